@@ -1,76 +1,440 @@
 package cmd
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/networkop/cloudroutesync/pkg/config"
+	"github.com/networkop/cloudroutesync/pkg/filter"
+	"github.com/networkop/cloudroutesync/pkg/health"
+	"github.com/networkop/cloudroutesync/pkg/leader"
+	"github.com/networkop/cloudroutesync/pkg/metrics"
 	"github.com/networkop/cloudroutesync/pkg/monitor"
 	"github.com/networkop/cloudroutesync/pkg/reconciler"
 	"github.com/networkop/cloudroutesync/pkg/route"
+	"github.com/networkop/cloudroutesync/pkg/state"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	cloud          = flag.String("cloud", "", "public cloud providers [azure|aws|gcp]")
-	netlinkPollSec = flag.Int("netlink", 10, "netlink polling interval in seconds")
+	configFile     = flag.String("config", "", "path to YAML/JSON configuration file, flags and env vars take precedence")
+	cloud          = flag.String("cloud", "", "public cloud providers [azure|aws|gcp|openstack|fake]")
+	netlinkPollSec = flag.Int("netlink", 300, "interval in seconds of full netlink resyncs, a safety net for missed route updates")
 	cloudSyncSec   = flag.Int("sync", 10, "cloud routing table sync interval in seconds")
 	enableSync     = flag.Bool("event", false, "enable event-based sync (default is periodic, controlled by 'sync')")
 	debug          = flag.Bool("debug", false, "enable debug logging")
 	cleanup        = flag.Bool("cleanup", false, "cleanup any created objects")
+	dryRun         = flag.Bool("dry-run", false, "print planned cloud route table changes instead of applying them")
+	output         = flag.String("output", "text", "format of planned changes [text|json]")
+	tables         = flag.String("tables", "main", "comma-separated routing table IDs, names or VRF devices to read routes from")
+	protocols      = flag.String("protocols", "", "comma-separated route protocols to sync, e.g. 'bgp,zebra' or '186' (default any)")
+	interfaces     = flag.String("interfaces", "", "comma-separated outgoing interfaces to sync routes from (default any)")
+	minMetric      = flag.Uint("metric-min", 0, "minimum route metric to sync")
+	maxMetric      = flag.Uint("metric-max", 0, "maximum route metric to sync, 0 means no limit")
+	withdraw       = flag.Bool("withdraw", false, "withdraw all owned cloud routes on shutdown")
+	shutdownSec    = flag.Int("shutdown-timeout", 30, "seconds to wait for in-flight cloud API calls on shutdown")
+	listen         = flag.String("listen", "", "address of the HTTP server exposing /metrics, /healthz and /readyz, e.g. ':9400' (default disabled)")
+	staleness      = flag.Int("staleness", 60, "seconds since the last successful sync before health checks fail")
+	leaderElect    = flag.String("leader-elect", "", "leader election backend [cloud|kubernetes|file] (default disabled)")
+	leaderID       = flag.String("leader-id", "", "identity used in leader election (default hostname)")
+	leaseSec       = flag.Int("lease-duration", 15, "seconds after which a standby takes over a lease that has not been renewed")
+	leaseFile      = flag.String("lease-file", "", "lock file of the file leader election backend")
+	statePath      = flag.String("state", "/var/lib/cloudroutesync/state.json", "file or s3://bucket/key recording created routes")
+	prefixList     filter.PrefixList
 
 	supportedClouds = struct {
-		azure string
-		aws   string
-		gcp   string
+		azure     string
+		aws       string
+		gcp       string
+		openstack string
+		fake      string
 	}{
-		azure: "azure",
-		aws:   "aws",
-		gcp:   "gcp",
+		azure:     "azure",
+		aws:       "aws",
+		gcp:       "gcp",
+		openstack: "openstack",
+		fake:      "fake",
 	}
 )
 
+func init() {
+	flag.Var(&prefixList, "prefix-list", "prefix list entry 'permit|deny PREFIX [ge N] [le N]', can be repeated, first match wins")
+}
+
 func Run() error {
 
 	flag.Parse()
 
-	if *debug {
-		logrus.SetLevel(logrus.DebugLevel)
+	// Subcommands can be placed either before or after the flags
+	command := flag.Arg(0)
+	if command != "" {
+		if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+			return err
+		}
+	}
+
+	switch command {
+	case "", "plan":
+	default:
+		flag.Usage()
+		return fmt.Errorf("Unknown command: %s", command)
+	}
+
+	cfg := config.Default()
+	if *configFile != "" {
+		var err error
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			return err
+		}
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return err
+	}
+	applyFlags(cfg)
+
+	if err := cfg.Validate(); err != nil {
+		flag.Usage()
+		return err
+	}
+
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("Unknown output format: %s", *output)
+	}
+
+	cfg.SetupLogging()
+
+	filterConfig, err := cfg.FilterConfig()
+	if err != nil {
+		return err
+	}
+
+	routeFilter, err := filter.New(filterConfig)
+	if err != nil {
+		return fmt.Errorf("Failed to build route filter: %s", err)
+	}
+
+	stateStore, err := state.New(cfg.State.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to build state store: %s", err)
+	}
+
+	opts := reconciler.Options{
+		OwnerTag:       cfg.OwnerTag,
+		ReservedRanges: cfg.ParsedReservedRanges(),
+		DryRun:         *dryRun,
+		PlanFormat:     *output,
+		State:          stateStore,
+		Targets: reconciler.Targets{
+			IDs:  cfg.Targets.IDs,
+			Tags: cfg.Targets.Tags,
+			All:  cfg.Targets.All,
+		},
 	}
 
 	var client reconciler.CloudClient
-	var err error
 
-	switch *cloud {
+	switch cfg.Cloud {
 	case supportedClouds.azure:
 		logrus.Info("Running on Azure")
-		client, err = reconciler.NewAzureClient()
+		settings := reconciler.AzureSettings{
+			SubscriptionID:   cfg.Azure.SubscriptionID,
+			ResourceGroup:    cfg.Azure.ResourceGroup,
+			IdentityClientID: cfg.Azure.IdentityClientID,
+		}
+		if cfg.Azure.Mode == "routeServer" {
+			settings.RouteServer = cfg.Azure.RouteServer.Name
+			settings.RouteServerResourceGroup = cfg.Azure.RouteServer.ResourceGroup
+			settings.PeerASN = cfg.Azure.RouteServer.PeerASN
+		}
+		client, err = reconciler.NewAzureClient(opts, settings)
 	case supportedClouds.aws:
 		logrus.Info("Running on AWS")
-		client, err = reconciler.NewAwsClient()
+		client, err = reconciler.NewAwsClient(opts, cfg.AWS.RouteTable)
 	case supportedClouds.gcp:
 		logrus.Info("Running on GCP")
-		client, err = reconciler.NewGcpClient()
+		client, err = reconciler.NewGcpClient(opts, reconciler.GcpSettings{
+			Priority:        cfg.GCP.Priority,
+			Tags:            cfg.GCP.Tags,
+			NextHopInstance: cfg.GCP.NextHopInstance,
+			ForwardingRule:  cfg.GCP.ILB.ForwardingRule,
+			InstanceGroup:   cfg.GCP.ILB.InstanceGroup,
+		})
+	case supportedClouds.openstack:
+		logrus.Info("Running on OpenStack")
+		client, err = reconciler.NewOpenStackClient(opts, cfg.OpenStack.Mode, cfg.OpenStack.RouterID)
+	case supportedClouds.fake:
+		logrus.Info("Running on the in-memory fake cloud")
+		latency := time.Duration(cfg.Fake.Latency) * time.Millisecond
+		client = reconciler.NewFakeClient(opts, cfg.Fake.MaxRoutes, latency, cfg.Fake.FailureRate)
 	default:
 		flag.Usage()
-		return fmt.Errorf("Unsupported/Undefined cloud provider: %v", *cloud)
+		return fmt.Errorf("Unsupported/Undefined cloud provider: %v", cfg.Cloud)
 	}
 	if err != nil {
-		fmt.Errorf("Failed to build API client: %s", err)
+		return fmt.Errorf("Failed to build API client: %s", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			logrus.Infof("Received %s, shutting down", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
 	if *cleanup {
-		if err := client.Cleanup(); err != nil {
+		if err := client.Cleanup(ctx); err != nil {
 			return err
 		}
 		return nil
 	}
-	syncCh := make(chan bool)
+	syncCh := make(chan bool, 1)
 
 	rt := route.New(syncCh)
 
-	go monitor.Start(rt, *netlinkPollSec)
+	if command == "plan" {
+		return plan(ctx, client, rt, routeFilter)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 3)
+	run := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Errors caused by cancellation are expected during shutdown
+			if err := f(); err != nil && ctx.Err() == nil {
+				errCh <- err
+			}
+		}()
+	}
 
-	go client.Reconcile(rt, *enableSync, *cloudSyncSec)
+	if cfg.HTTP.Listen != "" {
+		health.SetStaleness(time.Duration(cfg.HTTP.Staleness) * time.Second)
+		run(func() error {
+			return serveHTTP(ctx, cfg.HTTP.Listen, client)
+		})
+	}
+
+	run(func() error {
+		return monitor.Start(ctx, rt, routeFilter, cfg.Netlink.ResyncInterval)
+	})
+
+	if manager, ok := client.(reconciler.BackendManager); ok {
+		run(func() error {
+			return manager.ManageBackend(ctx, rt, cfg.Sync.Interval)
+		})
+	}
+
+	reconcile := func(ctx context.Context) error {
+		return client.Reconcile(ctx, rt, cfg.Sync.Event, cfg.Sync.Interval)
+	}
+
+	if cfg.LeaderElection.Backend != "" {
+		elector, err := newElector(ctx, cfg, client, rt)
+		if err != nil {
+			cancel()
+			shutdown(client, &wg, cfg.Shutdown)
+			return err
+		}
+
+		health.SetStandby(true)
+		run(func() error {
+			return elector.Run(ctx, func(ctx context.Context) error {
+				health.SetStandby(false)
+				metrics.SetLeader(true)
+				defer health.SetStandby(true)
+				defer metrics.SetLeader(false)
+				return reconcile(ctx)
+			})
+		})
+	} else {
+		metrics.SetLeader(true)
+		run(func() error {
+			return reconcile(ctx)
+		})
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+	case runErr = <-errCh:
+		cancel()
+	}
+
+	shutdown(client, &wg, cfg.Shutdown)
+
+	return runErr
+}
+
+// newElector builds a leader elector with the configured lock backend
+func newElector(ctx context.Context, cfg *config.Config, client reconciler.CloudClient, rt *route.Table) (*leader.Elector, error) {
+	identity := cfg.LeaderElection.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get hostname: %s", err)
+		}
+		identity = hostname
+	}
+
+	var store leader.Store
+	switch cfg.LeaderElection.Backend {
+	case "file":
+		store = leader.NewFileStore(cfg.LeaderElection.File)
+	case "kubernetes":
+		var err error
+		store, err = leader.NewKubernetesStore(cfg.LeaderElection.Namespace, cfg.OwnerTag)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to build Kubernetes lease store: %s", err)
+		}
+	case "cloud":
+		provider, ok := client.(reconciler.LeaseProvider)
+		if !ok {
+			return nil, fmt.Errorf("Cloud %s does not support leader election", cfg.Cloud)
+		}
+		var err error
+		store, err = provider.LeaseStore(ctx, rt)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to build cloud lease store: %s", err)
+		}
+	}
+
+	logrus.Infof("Starting leader election as %s using %s backend", identity, cfg.LeaderElection.Backend)
+	return leader.NewElector(store, identity, time.Duration(cfg.LeaderElection.LeaseDuration)*time.Second), nil
+}
+
+// serveHTTP exposes metrics and health checks until ctx is cancelled
+func serveHTTP(ctx context.Context, addr string, client reconciler.CloudClient) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", health.Liveness())
+	mux.Handle("/readyz", health.Readiness())
+	// The fake cloud exposes its state for local testing
+	if fake, ok := client.(*reconciler.FakeClient); ok {
+		mux.Handle("/fake/", fake)
+	}
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	logrus.Infof("Serving metrics and health checks on %s", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return fmt.Errorf("HTTP server failed: %s", err)
+	}
+	return nil
+}
+
+// shutdown waits for running goroutines to return and optionally withdraws owned routes
+func shutdown(client reconciler.CloudClient, wg *sync.WaitGroup, cfg config.ShutdownConfig) {
+	timeout := time.Duration(cfg.Timeout) * time.Second
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logrus.Infof("Timed out after %s waiting for in-flight operations", timeout)
+	}
+
+	if cfg.Withdraw {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := client.Withdraw(ctx); err != nil {
+			logrus.Errorf("Failed to withdraw routes: %s", err)
+		}
+	}
+
+	logrus.Info("Shutdown complete")
+}
+
+// applyFlags overrides configuration with explicitly set flags only
+func applyFlags(cfg *config.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "cloud":
+			cfg.Cloud = *cloud
+		case "netlink":
+			cfg.Netlink.ResyncInterval = *netlinkPollSec
+		case "sync":
+			cfg.Sync.Interval = *cloudSyncSec
+		case "event":
+			cfg.Sync.Event = *enableSync
+		case "debug":
+			if *debug {
+				cfg.Log.Level = logrus.DebugLevel.String()
+			}
+		case "tables":
+			cfg.Filter.Tables = filter.ParseList(*tables)
+		case "protocols":
+			cfg.Filter.Protocols = filter.ParseList(*protocols)
+		case "interfaces":
+			cfg.Filter.Interfaces = filter.ParseList(*interfaces)
+		case "metric-min":
+			cfg.Filter.MetricMin = uint32(*minMetric)
+		case "metric-max":
+			cfg.Filter.MetricMax = uint32(*maxMetric)
+		case "listen":
+			cfg.HTTP.Listen = *listen
+		case "staleness":
+			cfg.HTTP.Staleness = *staleness
+		case "leader-elect":
+			cfg.LeaderElection.Backend = *leaderElect
+		case "leader-id":
+			cfg.LeaderElection.Identity = *leaderID
+		case "lease-duration":
+			cfg.LeaderElection.LeaseDuration = *leaseSec
+		case "lease-file":
+			cfg.LeaderElection.File = *leaseFile
+		case "state":
+			cfg.State.Path = *statePath
+		case "withdraw":
+			cfg.Shutdown.Withdraw = *withdraw
+		case "shutdown-timeout":
+			cfg.Shutdown.Timeout = *shutdownSec
+		case "prefix-list":
+			cfg.Filter.PrefixList = nil
+			for _, entry := range prefixList {
+				cfg.Filter.PrefixList = append(cfg.Filter.PrefixList, entry.String())
+			}
+		}
+	})
+}
+
+// plan prints changes that would be made to the cloud route table
+func plan(ctx context.Context, client reconciler.CloudClient, rt *route.Table, routeFilter *filter.Filter) error {
+	if err := monitor.Dump(rt, routeFilter); err != nil {
+		return err
+	}
+
+	p, err := client.Plan(ctx, rt)
+	if err != nil {
+		return fmt.Errorf("Failed to plan changes: %s", err)
+	}
 
-	select {}
+	return p.Print(os.Stdout, *output)
 }
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/networkop/cloudroutesync/pkg/config"
+)
+
+// Explicitly set flags take precedence over the environment and the configuration file, others are left alone
+func TestApplyFlags(t *testing.T) {
+	t.Setenv("CLOUDROUTESYNC_CLOUD", "gcp")
+	t.Setenv("CLOUDROUTESYNC_SYNC_INTERVAL", "30")
+
+	cfg := config.Default()
+	cfg.OwnerTag = "from-file"
+	if err := cfg.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flag.Set("sync", "45"); err != nil {
+		t.Fatal(err)
+	}
+	applyFlags(cfg)
+
+	if cfg.Sync.Interval != 45 {
+		t.Errorf("flag does not take precedence over the environment, sync interval is %d", cfg.Sync.Interval)
+	}
+	if cfg.Cloud != "gcp" || cfg.OwnerTag != "from-file" || cfg.Netlink.ResyncInterval != 300 {
+		t.Errorf("unset flags have overridden the configuration: %+v", cfg)
+	}
+}
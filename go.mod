@@ -10,10 +10,14 @@ require (
 	github.com/Azure/go-autorest/autorest/to v0.4.0
 	github.com/Azure/go-autorest/autorest/validation v0.3.0 // indirect
 	github.com/aws/aws-sdk-go v1.35.5
+	github.com/gophercloud/gophercloud v0.13.0
 	github.com/jsimonetti/rtnetlink v0.0.0-20201002145915-c293b6793422
+	github.com/mdlayher/netlink v1.1.0
+	github.com/prometheus/client_golang v1.7.0
 	github.com/sirupsen/logrus v1.7.0
 	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
 	golang.org/x/sys v0.0.0-20200905004654-be1d3432aa8f
 	google.golang.org/api v0.32.0
 	google.golang.org/appengine v1.6.6
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,525 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/networkop/cloudroutesync/pkg/filter"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// SupportedClouds is a list of valid cloud providers
+var SupportedClouds = []string{"azure", "aws", "gcp", "openstack", "fake"}
+
+// Config describes all cloudroutesync settings
+// JSON files are parsed as well, since JSON is a subset of YAML
+type Config struct {
+	Cloud          string          `yaml:"cloud"`
+	Netlink        NetlinkConfig   `yaml:"netlink"`
+	Sync           SyncConfig      `yaml:"sync"`
+	Filter         FilterConfig    `yaml:"filter"`
+	ReservedRanges []string        `yaml:"reservedRanges"`
+	OwnerTag       string          `yaml:"ownerTag"`
+	Shutdown       ShutdownConfig  `yaml:"shutdown"`
+	HTTP           HTTPConfig      `yaml:"http"`
+	LeaderElection LeaderConfig    `yaml:"leaderElection"`
+	State          StateConfig     `yaml:"state"`
+	Targets        TargetsConfig   `yaml:"targets"`
+	AWS            AwsConfig       `yaml:"aws"`
+	GCP            GcpConfig       `yaml:"gcp"`
+	Azure          AzureConfig     `yaml:"azure"`
+	OpenStack      OpenStackConfig `yaml:"openstack"`
+	Fake           FakeConfig      `yaml:"fake"`
+	Log            LogConfig       `yaml:"log"`
+}
+
+// NetlinkConfig defines how local routes are read
+type NetlinkConfig struct {
+	ResyncInterval int `yaml:"resyncInterval"`
+}
+
+// SyncConfig defines how cloud routing table is updated
+type SyncConfig struct {
+	Interval int  `yaml:"interval"`
+	Event    bool `yaml:"event"`
+}
+
+// ShutdownConfig defines what happens on SIGINT/SIGTERM
+type ShutdownConfig struct {
+	Timeout  int  `yaml:"timeout"`
+	Withdraw bool `yaml:"withdraw"`
+}
+
+// HTTPConfig defines the HTTP server exposing metrics and health checks
+type HTTPConfig struct {
+	Listen string `yaml:"listen"`
+	// Staleness is the maximum age in seconds of the last successful sync reported as healthy
+	Staleness int `yaml:"staleness"`
+}
+
+// LeaderConfig defines leader election between multiple instances
+type LeaderConfig struct {
+	// Backend is one of cloud|kubernetes|file, empty disables leader election
+	Backend string `yaml:"backend"`
+	// Identity defaults to the hostname
+	Identity string `yaml:"identity"`
+	// LeaseDuration in seconds
+	LeaseDuration int `yaml:"leaseDuration"`
+	// File is the path of the lock file for the file backend
+	File string `yaml:"file"`
+	// Namespace of the Kubernetes Lease, defaults to the pod namespace
+	Namespace string `yaml:"namespace"`
+}
+
+// StateConfig defines where routes created by cloudroutesync are recorded
+type StateConfig struct {
+	// Path is either a local file or s3://bucket/key
+	Path string `yaml:"path"`
+}
+
+// TargetsConfig selects the subnets or route tables that receive routes, only the local subnet if empty
+type TargetsConfig struct {
+	// IDs of AWS route tables or subnets, names or resource IDs of Azure subnets
+	IDs []string `yaml:"ids"`
+	// Tags of AWS subnets or Azure VNETs, all of them must match
+	Tags map[string]string `yaml:"tags"`
+	// All subnets of the local VPC or VNET
+	All bool `yaml:"all"`
+}
+
+// Empty returns true if only the local subnet is targeted
+func (t TargetsConfig) Empty() bool {
+	return len(t.IDs) == 0 && len(t.Tags) == 0 && !t.All
+}
+
+// TargetClouds is a list of clouds that support multiple targets
+var TargetClouds = []string{"aws", "azure"}
+
+// LeaderBackends is a list of valid leader election backends
+var LeaderBackends = []string{"cloud", "kubernetes", "file"}
+
+// LeaseClouds is a list of clouds that can hold a lease with conditional writes, as required by the cloud backend
+var LeaseClouds = []string{"gcp"}
+
+// MinCloudLeaseDuration in seconds leaves room for several slow cloud lease renewals before the leader steps down
+const MinCloudLeaseDuration = 120
+
+// FilterConfig defines which local routes get synced
+type FilterConfig struct {
+	Tables     []string `yaml:"tables"`
+	Protocols  []string `yaml:"protocols"`
+	Interfaces []string `yaml:"interfaces"`
+	MetricMin  uint32   `yaml:"metricMin"`
+	MetricMax  uint32   `yaml:"metricMax"`
+	PrefixList []string `yaml:"prefixList"`
+}
+
+// AwsConfig defines which AWS route table is managed
+type AwsConfig struct {
+	// RouteTable is empty for a dedicated route table, "subnet" for the current table of the local subnet or a route table ID
+	RouteTable string `yaml:"routeTable"`
+}
+
+// GcpConfig defines how GCP routes are created
+type GcpConfig struct {
+	// Priority of all routes, lower values win, ECMP routes always share it
+	Priority int64 `yaml:"priority"`
+	// Tags limit routes to instances with any of these network tags, all instances of the network if empty
+	Tags []string `yaml:"tags"`
+	// NextHopInstance points routes to the router instance instead of its IP
+	NextHopInstance bool `yaml:"nextHopInstance"`
+	// ILB points routes to an internal load balancer in front of several routers
+	ILB GcpIlbConfig `yaml:"ilb"`
+}
+
+// GcpIlbConfig defines the internal passthrough load balancer used as next hop
+type GcpIlbConfig struct {
+	// ForwardingRule name in the region of the router, empty disables ILB next hops
+	ForwardingRule string `yaml:"forwardingRule"`
+	// InstanceGroup is an unmanaged instance group in the zone of the router, which is a backend of the ILB
+	// The local instance is a member while it has routes to sync, membership is not managed if empty
+	InstanceGroup string `yaml:"instanceGroup"`
+}
+
+// gcpNetworkTag matches valid GCP network tags
+var gcpNetworkTag = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// AzureConfig stores Azure-specific identifiers
+// Subscription and resource group default to the ones of the local VM
+type AzureConfig struct {
+	SubscriptionID string `yaml:"subscriptionID"`
+	ResourceGroup  string `yaml:"resourceGroup"`
+	// IdentityClientID selects a user-assigned managed identity, credentials from the environment or the system-assigned identity are used if empty
+	IdentityClientID string `yaml:"identityClientID"`
+	// Mode is either udr (route table) or routeServer (BGP peering with Azure Route Server)
+	Mode        string                 `yaml:"mode"`
+	RouteServer AzureRouteServerConfig `yaml:"routeServer"`
+}
+
+// AzureRouteServerConfig defines the Azure Route Server peered with in routeServer mode
+type AzureRouteServerConfig struct {
+	Name string `yaml:"name"`
+	// ResourceGroup defaults to the resource group of the route table
+	ResourceGroup string `yaml:"resourceGroup"`
+	// PeerASN is the BGP ASN of the local routing daemon
+	PeerASN int64 `yaml:"peerASN"`
+}
+
+// AzureModes is a list of valid Azure route targets
+var AzureModes = []string{"udr", "routeServer"}
+
+// azureReservedASNs can not be used by Route Server peers
+var azureReservedASNs = map[int64]bool{8074: true, 8075: true, 12076: true, 65515: true, 65516: true, 65517: true, 65518: true, 65519: true, 65520: true}
+
+// OpenStackConfig defines where OpenStack routes are installed
+type OpenStackConfig struct {
+	// Mode is either router (router extra routes) or subnet (subnet host routes)
+	Mode string `yaml:"mode"`
+	// RouterID defaults to the router attached to the local subnet
+	RouterID string `yaml:"routerID"`
+}
+
+// OpenStackModes is a list of valid OpenStack route targets
+var OpenStackModes = []string{"router", "subnet"}
+
+// FakeConfig defines limits and failures of the in-memory fake cloud
+type FakeConfig struct {
+	// MaxRoutes limits the size of the route table, 0 means no limit
+	MaxRoutes int `yaml:"maxRoutes"`
+	// Latency of every API call in milliseconds
+	Latency int `yaml:"latency"`
+	// FailureRate is the probability of any API call failing, between 0 and 1
+	FailureRate float64 `yaml:"failureRate"`
+}
+
+// LogConfig defines logging level and format
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// Default returns configuration matching the default flag values
+func Default() *Config {
+	return &Config{
+		Netlink: NetlinkConfig{
+			ResyncInterval: 300,
+		},
+		Sync: SyncConfig{
+			Interval: 10,
+		},
+		Filter: FilterConfig{
+			Tables: []string{"main"},
+		},
+		OwnerTag: "cloudroutesync",
+		Shutdown: ShutdownConfig{
+			Timeout: 30,
+		},
+		HTTP: HTTPConfig{
+			Staleness: 60,
+		},
+		LeaderElection: LeaderConfig{
+			LeaseDuration: 15,
+		},
+		State: StateConfig{
+			Path: "/var/lib/cloudroutesync/state.json",
+		},
+		GCP: GcpConfig{
+			Priority: 1000,
+		},
+		Azure: AzureConfig{
+			Mode: "udr",
+		},
+		OpenStack: OpenStackConfig{
+			Mode: "router",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// Load reads configuration file on top of the defaults
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config file: %s", err)
+	}
+
+	cfg := Default()
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("Failed to parse config file %s: %s", path, err)
+	}
+
+	logrus.Debugf("Loaded config file %s", path)
+	return cfg, nil
+}
+
+// ApplyEnv overrides configuration with environment variables
+func (c *Config) ApplyEnv() error {
+	stringVars := map[string]*string{
+		"CLOUDROUTESYNC_CLOUD":     &c.Cloud,
+		"CLOUDROUTESYNC_OWNER_TAG": &c.OwnerTag,
+		"CLOUDROUTESYNC_LOG_LEVEL": &c.Log.Level,
+		"AZURE_SUBSCRIPTION_ID":    &c.Azure.SubscriptionID,
+		"AZURE_RESOURCE_GROUP":     &c.Azure.ResourceGroup,
+	}
+	for name, value := range stringVars {
+		if env := os.Getenv(name); env != "" {
+			*value = env
+		}
+	}
+
+	intVars := map[string]*int{
+		"CLOUDROUTESYNC_NETLINK_RESYNC_INTERVAL": &c.Netlink.ResyncInterval,
+		"CLOUDROUTESYNC_SYNC_INTERVAL":           &c.Sync.Interval,
+	}
+	for name, value := range intVars {
+		env := os.Getenv(name)
+		if env == "" {
+			continue
+		}
+		i, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("Invalid value of %s: %s", name, err)
+		}
+		*value = i
+	}
+
+	return nil
+}
+
+// Validate checks the whole configuration and reports all errors at once
+func (c *Config) Validate() error {
+	var errs []string
+
+	if !isSupported(c.Cloud) {
+		errs = append(errs, fmt.Sprintf("unsupported/undefined cloud provider %q, must be one of %s", c.Cloud, strings.Join(SupportedClouds, "|")))
+	}
+
+	if c.Netlink.ResyncInterval <= 0 {
+		errs = append(errs, fmt.Sprintf("netlink resync interval must be positive, got %d", c.Netlink.ResyncInterval))
+	}
+
+	if c.Sync.Interval <= 0 {
+		errs = append(errs, fmt.Sprintf("sync interval must be positive, got %d", c.Sync.Interval))
+	}
+
+	if c.Filter.MetricMax != 0 && c.Filter.MetricMin > c.Filter.MetricMax {
+		errs = append(errs, fmt.Sprintf("minimum metric %d is greater than maximum %d", c.Filter.MetricMin, c.Filter.MetricMax))
+	}
+
+	for _, entry := range c.Filter.PrefixList {
+		if _, err := filter.ParsePrefixListEntry(entry); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	for _, prefix := range c.ReservedRanges {
+		if _, _, err := net.ParseCIDR(prefix); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid reserved range %q: %s", prefix, err))
+		}
+	}
+
+	if c.Shutdown.Timeout <= 0 {
+		errs = append(errs, fmt.Sprintf("shutdown timeout must be positive, got %d", c.Shutdown.Timeout))
+	}
+
+	if c.HTTP.Staleness <= 0 {
+		errs = append(errs, fmt.Sprintf("staleness window must be positive, got %d", c.HTTP.Staleness))
+	}
+
+	if c.HTTP.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.Listen); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid HTTP listen address %q: %s", c.HTTP.Listen, err))
+		}
+	}
+
+	if le := c.LeaderElection; le.Backend != "" {
+		if !contains(LeaderBackends, le.Backend) {
+			errs = append(errs, fmt.Sprintf("unknown leader election backend %q, must be one of %s", le.Backend, strings.Join(LeaderBackends, "|")))
+		}
+		if le.LeaseDuration < 5 {
+			errs = append(errs, fmt.Sprintf("lease duration must be at least 5 seconds, got %d", le.LeaseDuration))
+		}
+		if le.Backend == "cloud" && le.LeaseDuration < MinCloudLeaseDuration {
+			errs = append(errs, fmt.Sprintf("lease duration of the cloud backend must be at least %d seconds, got %d", MinCloudLeaseDuration, le.LeaseDuration))
+		}
+		if le.Backend == "cloud" && isSupported(c.Cloud) && !contains(LeaseClouds, c.Cloud) {
+			errs = append(errs, fmt.Sprintf("cloud leader election backend is only supported on %s, %s tags can not be updated conditionally", strings.Join(LeaseClouds, "|"), c.Cloud))
+		}
+		if le.Backend == "file" && le.File == "" {
+			errs = append(errs, "file leader election backend requires a lock file")
+		}
+		if c.Shutdown.Withdraw {
+			errs = append(errs, "withdraw on shutdown can not be combined with leader election, the standby takes over the routes instead")
+		}
+		// Existing route tables only get owned routes replaced, a new leader has to know the ones of the previous leader
+		if c.Cloud == "aws" && (c.AWS.RouteTable != "" || !c.Targets.Empty()) && !strings.HasPrefix(c.State.Path, "s3://") {
+			errs = append(errs, "leader election with an existing AWS route table or targets requires a shared s3:// state")
+		}
+	}
+
+	if c.State.Path == "" {
+		errs = append(errs, "state path must not be empty")
+	} else if strings.HasPrefix(c.State.Path, "s3://") && strings.Count(strings.TrimPrefix(c.State.Path, "s3://"), "/") == 0 {
+		errs = append(errs, fmt.Sprintf("state location %q must be s3://bucket/key", c.State.Path))
+	}
+
+	if rt := c.AWS.RouteTable; rt != "" && rt != "subnet" && !strings.HasPrefix(rt, "rtb-") {
+		errs = append(errs, fmt.Sprintf("AWS route table must be empty, subnet or a route table ID, got %q", rt))
+	}
+
+	if c.GCP.Priority < 0 || c.GCP.Priority > 65535 {
+		errs = append(errs, fmt.Sprintf("GCP route priority must be between 0 and 65535, got %d", c.GCP.Priority))
+	}
+
+	for _, tag := range c.GCP.Tags {
+		if !gcpNetworkTag.MatchString(tag) {
+			errs = append(errs, fmt.Sprintf("invalid GCP network tag %q", tag))
+		}
+	}
+
+	if ilb := c.GCP.ILB; ilb.ForwardingRule != "" || ilb.InstanceGroup != "" {
+		if ilb.ForwardingRule == "" {
+			errs = append(errs, "GCP ILB instance group requires a forwarding rule")
+		}
+		if c.GCP.NextHopInstance {
+			errs = append(errs, "GCP routes can point either to the router instance or to the ILB")
+		}
+		// Route names only depend on the owner tag, so routers behind the same ILB would fight over them
+		if ilb.ForwardingRule != "" && c.LeaderElection.Backend == "" {
+			errs = append(errs, "GCP ILB forwarding rule requires leader election, all routers manage the same routes")
+		}
+		if strings.Contains(ilb.ForwardingRule, "/") || strings.Contains(ilb.InstanceGroup, "/") {
+			errs = append(errs, "GCP ILB forwarding rule and instance group must be names, not URLs")
+		}
+	}
+
+	if t := c.Targets; len(t.IDs) > 0 || len(t.Tags) > 0 || t.All {
+		if isSupported(c.Cloud) && !contains(TargetClouds, c.Cloud) {
+			errs = append(errs, fmt.Sprintf("targets are only supported on %s, %s routes apply to the whole network", strings.Join(TargetClouds, "|"), c.Cloud))
+		}
+		if c.Cloud == "aws" && c.AWS.RouteTable != "" {
+			errs = append(errs, "AWS route table can not be combined with targets, add it to target IDs instead")
+		}
+		if t.All && len(t.Tags) > 0 {
+			errs = append(errs, "targets can select either all subnets or subnets by tags")
+		}
+		if c.Cloud == "aws" {
+			for _, id := range t.IDs {
+				if !strings.HasPrefix(id, "rtb-") && !strings.HasPrefix(id, "subnet-") {
+					errs = append(errs, fmt.Sprintf("AWS target %q must be a route table or subnet ID", id))
+				}
+			}
+		}
+	}
+
+	if c.Cloud == "azure" && !contains(AzureModes, c.Azure.Mode) {
+		errs = append(errs, fmt.Sprintf("unknown Azure mode %q, must be one of %s", c.Azure.Mode, strings.Join(AzureModes, "|")))
+	}
+
+	if rs := c.Azure.RouteServer; c.Cloud == "azure" && c.Azure.Mode == "routeServer" {
+		if rs.Name == "" {
+			errs = append(errs, "Azure routeServer mode requires a Route Server name")
+		}
+		if rs.PeerASN < 1 || rs.PeerASN > 4294967295 || azureReservedASNs[rs.PeerASN] {
+			errs = append(errs, fmt.Sprintf("invalid Azure Route Server peer ASN %d", rs.PeerASN))
+		}
+		if t := c.Targets; len(t.IDs) > 0 || len(t.Tags) > 0 || t.All {
+			errs = append(errs, "targets can not be combined with Azure routeServer mode, Route Server routes apply to the whole VNET")
+		}
+	}
+
+	if c.Cloud == "openstack" && !contains(OpenStackModes, c.OpenStack.Mode) {
+		errs = append(errs, fmt.Sprintf("unknown OpenStack mode %q, must be one of %s", c.OpenStack.Mode, strings.Join(OpenStackModes, "|")))
+	}
+
+	if c.Fake.MaxRoutes < 0 {
+		errs = append(errs, fmt.Sprintf("fake cloud route limit must not be negative, got %d", c.Fake.MaxRoutes))
+	}
+
+	if c.Fake.Latency < 0 {
+		errs = append(errs, fmt.Sprintf("fake cloud latency must not be negative, got %d", c.Fake.Latency))
+	}
+
+	if c.Fake.FailureRate < 0 || c.Fake.FailureRate > 1 {
+		errs = append(errs, fmt.Sprintf("fake cloud failure rate must be between 0 and 1, got %g", c.Fake.FailureRate))
+	}
+
+	if c.OwnerTag == "" {
+		errs = append(errs, "owner tag must not be empty")
+	}
+
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		errs = append(errs, fmt.Sprintf("unknown log format %q, must be text|json", c.Log.Format))
+	}
+
+	if len(errs) > 0 {
+		return errors.New("Invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// FilterConfig converts configuration into route filter settings
+func (c *Config) FilterConfig() (filter.Config, error) {
+	var prefixList filter.PrefixList
+	for _, entry := range c.Filter.PrefixList {
+		if err := prefixList.Set(entry); err != nil {
+			return filter.Config{}, err
+		}
+	}
+
+	return filter.Config{
+		Tables:     c.Filter.Tables,
+		Protocols:  c.Filter.Protocols,
+		Interfaces: c.Filter.Interfaces,
+		MinMetric:  c.Filter.MetricMin,
+		MaxMetric:  c.Filter.MetricMax,
+		PrefixList: prefixList,
+	}, nil
+}
+
+// ParsedReservedRanges returns user-defined reserved ranges
+func (c *Config) ParsedReservedRanges() (result []*net.IPNet) {
+	for _, prefix := range c.ReservedRanges {
+		if _, ipNet, err := net.ParseCIDR(prefix); err == nil {
+			result = append(result, ipNet)
+		}
+	}
+	return result
+}
+
+// SetupLogging applies log level and format
+func (c *Config) SetupLogging() {
+	if level, err := logrus.ParseLevel(c.Log.Level); err == nil {
+		logrus.SetLevel(level)
+	}
+	if c.Log.Format == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+}
+
+func isSupported(cloud string) bool {
+	return contains(SupportedClouds, cloud)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
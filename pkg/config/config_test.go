@@ -0,0 +1,294 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		check   func(*Config) bool
+		wantErr bool
+	}{
+		{
+			name:  "no overrides",
+			check: func(c *Config) bool { return c.Cloud == "" && c.Sync.Interval == 10 && c.OwnerTag == "cloudroutesync" },
+		},
+		{
+			name:  "cloud",
+			env:   map[string]string{"CLOUDROUTESYNC_CLOUD": "gcp"},
+			check: func(c *Config) bool { return c.Cloud == "gcp" },
+		},
+		{
+			name: "intervals",
+			env: map[string]string{
+				"CLOUDROUTESYNC_NETLINK_RESYNC_INTERVAL": "600",
+				"CLOUDROUTESYNC_SYNC_INTERVAL":           "30",
+			},
+			check: func(c *Config) bool { return c.Netlink.ResyncInterval == 600 && c.Sync.Interval == 30 },
+		},
+		{
+			name:  "owner tag",
+			env:   map[string]string{"CLOUDROUTESYNC_OWNER_TAG": "router-a"},
+			check: func(c *Config) bool { return c.OwnerTag == "router-a" },
+		},
+		{
+			name:  "log level",
+			env:   map[string]string{"CLOUDROUTESYNC_LOG_LEVEL": "debug"},
+			check: func(c *Config) bool { return c.Log.Level == "debug" },
+		},
+		{
+			name: "Azure",
+			env: map[string]string{
+				"AZURE_SUBSCRIPTION_ID": "sub",
+				"AZURE_RESOURCE_GROUP":  "rg",
+			},
+			check: func(c *Config) bool { return c.Azure.SubscriptionID == "sub" && c.Azure.ResourceGroup == "rg" },
+		},
+		{
+			name:    "invalid interval",
+			env:     map[string]string{"CLOUDROUTESYNC_SYNC_INTERVAL": "10s"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{
+				"CLOUDROUTESYNC_CLOUD", "CLOUDROUTESYNC_NETLINK_RESYNC_INTERVAL", "CLOUDROUTESYNC_SYNC_INTERVAL",
+				"CLOUDROUTESYNC_OWNER_TAG", "CLOUDROUTESYNC_LOG_LEVEL", "AZURE_SUBSCRIPTION_ID", "AZURE_RESOURCE_GROUP",
+			} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			cfg := Default()
+			err := cfg.ApplyEnv()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("unexpected configuration %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	data := "cloud: aws\nsync:\n  interval: 20\nownerTag: from-file\nlog:\n  format: json\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("CLOUDROUTESYNC_SYNC_INTERVAL", "30")
+	t.Setenv("CLOUDROUTESYNC_OWNER_TAG", "")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		t.Fatalf("ApplyEnv: %s", err)
+	}
+
+	if cfg.Cloud != "aws" || cfg.OwnerTag != "from-file" || cfg.Log.Format != "json" {
+		t.Errorf("file values have not been kept: %+v", cfg)
+	}
+	if cfg.Sync.Interval != 30 {
+		t.Errorf("environment does not take precedence over the file, sync interval is %d", cfg.Sync.Interval)
+	}
+	if cfg.Netlink.ResyncInterval != 300 || cfg.Log.Level != "info" {
+		t.Errorf("defaults have not been kept: %+v", cfg)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("unknown: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Errorf("expected an error for an unknown key")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		// wantErr is a substring of the expected error, empty if the configuration is valid
+		wantErr string
+	}{
+		{
+			name:   "defaults",
+			modify: func(c *Config) {},
+		},
+		{
+			name:    "no cloud",
+			modify:  func(c *Config) { c.Cloud = "" },
+			wantErr: "unsupported/undefined cloud provider",
+		},
+		{
+			name:    "non-positive sync interval",
+			modify:  func(c *Config) { c.Sync.Interval = 0 },
+			wantErr: "sync interval must be positive",
+		},
+		{
+			name:    "invalid prefix list",
+			modify:  func(c *Config) { c.Filter.PrefixList = []string{"permit 10.0.0.0/8 ge 4"} },
+			wantErr: "Prefix lengths must satisfy",
+		},
+		{
+			name: "leader election",
+			modify: func(c *Config) {
+				c.LeaderElection.Backend = "file"
+				c.LeaderElection.File = "/tmp/lease"
+			},
+		},
+		{
+			name:    "unknown leader election backend",
+			modify:  func(c *Config) { c.LeaderElection.Backend = "etcd" },
+			wantErr: "unknown leader election backend",
+		},
+		{
+			name:    "file backend without lock file",
+			modify:  func(c *Config) { c.LeaderElection.Backend = "file" },
+			wantErr: "requires a lock file",
+		},
+		{
+			name: "withdraw with leader election",
+			modify: func(c *Config) {
+				c.LeaderElection.Backend = "kubernetes"
+				c.Shutdown.Withdraw = true
+			},
+			wantErr: "withdraw on shutdown can not be combined with leader election",
+		},
+		{
+			name: "cloud lease on GCP",
+			modify: func(c *Config) {
+				c.Cloud = "gcp"
+				c.LeaderElection.Backend = "cloud"
+				c.LeaderElection.LeaseDuration = MinCloudLeaseDuration
+			},
+		},
+		{
+			name: "short cloud lease",
+			modify: func(c *Config) {
+				c.Cloud = "gcp"
+				c.LeaderElection.Backend = "cloud"
+			},
+			wantErr: "lease duration of the cloud backend must be at least",
+		},
+		{
+			name: "cloud lease on AWS",
+			modify: func(c *Config) {
+				c.LeaderElection.Backend = "cloud"
+				c.LeaderElection.LeaseDuration = MinCloudLeaseDuration
+			},
+			wantErr: "cloud leader election backend is only supported on gcp",
+		},
+		{
+			name: "leader election with existing AWS route table and local state",
+			modify: func(c *Config) {
+				c.LeaderElection.Backend = "kubernetes"
+				c.AWS.RouteTable = "subnet"
+			},
+			wantErr: "requires a shared s3:// state",
+		},
+		{
+			name: "leader election with AWS targets and S3 state",
+			modify: func(c *Config) {
+				c.LeaderElection.Backend = "kubernetes"
+				c.Targets.All = true
+				c.State.Path = "s3://bucket/state.json"
+			},
+		},
+		{
+			name: "GCP ILB with leader election",
+			modify: func(c *Config) {
+				c.Cloud = "gcp"
+				c.GCP.ILB.ForwardingRule = "ilb"
+				c.LeaderElection.Backend = "kubernetes"
+			},
+		},
+		{
+			name: "GCP ILB without leader election",
+			modify: func(c *Config) {
+				c.Cloud = "gcp"
+				c.GCP.ILB.ForwardingRule = "ilb"
+			},
+			wantErr: "GCP ILB forwarding rule requires leader election",
+		},
+		{
+			name: "GCP ILB instance group without forwarding rule",
+			modify: func(c *Config) {
+				c.Cloud = "gcp"
+				c.GCP.ILB.InstanceGroup = "routers"
+			},
+			wantErr: "GCP ILB instance group requires a forwarding rule",
+		},
+		{
+			name: "targets on GCP",
+			modify: func(c *Config) {
+				c.Cloud = "gcp"
+				c.Targets.All = true
+			},
+			wantErr: "targets are only supported on aws|azure",
+		},
+		{
+			name: "AWS route table with targets",
+			modify: func(c *Config) {
+				c.AWS.RouteTable = "rtb-1"
+				c.Targets.IDs = []string{"subnet-1"}
+			},
+			wantErr: "AWS route table can not be combined with targets",
+		},
+		{
+			name: "Azure Route Server without name",
+			modify: func(c *Config) {
+				c.Cloud = "azure"
+				c.Azure.Mode = "routeServer"
+				c.Azure.RouteServer.PeerASN = 65001
+			},
+			wantErr: "requires a Route Server name",
+		},
+		{
+			name:    "invalid log level",
+			modify:  func(c *Config) { c.Log.Level = "verbose" },
+			wantErr: "not a valid logrus Level",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Cloud = "aws"
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package diff
+
+import (
+	"sort"
+)
+
+// Route is a cloud-agnostic route, identified by its prefix and next hop
+type Route struct {
+	Prefix  string `json:"prefix"`
+	Nexthop string `json:"nexthop"`
+}
+
+// Replacement changes the next hop of an existing route
+type Replacement struct {
+	Prefix string
+	From   string
+	To     string
+}
+
+// Result holds the changes that turn current routes into proposed ones
+// All lists are sorted by prefix and next hop
+type Result struct {
+	Add     []Route
+	Delete  []Route
+	Replace []Replacement
+}
+
+// Routes compares current and proposed routes as sets keyed on (prefix, next hop)
+// Only current routes for which owned returns true get deleted or replaced, nil owns all of them
+// An owned route and a proposed route with the same prefix are paired into a replacement
+func Routes(current, proposed []Route, owned func(Route) bool) (result Result) {
+	existing := make(map[Route]bool, len(current))
+	for _, r := range current {
+		existing[r] = true
+	}
+
+	wanted := make(map[Route]bool, len(proposed))
+	for _, r := range proposed {
+		wanted[r] = true
+	}
+
+	// Candidates are grouped by prefix, so that they can be paired into replacements
+	deletes := make(map[string][]Route)
+	for r := range existing {
+		if !wanted[r] && (owned == nil || owned(r)) {
+			deletes[r.Prefix] = append(deletes[r.Prefix], r)
+		}
+	}
+	adds := make(map[string][]Route)
+	for r := range wanted {
+		if !existing[r] {
+			adds[r.Prefix] = append(adds[r.Prefix], r)
+		}
+	}
+
+	for prefix, toAdd := range adds {
+		toDelete := deletes[prefix]
+		sortRoutes(toAdd)
+		sortRoutes(toDelete)
+
+		for len(toAdd) > 0 && len(toDelete) > 0 {
+			result.Replace = append(result.Replace, Replacement{
+				Prefix: prefix,
+				From:   toDelete[0].Nexthop,
+				To:     toAdd[0].Nexthop,
+			})
+			toAdd, toDelete = toAdd[1:], toDelete[1:]
+		}
+		result.Add = append(result.Add, toAdd...)
+		deletes[prefix] = toDelete
+	}
+	for _, toDelete := range deletes {
+		result.Delete = append(result.Delete, toDelete...)
+	}
+
+	sortRoutes(result.Add)
+	sortRoutes(result.Delete)
+	sort.Slice(result.Replace, func(i, j int) bool {
+		if result.Replace[i].Prefix != result.Replace[j].Prefix {
+			return result.Replace[i].Prefix < result.Replace[j].Prefix
+		}
+		return result.Replace[i].From < result.Replace[j].From
+	})
+
+	return result
+}
+
+// Len returns the number of changes
+func (r Result) Len() int {
+	return len(r.Add) + len(r.Delete) + len(r.Replace)
+}
+
+// Flatten turns replacements into a delete and an add, for clouds that can't change a next hop in place
+// Deletes must be applied before adds, as clouds may not allow two routes with the same prefix
+func (r Result) Flatten() (toAdd, toDelete []Route) {
+	toAdd = append(toAdd, r.Add...)
+	toDelete = append(toDelete, r.Delete...)
+	for _, replace := range r.Replace {
+		toAdd = append(toAdd, Route{Prefix: replace.Prefix, Nexthop: replace.To})
+		toDelete = append(toDelete, Route{Prefix: replace.Prefix, Nexthop: replace.From})
+	}
+	sortRoutes(toAdd)
+	sortRoutes(toDelete)
+	return toAdd, toDelete
+}
+
+func sortRoutes(routes []Route) {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Prefix != routes[j].Prefix {
+			return routes[i].Prefix < routes[j].Prefix
+		}
+		return routes[i].Nexthop < routes[j].Nexthop
+	})
+}
@@ -0,0 +1,139 @@
+package diff
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	r := func(prefix, nexthop string) Route { return Route{Prefix: prefix, Nexthop: nexthop} }
+	onlyOwned := func(route Route) bool { return route.Nexthop != "foreign" }
+
+	tests := []struct {
+		name     string
+		current  []Route
+		proposed []Route
+		owned    func(Route) bool
+		want     Result
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "all new",
+			proposed: []Route{r("10.1.0.0/16", "a"), r("10.0.0.0/16", "a")},
+			want:     Result{Add: []Route{r("10.0.0.0/16", "a"), r("10.1.0.0/16", "a")}},
+		},
+		{
+			name:    "withdraw all",
+			current: []Route{r("10.0.0.0/16", "a"), r("10.1.0.0/16", "a")},
+			want:    Result{Delete: []Route{r("10.0.0.0/16", "a"), r("10.1.0.0/16", "a")}},
+		},
+		{
+			// The old nested loops added and deleted every route once per other route
+			name:     "in sync with many routes",
+			current:  []Route{r("10.0.0.0/16", "a"), r("10.1.0.0/16", "a"), r("10.2.0.0/16", "b")},
+			proposed: []Route{r("10.2.0.0/16", "b"), r("10.1.0.0/16", "a"), r("10.0.0.0/16", "a")},
+		},
+		{
+			name:     "one new among existing",
+			current:  []Route{r("10.0.0.0/16", "a"), r("10.1.0.0/16", "a")},
+			proposed: []Route{r("10.0.0.0/16", "a"), r("10.1.0.0/16", "a"), r("10.2.0.0/16", "a")},
+			want:     Result{Add: []Route{r("10.2.0.0/16", "a")}},
+		},
+		{
+			// The old GCP comparison ignored the prefix and only looked at the next hop
+			name:     "same next hop different prefix",
+			current:  []Route{r("10.0.0.0/16", "a")},
+			proposed: []Route{r("10.1.0.0/16", "a")},
+			want:     Result{Add: []Route{r("10.1.0.0/16", "a")}, Delete: []Route{r("10.0.0.0/16", "a")}},
+		},
+		{
+			name:     "next hop change",
+			current:  []Route{r("10.0.0.0/16", "a"), r("10.1.0.0/16", "a")},
+			proposed: []Route{r("10.0.0.0/16", "b"), r("10.1.0.0/16", "a")},
+			want:     Result{Replace: []Replacement{{Prefix: "10.0.0.0/16", From: "a", To: "b"}}},
+		},
+		{
+			name:     "ECMP member added",
+			current:  []Route{r("10.0.0.0/16", "a")},
+			proposed: []Route{r("10.0.0.0/16", "a"), r("10.0.0.0/16", "b")},
+			want:     Result{Add: []Route{r("10.0.0.0/16", "b")}},
+		},
+		{
+			name:     "ECMP members replaced",
+			current:  []Route{r("10.0.0.0/16", "a"), r("10.0.0.0/16", "b"), r("10.0.0.0/16", "c")},
+			proposed: []Route{r("10.0.0.0/16", "e"), r("10.0.0.0/16", "a"), r("10.0.0.0/16", "d")},
+			want: Result{Replace: []Replacement{
+				{Prefix: "10.0.0.0/16", From: "b", To: "d"},
+				{Prefix: "10.0.0.0/16", From: "c", To: "e"},
+			}},
+		},
+		{
+			name:     "duplicates are ignored",
+			current:  []Route{r("10.0.0.0/16", "a"), r("10.0.0.0/16", "a")},
+			proposed: []Route{r("10.1.0.0/16", "a"), r("10.1.0.0/16", "a")},
+			want:     Result{Add: []Route{r("10.1.0.0/16", "a")}, Delete: []Route{r("10.0.0.0/16", "a")}},
+		},
+		{
+			name:     "foreign routes are kept",
+			current:  []Route{r("10.0.0.0/16", "foreign"), r("10.1.0.0/16", "a")},
+			proposed: []Route{r("10.0.0.0/16", "a")},
+			owned:    onlyOwned,
+			want:     Result{Add: []Route{r("10.0.0.0/16", "a")}, Delete: []Route{r("10.1.0.0/16", "a")}},
+		},
+		{
+			name:     "existing foreign route matches",
+			current:  []Route{r("10.0.0.0/16", "foreign")},
+			proposed: []Route{r("10.0.0.0/16", "foreign")},
+			owned:    onlyOwned,
+		},
+		{
+			name:     "foreign route is not replaced",
+			current:  []Route{r("10.0.0.0/16", "foreign")},
+			proposed: []Route{r("10.0.0.0/16", "a")},
+			owned:    onlyOwned,
+			want:     Result{Add: []Route{r("10.0.0.0/16", "a")}},
+		},
+		{
+			name:     "IPv6",
+			current:  []Route{r("2001:db8::/64", "2001:db8:ffff::1")},
+			proposed: []Route{r("2001:db8::/64", "2001:db8:ffff::2"), r("2001:db8:1::/64", "2001:db8:ffff::1")},
+			want: Result{
+				Add:     []Route{r("2001:db8:1::/64", "2001:db8:ffff::1")},
+				Replace: []Replacement{{Prefix: "2001:db8::/64", From: "2001:db8:ffff::1", To: "2001:db8:ffff::2"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Routes(tt.current, tt.proposed, tt.owned)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	result := Result{
+		Add:     []Route{{Prefix: "10.1.0.0/16", Nexthop: "a"}},
+		Delete:  []Route{{Prefix: "10.2.0.0/16", Nexthop: "a"}},
+		Replace: []Replacement{{Prefix: "10.0.0.0/16", From: "a", To: "b"}},
+	}
+
+	toAdd, toDelete := result.Flatten()
+
+	wantAdd := []Route{{Prefix: "10.0.0.0/16", Nexthop: "b"}, {Prefix: "10.1.0.0/16", Nexthop: "a"}}
+	wantDelete := []Route{{Prefix: "10.0.0.0/16", Nexthop: "a"}, {Prefix: "10.2.0.0/16", Nexthop: "a"}}
+	if !reflect.DeepEqual(toAdd, wantAdd) {
+		t.Errorf("expected adds %+v, got %+v", wantAdd, toAdd)
+	}
+	if !reflect.DeepEqual(toDelete, wantDelete) {
+		t.Errorf("expected deletes %+v, got %+v", wantDelete, toDelete)
+	}
+	if result.Len() != 3 {
+		t.Errorf("expected 3 changes, got %d", result.Len())
+	}
+}
@@ -0,0 +1,238 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Nested attribute of IFLA_INFO_DATA holding VRF's table ID
+const iflaVrfTable = 1
+
+var tableNames = map[string]uint32{
+	"default": unix.RT_TABLE_DEFAULT,
+	"main":    unix.RT_TABLE_MAIN,
+	"local":   unix.RT_TABLE_LOCAL,
+}
+
+var protocolNames = map[string]uint8{
+	"redirect": unix.RTPROT_REDIRECT,
+	"kernel":   unix.RTPROT_KERNEL,
+	"boot":     unix.RTPROT_BOOT,
+	"static":   unix.RTPROT_STATIC,
+	"zebra":    unix.RTPROT_ZEBRA,
+	"bird":     unix.RTPROT_BIRD,
+	"dhcp":     unix.RTPROT_DHCP,
+	"babel":    unix.RTPROT_BABEL,
+	"ra":       unix.RTPROT_RA,
+	"bgp":      unix.RTPROT_BGP,
+	"isis":     unix.RTPROT_ISIS,
+	"ospf":     unix.RTPROT_OSPF,
+	"rip":      unix.RTPROT_RIP,
+	"eigrp":    unix.RTPROT_EIGRP,
+}
+
+// Config defines which netlink routes get synced to the cloud
+// Empty lists match everything
+type Config struct {
+	Tables     []string
+	Protocols  []string
+	Interfaces []string
+	MinMetric  uint32
+	MaxMetric  uint32
+	PrefixList PrefixList
+}
+
+// Filter matches netlink routes against the configured criteria
+type Filter struct {
+	tables     map[uint32]bool
+	protocols  map[uint8]bool
+	interfaces map[string]bool
+	minMetric  uint32
+	maxMetric  uint32
+	prefixList PrefixList
+
+	mu         sync.Mutex
+	indexCache map[uint32]string
+}
+
+// New builds a new route filter, resolving table, VRF and protocol names
+func New(config Config) (*Filter, error) {
+	f := &Filter{
+		tables:     make(map[uint32]bool),
+		protocols:  make(map[uint8]bool),
+		interfaces: make(map[string]bool),
+		minMetric:  config.MinMetric,
+		maxMetric:  config.MaxMetric,
+		prefixList: config.PrefixList,
+		indexCache: make(map[uint32]string),
+	}
+
+	if config.MaxMetric != 0 && config.MinMetric > config.MaxMetric {
+		return nil, fmt.Errorf("Minimum metric %d is greater than maximum %d", config.MinMetric, config.MaxMetric)
+	}
+
+	for _, table := range config.Tables {
+		id, err := parseTable(table)
+		if err != nil {
+			return nil, err
+		}
+		f.tables[id] = true
+	}
+
+	for _, protocol := range config.Protocols {
+		id, err := parseProtocol(protocol)
+		if err != nil {
+			return nil, err
+		}
+		f.protocols[id] = true
+	}
+
+	for _, intf := range config.Interfaces {
+		f.interfaces[intf] = true
+	}
+
+	logrus.Debugf("Built route filter: %+v", config)
+	return f, nil
+}
+
+// Match returns true if the route should be synced to the cloud
+func (f *Filter) Match(r rtnetlink.RouteMessage) bool {
+	if r.Type != unix.RTN_UNICAST || r.Scope != unix.RT_SCOPE_UNIVERSE {
+		return false
+	}
+
+	// Table IDs above 255 are only stored in RTA_TABLE
+	table := uint32(r.Table)
+	if r.Attributes.Table != 0 {
+		table = r.Attributes.Table
+	}
+	if len(f.tables) > 0 && !f.tables[table] {
+		return false
+	}
+
+	if len(f.protocols) > 0 && !f.protocols[r.Protocol] {
+		return false
+	}
+
+	metric := r.Attributes.Priority
+	if metric < f.minMetric || (f.maxMetric != 0 && metric > f.maxMetric) {
+		return false
+	}
+
+	if r.Attributes.OutIface != 0 && !f.MatchInterface(r.Attributes.OutIface) {
+		return false
+	}
+
+	if r.Attributes.Dst == nil {
+		return false
+	}
+	bits := 8 * net.IPv4len
+	if r.Family == unix.AF_INET6 {
+		bits = 8 * net.IPv6len
+	}
+	prefix := &net.IPNet{
+		IP:   r.Attributes.Dst,
+		Mask: net.CIDRMask(int(r.DstLength), bits),
+	}
+
+	return f.prefixList.Permit(prefix)
+}
+
+// MatchInterface returns true if the outgoing interface is allowed
+func (f *Filter) MatchInterface(index uint32) bool {
+	if len(f.interfaces) == 0 {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name, ok := f.indexCache[index]
+	if !ok {
+		intf, err := net.InterfaceByIndex(int(index))
+		if err != nil {
+			logrus.Infof("Could not find interface by its index %d: %s", index, err)
+			return false
+		}
+		name = intf.Name
+		f.indexCache[index] = name
+	}
+
+	return f.interfaces[name]
+}
+
+// ParseList splits a comma-separated flag value
+func ParseList(s string) (result []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func parseProtocol(s string) (uint8, error) {
+	if id, ok := protocolNames[s]; ok {
+		return id, nil
+	}
+	id, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("Unknown route protocol: %s", s)
+	}
+	return uint8(id), nil
+}
+
+// Tables can be referred to by their ID, well-known name or name of a VRF device
+func parseTable(s string) (uint32, error) {
+	if id, ok := tableNames[s]; ok {
+		return id, nil
+	}
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	return lookupVrfTable(s)
+}
+
+func lookupVrfTable(name string) (uint32, error) {
+	conn, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to dial netlink: %s", err)
+	}
+	defer conn.Close()
+
+	links, err := conn.Link.List()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to list links: %s", err)
+	}
+
+	for _, link := range links {
+		if link.Attributes == nil || link.Attributes.Name != name {
+			continue
+		}
+		info := link.Attributes.Info
+		if info == nil || info.Kind != "vrf" {
+			return 0, fmt.Errorf("Interface %s is not a VRF", name)
+		}
+
+		ad, err := netlink.NewAttributeDecoder(info.Data)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to decode VRF %s: %s", name, err)
+		}
+		for ad.Next() {
+			if ad.Type() == iflaVrfTable {
+				return ad.Uint32(), nil
+			}
+		}
+		return 0, fmt.Errorf("VRF %s has no table ID", name)
+	}
+
+	return 0, fmt.Errorf("Unknown routing table or VRF: %s", name)
+}
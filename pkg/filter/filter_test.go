@@ -0,0 +1,398 @@
+package filter
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/jsimonetti/rtnetlink"
+	"golang.org/x/sys/unix"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %s", s, err)
+	}
+	return prefix
+}
+
+func mustPrefixList(t *testing.T, entries ...string) PrefixList {
+	var pl PrefixList
+	for _, e := range entries {
+		if err := pl.Set(e); err != nil {
+			t.Fatalf("failed to parse %q: %s", e, err)
+		}
+	}
+	return pl
+}
+
+func TestParsePrefixListEntry(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "permit 10.0.0.0/8", want: "permit 10.0.0.0/8"},
+		{in: "allow 10.0.0.0/8", want: "permit 10.0.0.0/8"},
+		{in: "deny 10.1.2.3/16", want: "deny 10.1.0.0/16"},
+		{in: "permit 10.0.0.0/8 ge 16", want: "permit 10.0.0.0/8 ge 16"},
+		{in: "permit 10.0.0.0/8 le 24", want: "permit 10.0.0.0/8 le 24"},
+		{in: "permit 10.0.0.0/8 ge 16 le 24", want: "permit 10.0.0.0/8 ge 16 le 24"},
+		{in: "permit 10.0.0.0/8 le 24 ge 16", want: "permit 10.0.0.0/8 ge 16 le 24"},
+		{in: "permit 10.0.0.0/8 ge 32", want: "permit 10.0.0.0/8 ge 32"},
+		{in: "permit 2001:db8::/32 le 128", want: "permit 2001:db8::/32 le 128"},
+		{in: "permit 2001:db8::/32 ge 48 le 64", want: "permit 2001:db8::/32 ge 48 le 64"},
+		{in: "permit", wantErr: true},
+		{in: "accept 10.0.0.0/8", wantErr: true},
+		{in: "permit 10.0.0.0", wantErr: true},
+		{in: "permit 10.0.0.0/8 ge", wantErr: true},
+		{in: "permit 10.0.0.0/8 ge x", wantErr: true},
+		{in: "permit 10.0.0.0/8 eq 16", wantErr: true},
+		// ge must not be shorter than the prefix itself
+		{in: "permit 10.0.0.0/16 ge 8", wantErr: true},
+		// le must not be shorter than the prefix itself
+		{in: "permit 10.0.0.0/16 le 8", wantErr: true},
+		{in: "permit 10.0.0.0/8 ge 24 le 16", wantErr: true},
+		{in: "permit 10.0.0.0/8 ge 33", wantErr: true},
+		{in: "permit 10.0.0.0/8 le 33", wantErr: true},
+		{in: "permit 2001:db8::/32 le 129", wantErr: true},
+		{in: "permit 2001:db8::/32 ge 129", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePrefixListEntry(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPrefixListPermit(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		prefix  string
+		want    bool
+	}{
+		{
+			name:   "empty list permits everything",
+			prefix: "192.168.0.0/24",
+			want:   true,
+		},
+		{
+			name:    "exact match",
+			entries: []string{"permit 10.0.0.0/8"},
+			prefix:  "10.0.0.0/8",
+			want:    true,
+		},
+		{
+			name:    "longer prefix without bounds",
+			entries: []string{"permit 10.0.0.0/8"},
+			prefix:  "10.1.0.0/16",
+		},
+		{
+			name:    "le includes longer prefixes",
+			entries: []string{"permit 10.0.0.0/8 le 24"},
+			prefix:  "10.1.2.0/24",
+			want:    true,
+		},
+		{
+			name:    "le excludes even longer prefixes",
+			entries: []string{"permit 10.0.0.0/8 le 24"},
+			prefix:  "10.1.2.0/25",
+		},
+		{
+			name:    "ge excludes the prefix itself",
+			entries: []string{"permit 10.0.0.0/8 ge 16"},
+			prefix:  "10.0.0.0/8",
+		},
+		{
+			name:    "ge without le goes up to host routes",
+			entries: []string{"permit 10.0.0.0/8 ge 16"},
+			prefix:  "10.1.2.3/32",
+			want:    true,
+		},
+		{
+			name:    "ge and le",
+			entries: []string{"permit 10.0.0.0/8 ge 16 le 24"},
+			prefix:  "10.1.2.0/23",
+			want:    true,
+		},
+		{
+			name:    "outside of the prefix",
+			entries: []string{"permit 10.0.0.0/8 le 32"},
+			prefix:  "11.0.0.0/16",
+		},
+		{
+			name:    "first match deny wins",
+			entries: []string{"deny 10.1.0.0/16 le 32", "permit 10.0.0.0/8 le 32"},
+			prefix:  "10.1.2.0/24",
+		},
+		{
+			name:    "first match permit wins",
+			entries: []string{"permit 10.1.0.0/16 le 32", "deny 10.0.0.0/8 le 32"},
+			prefix:  "10.1.2.0/24",
+			want:    true,
+		},
+		{
+			name:    "later entry matches when earlier doesn't",
+			entries: []string{"deny 10.1.0.0/16 le 32", "permit 10.0.0.0/8 le 32"},
+			prefix:  "10.2.0.0/16",
+			want:    true,
+		},
+		{
+			name:    "implicit deny",
+			entries: []string{"deny 10.1.0.0/16 le 32"},
+			prefix:  "192.168.0.0/24",
+		},
+		{
+			name:    "IPv6 prefix",
+			entries: []string{"permit 2001:db8::/32 le 64"},
+			prefix:  "2001:db8:1::/48",
+			want:    true,
+		},
+		{
+			name:    "IPv4 entry doesn't match IPv6 prefixes",
+			entries: []string{"permit 0.0.0.0/0 le 32"},
+			prefix:  "2001:db8::/32",
+		},
+		{
+			name:    "IPv6 entry doesn't match IPv4 prefixes",
+			entries: []string{"permit ::/0 le 128"},
+			prefix:  "10.0.0.0/8",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := mustPrefixList(t, tt.entries...)
+			if got := pl.Permit(mustCIDR(t, tt.prefix)); got != tt.want {
+				t.Errorf("expected %v for %s in [%s], got %v", tt.want, tt.prefix, pl.String(), got)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "table names", config: Config{Tables: []string{"main", "default", "local"}}},
+		{name: "table IDs", config: Config{Tables: []string{"254", "1000"}}},
+		{name: "protocol names", config: Config{Protocols: []string{"bgp", "static", "ospf"}}},
+		{name: "protocol IDs", config: Config{Protocols: []string{"186"}}},
+		{name: "unknown protocol", config: Config{Protocols: []string{"foo"}}, wantErr: true},
+		{name: "protocol ID out of range", config: Config{Protocols: []string{"256"}}, wantErr: true},
+		{name: "metric range", config: Config{MinMetric: 10, MaxMetric: 20}},
+		{name: "minimum metric only", config: Config{MinMetric: 10}},
+		{name: "inverted metric range", config: Config{MinMetric: 20, MaxMetric: 10}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.config)
+			if tt.wantErr && err == nil {
+				t.Errorf("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	route := func(prefix string, mod func(*rtnetlink.RouteMessage)) rtnetlink.RouteMessage {
+		ip, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", prefix, err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		family := uint8(unix.AF_INET)
+		if ip.To4() == nil {
+			family = unix.AF_INET6
+		}
+		r := rtnetlink.RouteMessage{
+			Family:    family,
+			DstLength: uint8(ones),
+			Table:     unix.RT_TABLE_MAIN,
+			Protocol:  unix.RTPROT_BGP,
+			Scope:     unix.RT_SCOPE_UNIVERSE,
+			Type:      unix.RTN_UNICAST,
+			Attributes: rtnetlink.RouteAttributes{
+				Dst:      ipnet.IP,
+				Priority: 20,
+			},
+		}
+		if mod != nil {
+			mod(&r)
+		}
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		route  rtnetlink.RouteMessage
+		want   bool
+	}{
+		{
+			name:  "empty filter",
+			route: route("10.0.0.0/24", nil),
+			want:  true,
+		},
+		{
+			name:  "IPv6",
+			route: route("2001:db8::/64", nil),
+			want:  true,
+		},
+		{
+			name:  "not unicast",
+			route: route("10.0.0.0/24", func(r *rtnetlink.RouteMessage) { r.Type = unix.RTN_BLACKHOLE }),
+		},
+		{
+			name:  "link scope",
+			route: route("10.0.0.0/24", func(r *rtnetlink.RouteMessage) { r.Scope = unix.RT_SCOPE_LINK }),
+		},
+		{
+			name:  "no destination",
+			route: route("10.0.0.0/24", func(r *rtnetlink.RouteMessage) { r.Attributes.Dst = nil }),
+		},
+		{
+			name:   "table match",
+			config: Config{Tables: []string{"main"}},
+			route:  route("10.0.0.0/24", nil),
+			want:   true,
+		},
+		{
+			name:   "table mismatch",
+			config: Config{Tables: []string{"100"}},
+			route:  route("10.0.0.0/24", nil),
+		},
+		{
+			name:   "table ID above 255 from RTA_TABLE",
+			config: Config{Tables: []string{"1000"}},
+			route: route("10.0.0.0/24", func(r *rtnetlink.RouteMessage) {
+				r.Table = unix.RT_TABLE_COMPAT
+				r.Attributes.Table = 1000
+			}),
+			want: true,
+		},
+		{
+			name:   "protocol match",
+			config: Config{Protocols: []string{"static", "bgp"}},
+			route:  route("10.0.0.0/24", nil),
+			want:   true,
+		},
+		{
+			name:   "protocol mismatch",
+			config: Config{Protocols: []string{"static"}},
+			route:  route("10.0.0.0/24", nil),
+		},
+		{
+			name:   "metric within range",
+			config: Config{MinMetric: 10, MaxMetric: 20},
+			route:  route("10.0.0.0/24", nil),
+			want:   true,
+		},
+		{
+			name:   "metric below minimum",
+			config: Config{MinMetric: 30},
+			route:  route("10.0.0.0/24", nil),
+		},
+		{
+			name:   "metric above maximum",
+			config: Config{MaxMetric: 10},
+			route:  route("10.0.0.0/24", nil),
+		},
+		{
+			name:   "prefix list permit",
+			config: Config{PrefixList: mustPrefixList(t, "permit 10.0.0.0/8 le 24")},
+			route:  route("10.0.0.0/24", nil),
+			want:   true,
+		},
+		{
+			name:   "prefix list implicit deny",
+			config: Config{PrefixList: mustPrefixList(t, "permit 10.0.0.0/8 le 16")},
+			route:  route("10.0.0.0/24", nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(tt.config)
+			if err != nil {
+				t.Fatalf("failed to build filter: %s", err)
+			}
+			if got := f.Match(tt.route); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMatchInterface(t *testing.T) {
+	intfs, err := net.Interfaces()
+	if err != nil || len(intfs) == 0 {
+		t.Skipf("no network interfaces: %v", err)
+	}
+	intf := intfs[0]
+
+	tests := []struct {
+		name       string
+		interfaces []string
+		index      uint32
+		want       bool
+	}{
+		{name: "no interfaces configured", index: uint32(intf.Index), want: true},
+		{name: "allowed interface", interfaces: []string{intf.Name}, index: uint32(intf.Index), want: true},
+		{name: "other interface", interfaces: []string{intf.Name + "-other"}, index: uint32(intf.Index)},
+		{name: "unknown index", interfaces: []string{intf.Name}, index: 1 << 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(Config{Interfaces: tt.interfaces})
+			if err != nil {
+				t.Fatalf("failed to build filter: %s", err)
+			}
+			if got := f.MatchInterface(tt.index); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{in: "", want: nil},
+		{in: "main", want: []string{"main"}},
+		{in: " main, 100 ,,vrf-red ", want: []string{"main", "100", "vrf-red"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := ParseList(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PrefixListEntry is a single permit or deny statement with optional ge/le bounds
+type PrefixListEntry struct {
+	Permit bool
+	Prefix *net.IPNet
+	Ge, Le int
+}
+
+// PrefixList is an ordered list of entries, the first matching entry wins
+// Just like in FRR, a non-empty list ends with an implicit deny
+type PrefixList []PrefixListEntry
+
+// ParsePrefixListEntry parses "permit|deny PREFIX [ge N] [le N]"
+func ParsePrefixListEntry(s string) (PrefixListEntry, error) {
+	var entry PrefixListEntry
+
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return entry, fmt.Errorf("Invalid prefix list entry %q", s)
+	}
+
+	switch fields[0] {
+	case "permit", "allow":
+		entry.Permit = true
+	case "deny":
+	default:
+		return entry, fmt.Errorf("Unknown prefix list action %q", fields[0])
+	}
+
+	_, prefix, err := net.ParseCIDR(fields[1])
+	if err != nil {
+		return entry, fmt.Errorf("Invalid prefix list prefix %q: %s", fields[1], err)
+	}
+	entry.Prefix = prefix
+
+	rest := fields[2:]
+	for len(rest) > 0 {
+		if len(rest) < 2 {
+			return entry, fmt.Errorf("Missing prefix length in %q", s)
+		}
+		length, err := strconv.Atoi(rest[1])
+		if err != nil {
+			return entry, fmt.Errorf("Invalid prefix length %q: %s", rest[1], err)
+		}
+		switch rest[0] {
+		case "ge":
+			entry.Ge = length
+		case "le":
+			entry.Le = length
+		default:
+			return entry, fmt.Errorf("Unknown prefix list keyword %q", rest[0])
+		}
+		rest = rest[2:]
+	}
+
+	ones, bits := prefix.Mask.Size()
+	ge, le := entry.bounds()
+	if ge < ones || le > bits || ge > le {
+		return entry, fmt.Errorf("Prefix lengths must satisfy %d <= ge <= le <= %d in %q", ones, bits, s)
+	}
+
+	return entry, nil
+}
+
+// bounds returns the effective range of matching prefix lengths
+func (e PrefixListEntry) bounds() (int, int) {
+	ones, bits := e.Prefix.Mask.Size()
+	if e.Ge == 0 && e.Le == 0 {
+		return ones, ones
+	}
+
+	ge, le := e.Ge, e.Le
+	if ge == 0 {
+		ge = ones
+	}
+	if le == 0 {
+		le = bits
+	}
+	return ge, le
+}
+
+// Match returns true if the prefix falls within the entry's prefix and length bounds
+func (e PrefixListEntry) Match(prefix *net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	if _, entryBits := e.Prefix.Mask.Size(); bits != entryBits {
+		return false
+	}
+	if !e.Prefix.Contains(prefix.IP) {
+		return false
+	}
+
+	ge, le := e.bounds()
+	return ones >= ge && ones <= le
+}
+
+func (e PrefixListEntry) String() string {
+	action := "deny"
+	if e.Permit {
+		action = "permit"
+	}
+
+	s := fmt.Sprintf("%s %s", action, e.Prefix)
+	if e.Ge != 0 {
+		s += fmt.Sprintf(" ge %d", e.Ge)
+	}
+	if e.Le != 0 {
+		s += fmt.Sprintf(" le %d", e.Le)
+	}
+	return s
+}
+
+// Permit returns true if the prefix is allowed by the list
+func (pl PrefixList) Permit(prefix *net.IPNet) bool {
+	if len(pl) == 0 {
+		return true
+	}
+
+	for _, entry := range pl {
+		if entry.Match(prefix) {
+			return entry.Permit
+		}
+	}
+	return false
+}
+
+// String implements flag.Value
+func (pl *PrefixList) String() string {
+	if pl == nil {
+		return ""
+	}
+
+	var entries []string
+	for _, entry := range *pl {
+		entries = append(entries, entry.String())
+	}
+	return strings.Join(entries, ", ")
+}
+
+// Set implements flag.Value, each call appends a new entry
+func (pl *PrefixList) Set(s string) error {
+	entry, err := ParsePrefixListEntry(s)
+	if err != nil {
+		return err
+	}
+	*pl = append(*pl, entry)
+	return nil
+}
@@ -0,0 +1,145 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// state is shared between the netlink monitor, the reconcile loop and the HTTP handlers
+var state = struct {
+	mu            sync.Mutex
+	monitorAlive  bool
+	standby       bool
+	discovered    bool
+	eventSync     bool
+	lastSuccess   time.Time
+	lastErr       error
+	staleness     time.Duration
+	discoveryTime time.Time
+}{
+	staleness: time.Minute,
+}
+
+// SetStaleness defines how long ago the last successful sync may have happened
+func SetStaleness(d time.Duration) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.staleness = d
+}
+
+// SetMonitorAlive records whether the netlink monitor is running
+func SetMonitorAlive(alive bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.monitorAlive = alive
+}
+
+// SetStandby records whether this instance is waiting for leadership and does not sync
+func SetStandby(standby bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.standby = standby
+}
+
+// SetDiscovered records whether the cloud client has finished discovery and entered its sync loop
+func SetDiscovered(discovered, eventSync bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.discovered = discovered
+	state.eventSync = eventSync
+	state.discoveryTime = time.Now()
+}
+
+// SyncDone records the result of a cloud sync
+func SyncDone(err error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.lastErr = err
+	if err == nil {
+		state.lastSuccess = time.Now()
+	}
+}
+
+// syncProblem returns a reason why the last sync is not considered successful
+// In event mode syncs only happen on route changes, so an old sync is fine as long as it succeeded
+func syncProblem(now time.Time) string {
+	since := state.lastSuccess
+	if since.IsZero() {
+		since = state.discoveryTime
+	}
+	if now.Sub(since) <= state.staleness {
+		return ""
+	}
+	if state.eventSync && state.lastErr == nil {
+		return ""
+	}
+	if state.lastSuccess.IsZero() {
+		return fmt.Sprintf("no successful sync since discovery %s ago", now.Sub(since).Round(time.Second))
+	}
+	if state.lastErr != nil {
+		return fmt.Sprintf("last successful sync %s ago, last error: %s", now.Sub(since).Round(time.Second), state.lastErr)
+	}
+	return fmt.Sprintf("last successful sync %s ago", now.Sub(since).Round(time.Second))
+}
+
+// liveness problems indicate the process needs to be restarted
+func liveness(now time.Time) (problems []string) {
+	if !state.monitorAlive {
+		problems = append(problems, "netlink monitor is not running")
+	}
+	if state.discovered && !state.standby {
+		if p := syncProblem(now); p != "" {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// readiness problems indicate the cloud route table is not being kept in sync
+func readiness(now time.Time) (problems []string) {
+	if !state.monitorAlive {
+		problems = append(problems, "netlink monitor is not running")
+	}
+	if state.standby {
+		return problems
+	}
+	if !state.discovered {
+		return append(problems, "cloud discovery has not finished")
+	}
+	// Event mode does not sync until the first route change
+	if state.lastSuccess.IsZero() && (!state.eventSync || state.lastErr != nil) {
+		problems = append(problems, "waiting for the first successful sync")
+	} else if p := syncProblem(now); p != "" {
+		problems = append(problems, p)
+	}
+	return problems
+}
+
+func handler(check func(time.Time) []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state.mu.Lock()
+		problems := check(time.Now())
+		state.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// Liveness serves /healthz, it fails if the netlink monitor stopped or syncs became stale
+func Liveness() http.Handler {
+	return handler(liveness)
+}
+
+// Readiness serves /readyz, it additionally fails until discovery and the first sync are done
+func Readiness() http.Handler {
+	return handler(readiness)
+}
@@ -0,0 +1,187 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Elector campaigns for a lease and runs a function only while holding it
+// A leader that fails to renew its lease within renewDeadline steps down before the lease expires
+// A standby takes over at most leaseDuration+retryPeriod after the leader stopped renewing
+type Elector struct {
+	store         Store
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	// Expiry is measured from the moment a record was observed to avoid relying on synchronized clocks
+	observed     *Record
+	observedTime time.Time
+}
+
+// NewElector builds a new leader elector
+// Paced stores are retried less often, leaseDuration has to leave room for a few retries before renewDeadline
+func NewElector(store Store, identity string, leaseDuration time.Duration) *Elector {
+	e := &Elector{
+		store:         store,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewDeadline: leaseDuration * 2 / 3,
+		retryPeriod:   leaseDuration / 5,
+	}
+	if p, ok := store.(Paced); ok && e.retryPeriod < p.MinRetryPeriod() {
+		e.retryPeriod = p.MinRetryPeriod()
+	}
+	return e
+}
+
+// Run campaigns for leadership until ctx is cancelled
+// lead is called every time leadership is acquired, its context is cancelled when leadership is lost
+// If lead returns on its own, the lease is released and its error returned
+func (e *Elector) Run(ctx context.Context, lead func(context.Context) error) error {
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+
+	var (
+		current   *leadership
+		lastRenew time.Time
+	)
+
+	for {
+		ok, err := e.tryAcquireOrRenew(ctx)
+		if err != nil {
+			logrus.Infof("Failed to acquire or renew lease: %s", err)
+		}
+		if ok {
+			lastRenew = time.Now()
+		}
+
+		switch {
+		case ok && current == nil:
+			logrus.Infof("%s became the leader", e.identity)
+			current = startLeading(ctx, lead)
+		case !ok && current != nil && (err == nil || time.Since(lastRenew) > e.renewDeadline):
+			// Either someone else holds the lease or it could not be renewed in time
+			current.stop()
+			current = nil
+			logrus.Infof("%s stopped leading", e.identity)
+		}
+
+		// Receiving from a nil channel blocks forever while in standby
+		var done <-chan error
+		if current != nil {
+			done = current.done
+		}
+
+		select {
+		case <-ctx.Done():
+			if current != nil {
+				current.stop()
+				e.release()
+			}
+			return ctx.Err()
+		case err := <-done:
+			current.cancel()
+			e.release()
+			if err == nil {
+				err = fmt.Errorf("Leader function returned unexpectedly")
+			}
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// leadership is a running lead function
+type leadership struct {
+	cancel context.CancelFunc
+	done   chan error
+}
+
+func startLeading(ctx context.Context, lead func(context.Context) error) *leadership {
+	leadCtx, cancel := context.WithCancel(ctx)
+	l := &leadership{
+		cancel: cancel,
+		done:   make(chan error, 1),
+	}
+	go func() {
+		l.done <- lead(leadCtx)
+	}()
+	return l
+}
+
+// stop cancels the lead function and waits for it to return
+func (l *leadership) stop() {
+	l.cancel()
+	<-l.done
+}
+
+// tryAcquireOrRenew returns true if the lease is held by this candidate
+func (e *Elector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	old, err := e.store.Get(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	if !old.equal(e.observed) {
+		e.observed = old
+		e.observedTime = now
+	}
+
+	if old != nil && old.Holder != "" && old.Holder != e.identity && now.Before(e.observedTime.Add(old.LeaseDuration)) {
+		logrus.Debugf("Lease is held by %s", old.Holder)
+		return false, nil
+	}
+
+	record := &Record{
+		Holder:        e.identity,
+		AcquireTime:   now,
+		RenewTime:     now,
+		LeaseDuration: e.leaseDuration,
+	}
+	if old != nil {
+		record.Transitions = old.Transitions
+		if old.Holder == e.identity {
+			record.AcquireTime = old.AcquireTime
+		} else {
+			record.Transitions++
+		}
+	}
+
+	if err := e.store.Update(ctx, old, record); err != nil {
+		if err == ErrConflict {
+			logrus.Debug("Lost the race for the lease")
+			return false, nil
+		}
+		return false, err
+	}
+
+	e.observed = record
+	e.observedTime = now
+	return true, nil
+}
+
+// release gives up the lease so that a standby can take over immediately
+func (e *Elector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), e.renewDeadline)
+	defer cancel()
+
+	old, err := e.store.Get(ctx)
+	if err != nil || old == nil || old.Holder != e.identity {
+		return
+	}
+
+	record := *old
+	record.Holder = ""
+	record.RenewTime = time.Now()
+	if err := e.store.Update(ctx, old, &record); err != nil {
+		logrus.Infof("Failed to release lease: %s", err)
+		return
+	}
+	logrus.Infof("%s released the lease", e.identity)
+}
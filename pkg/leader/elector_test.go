@@ -0,0 +1,233 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testLeaseDuration = 2 * time.Second
+
+// flakyStore fails all calls while failing is set
+type flakyStore struct {
+	Store
+	failing int32
+}
+
+func (s *flakyStore) Get(ctx context.Context) (*Record, error) {
+	if atomic.LoadInt32(&s.failing) != 0 {
+		return nil, errors.New("store unavailable")
+	}
+	return s.Store.Get(ctx)
+}
+
+func (s *flakyStore) Update(ctx context.Context, old, new *Record) error {
+	if atomic.LoadInt32(&s.failing) != 0 {
+		return errors.New("store unavailable")
+	}
+	return s.Store.Update(ctx, old, new)
+}
+
+// pacedStore asks for a longer retry period
+type pacedStore struct {
+	Store
+}
+
+func (pacedStore) MinRetryPeriod() time.Duration {
+	return 30 * time.Second
+}
+
+// candidate is an elector running in the background, its lead function reports every acquisition
+type candidate struct {
+	cancel  context.CancelFunc
+	done    chan error
+	leading chan context.Context
+}
+
+func startCandidate(store Store, identity string) *candidate {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &candidate{
+		cancel:  cancel,
+		done:    make(chan error, 1),
+		leading: make(chan context.Context, 10),
+	}
+	e := NewElector(store, identity, testLeaseDuration)
+	go func() {
+		c.done <- e.Run(ctx, func(ctx context.Context) error {
+			c.leading <- ctx
+			<-ctx.Done()
+			return nil
+		})
+	}()
+	return c
+}
+
+// stop cancels the candidate and waits for it to release the lease
+func (c *candidate) stop(t *testing.T) {
+	c.cancel()
+	select {
+	case <-c.done:
+	case <-time.After(testLeaseDuration):
+		t.Fatalf("elector did not return after cancellation")
+	}
+}
+
+func (c *candidate) waitLeading(t *testing.T, timeout time.Duration) context.Context {
+	select {
+	case ctx := <-c.leading:
+		return ctx
+	case <-time.After(timeout):
+		t.Fatalf("candidate did not become the leader within %s", timeout)
+		return nil
+	}
+}
+
+func newTestFileStore(t *testing.T) Store {
+	dir, err := ioutil.TempDir("", "leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return NewFileStore(filepath.Join(dir, "lease.json"))
+}
+
+func getRecord(t *testing.T, store Store) *Record {
+	r, err := store.Get(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get lease: %s", err)
+	}
+	if r == nil {
+		t.Fatalf("lease does not exist")
+	}
+	return r
+}
+
+func TestElectorAcquireRenewRelease(t *testing.T) {
+	store := newTestFileStore(t)
+
+	a := startCandidate(store, "a")
+	defer a.cancel()
+	a.waitLeading(t, testLeaseDuration)
+
+	acquired := getRecord(t, store)
+	if acquired.Holder != "a" || acquired.Transitions != 0 {
+		t.Fatalf("unexpected lease after acquisition %+v", acquired)
+	}
+
+	time.Sleep(testLeaseDuration / 2)
+	renewed := getRecord(t, store)
+	if renewed.Holder != "a" || !renewed.RenewTime.After(acquired.RenewTime) || !renewed.AcquireTime.Equal(acquired.AcquireTime) {
+		t.Errorf("lease has not been renewed: acquired %+v, now %+v", acquired, renewed)
+	}
+	if renewed.Transitions != acquired.Transitions {
+		t.Errorf("renewal changed transitions from %d to %d", acquired.Transitions, renewed.Transitions)
+	}
+
+	a.stop(t)
+	if released := getRecord(t, store); released.Holder != "" {
+		t.Errorf("lease is still held by %q after shutdown", released.Holder)
+	}
+}
+
+func TestElectorStepDown(t *testing.T) {
+	store := &flakyStore{Store: newTestFileStore(t)}
+
+	a := startCandidate(store, "a")
+	defer a.stop(t)
+	ctx := a.waitLeading(t, testLeaseDuration)
+
+	lastRenew := getRecord(t, store).RenewTime
+	atomic.StoreInt32(&store.failing, 1)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * testLeaseDuration):
+		t.Fatalf("leader did not step down while failing to renew its lease")
+	}
+
+	// Nobody else may take over before the leader has stopped
+	if elapsed := time.Since(lastRenew); elapsed >= testLeaseDuration {
+		t.Errorf("leader stepped down %s after the last renewal, after its lease of %s expired", elapsed, testLeaseDuration)
+	}
+
+	atomic.StoreInt32(&store.failing, 0)
+	a.waitLeading(t, testLeaseDuration)
+}
+
+func TestElectorTakeover(t *testing.T) {
+	store := newTestFileStore(t)
+
+	// A dead leader stopped renewing its lease, the stale renew time must not matter
+	now := time.Now().Add(-time.Hour)
+	dead := &Record{Holder: "dead", AcquireTime: now, RenewTime: now, LeaseDuration: testLeaseDuration, Transitions: 3}
+	if err := store.Update(context.Background(), nil, dead); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	b := startCandidate(store, "b")
+	defer b.stop(t)
+	b.waitLeading(t, 2*testLeaseDuration)
+
+	if elapsed := time.Since(start); elapsed < testLeaseDuration {
+		t.Errorf("took over after %s, before the lease of %s expired", elapsed, testLeaseDuration)
+	}
+	if r := getRecord(t, store); r.Holder != "b" || r.Transitions != dead.Transitions+1 {
+		t.Errorf("unexpected lease after takeover %+v", r)
+	}
+}
+
+func TestElectorStandby(t *testing.T) {
+	store := newTestFileStore(t)
+
+	a := startCandidate(store, "a")
+	defer a.cancel()
+	a.waitLeading(t, testLeaseDuration)
+
+	b := startCandidate(store, "b")
+	defer b.stop(t)
+
+	select {
+	case <-b.leading:
+		t.Fatalf("standby became the leader while the lease is renewed")
+	case <-time.After(testLeaseDuration * 3 / 2):
+	}
+
+	// A released lease is taken over without waiting for it to expire
+	start := time.Now()
+	a.stop(t)
+	b.waitLeading(t, testLeaseDuration)
+	if elapsed := time.Since(start); elapsed >= testLeaseDuration {
+		t.Errorf("took over a released lease after %s", elapsed)
+	}
+}
+
+func TestElectorLeadError(t *testing.T) {
+	store := newTestFileStore(t)
+	failure := errors.New("lead failed")
+
+	e := NewElector(store, "a", testLeaseDuration)
+	if err := e.Run(context.Background(), func(ctx context.Context) error { return failure }); err != failure {
+		t.Errorf("Run returned %v, want %v", err, failure)
+	}
+	if r := getRecord(t, store); r.Holder != "" {
+		t.Errorf("lease is still held by %q after the lead function failed", r.Holder)
+	}
+}
+
+func TestElectorPaced(t *testing.T) {
+	if e := NewElector(pacedStore{}, "a", 150*time.Second); e.retryPeriod != 30*time.Second {
+		t.Errorf("retry period of a paced store is %s, want 30s", e.retryPeriod)
+	}
+	if e := NewElector(pacedStore{}, "a", 300*time.Second); e.retryPeriod != 60*time.Second {
+		t.Errorf("retry period of a paced store is %s, want 60s", e.retryPeriod)
+	}
+	if e := NewElector(newTestFileStore(t), "a", 15*time.Second); e.retryPeriod != 3*time.Second {
+		t.Errorf("retry period is %s, want 3s", e.retryPeriod)
+	}
+}
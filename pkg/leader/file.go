@@ -0,0 +1,94 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileStore keeps the lease in a local JSON file guarded by flock
+// It only works for candidates sharing a filesystem and is meant for testing
+type fileStore struct {
+	path string
+}
+
+// NewFileStore builds a lease store backed by a local file
+func NewFileStore(path string) Store {
+	return &fileStore{path: path}
+}
+
+func (s *fileStore) Get(ctx context.Context) (*Record, error) {
+	f, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer s.unlock(f)
+
+	return s.read(f)
+}
+
+func (s *fileStore) Update(ctx context.Context, old, new *Record) error {
+	f, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer s.unlock(f)
+
+	current, err := s.read(f)
+	if err != nil {
+		return err
+	}
+	if !current.equal(old) {
+		return ErrConflict
+	}
+
+	data, err := json.Marshal(new)
+	if err != nil {
+		return fmt.Errorf("Failed to encode lease: %s", err)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("Failed to truncate lease file: %s", err)
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("Failed to write lease file: %s", err)
+	}
+	return f.Sync()
+}
+
+func (s *fileStore) lock() (*os.File, error) {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open lease file: %s", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to lock lease file: %s", err)
+	}
+	return f, nil
+}
+
+func (s *fileStore) unlock(f *os.File) {
+	unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	f.Close()
+}
+
+func (s *fileStore) read(f *os.File) (*Record, error) {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read lease file: %s", err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("Failed to parse lease file: %s", err)
+	}
+	return &record, nil
+}
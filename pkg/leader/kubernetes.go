@@ -0,0 +1,239 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// Format of metav1.MicroTime
+	microTime = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// lease mirrors the fields of coordination.k8s.io/v1 Lease used for leader election
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds *int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          *string `json:"acquireTime,omitempty"`
+	RenewTime            *string `json:"renewTime,omitempty"`
+	LeaseTransitions     *int    `json:"leaseTransitions,omitempty"`
+}
+
+// kubernetesStore keeps the lease in a Kubernetes Lease object
+// resourceVersion makes every update conditional
+type kubernetesStore struct {
+	server    string
+	token     string
+	client    *http.Client
+	namespace string
+	name      string
+}
+
+// NewKubernetesStore builds a lease store using the in-cluster service account
+// Namespace defaults to the namespace of the pod
+func NewKubernetesStore(namespace, name string) (Store, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("Not running inside a Kubernetes cluster")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read service account token: %s", err)
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read service account CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("Failed to parse service account CA")
+	}
+
+	if namespace == "" {
+		data, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read pod namespace: %s", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+
+	return newKubernetesStore("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), client, namespace, name), nil
+}
+
+func newKubernetesStore(server, token string, client *http.Client, namespace, name string) *kubernetesStore {
+	return &kubernetesStore{
+		server:    server,
+		token:     token,
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+func (s *kubernetesStore) url(name string) string {
+	return fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", s.server, s.namespace, name)
+}
+
+func (s *kubernetesStore) do(ctx context.Context, method, url string, body interface{}) (*http.Response, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode lease: %s", err)
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	return s.client.Do(req)
+}
+
+func (s *kubernetesStore) Get(ctx context.Context) (*Record, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.url(s.name), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get lease: %s", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Failed to get lease: unexpected status %s", resp.Status)
+	}
+
+	var l lease
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return nil, fmt.Errorf("Failed to decode lease: %s", err)
+	}
+	return l.record()
+}
+
+func (s *kubernetesStore) Update(ctx context.Context, old, new *Record) error {
+	l := s.lease(new)
+
+	method, url := http.MethodPost, strings.TrimSuffix(s.url(""), "/")
+	if old != nil {
+		method, url = http.MethodPut, s.url(s.name)
+		l.Metadata.ResourceVersion = old.version
+	}
+
+	resp, err := s.do(ctx, method, url, l)
+	if err != nil {
+		return fmt.Errorf("Failed to update lease: %s", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusConflict:
+		return ErrConflict
+	default:
+		return fmt.Errorf("Failed to update lease: unexpected status %s", resp.Status)
+	}
+
+	var written lease
+	if err := json.NewDecoder(resp.Body).Decode(&written); err != nil {
+		return fmt.Errorf("Failed to decode lease: %s", err)
+	}
+	new.version = written.Metadata.ResourceVersion
+	return nil
+}
+
+func (s *kubernetesStore) lease(r *Record) *lease {
+	duration := int(r.LeaseDuration.Seconds())
+	acquire := r.AcquireTime.UTC().Format(microTime)
+	renew := r.RenewTime.UTC().Format(microTime)
+	transitions := r.Transitions
+	holder := r.Holder
+
+	return &lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata: leaseMetadata{
+			Name:      s.name,
+			Namespace: s.namespace,
+		},
+		Spec: leaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &acquire,
+			RenewTime:            &renew,
+			LeaseTransitions:     &transitions,
+		},
+	}
+}
+
+func (l *lease) record() (*Record, error) {
+	r := &Record{version: l.Metadata.ResourceVersion}
+
+	if l.Spec.HolderIdentity != nil {
+		r.Holder = *l.Spec.HolderIdentity
+	}
+	if l.Spec.LeaseDurationSeconds != nil {
+		r.LeaseDuration = time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second
+	}
+	if l.Spec.LeaseTransitions != nil {
+		r.Transitions = *l.Spec.LeaseTransitions
+	}
+
+	var err error
+	if l.Spec.AcquireTime != nil {
+		if r.AcquireTime, err = time.Parse(time.RFC3339Nano, *l.Spec.AcquireTime); err != nil {
+			return nil, fmt.Errorf("Failed to parse lease acquire time: %s", err)
+		}
+	}
+	if l.Spec.RenewTime != nil {
+		if r.RenewTime, err = time.Parse(time.RFC3339Nano, *l.Spec.RenewTime); err != nil {
+			return nil, fmt.Errorf("Failed to parse lease renew time: %s", err)
+		}
+	}
+
+	return r, nil
+}
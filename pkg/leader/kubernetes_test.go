@@ -0,0 +1,89 @@
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+const testLeasesPath = "/apis/coordination.k8s.io/v1/namespaces/ns/leases"
+
+// fakeLeases is a Kubernetes API server holding a single Lease with optimistic locking
+type fakeLeases struct {
+	mu      sync.Mutex
+	lease   *lease
+	version int
+}
+
+func (f *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == testLeasesPath+"/crs":
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	case r.Method == http.MethodPost && r.URL.Path == testLeasesPath:
+		if f.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.write(w, r, http.StatusCreated)
+	case r.Method == http.MethodPut && r.URL.Path == testLeasesPath+"/crs":
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.write(w, r, http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// write stores the lease from the request body unless its resourceVersion is outdated
+func (f *fakeLeases) write(w http.ResponseWriter, r *http.Request, status int) {
+	var l lease
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if f.lease != nil && l.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	f.version++
+	l.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.lease = &l
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(f.lease)
+}
+
+func newTestKubernetesStore(t *testing.T) Store {
+	srv := httptest.NewServer(&fakeLeases{})
+	t.Cleanup(srv.Close)
+	return newKubernetesStore(srv.URL, "token", srv.Client(), "ns", "crs")
+}
+
+func TestKubernetesStoreUnauthorized(t *testing.T) {
+	srv := httptest.NewServer(&fakeLeases{})
+	defer srv.Close()
+
+	store := newKubernetesStore(srv.URL, "", srv.Client(), "ns", "crs")
+	if _, err := store.Get(context.Background()); err == nil {
+		t.Errorf("expected an error without a token")
+	}
+}
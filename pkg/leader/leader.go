@@ -0,0 +1,92 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrConflict is returned by a Store when the lease has changed since it was read
+var ErrConflict = errors.New("lease has been modified concurrently")
+
+// Record is the state of a lease shared by all candidates
+// An empty Holder means the lease has been released
+type Record struct {
+	Holder        string
+	AcquireTime   time.Time
+	RenewTime     time.Time
+	LeaseDuration time.Duration
+	Transitions   int
+
+	// opaque backend-specific version used for optimistic locking
+	version string
+}
+
+// Store persists a lease record
+type Store interface {
+	// Get returns the current record or nil if there is none
+	Get(ctx context.Context) (*Record, error)
+	// Update replaces old with new, failing with ErrConflict if the stored record is no longer old
+	Update(ctx context.Context, old, new *Record) error
+}
+
+// Paced is implemented by stores whose updates are too slow or expensive to be retried every few seconds
+type Paced interface {
+	// MinRetryPeriod is the shortest interval between attempts to acquire or renew the lease
+	MinRetryPeriod() time.Duration
+}
+
+func (r *Record) equal(o *Record) bool {
+	if r == nil || o == nil {
+		return r == o
+	}
+	return r.Holder == o.Holder &&
+		r.AcquireTime.Equal(o.AcquireTime) &&
+		r.RenewTime.Equal(o.RenewTime) &&
+		r.LeaseDuration == o.LeaseDuration &&
+		r.Transitions == o.Transitions
+}
+
+// Tags encodes the record as a set of key/value pairs starting with prefix
+// This is used by backends storing leases in cloud resource tags, labels or metadata
+func (r *Record) Tags(prefix string) map[string]string {
+	return map[string]string{
+		prefix + "-leader":             r.Holder,
+		prefix + "-leader-acquire":     r.AcquireTime.UTC().Format(time.RFC3339Nano),
+		prefix + "-leader-renew":       r.RenewTime.UTC().Format(time.RFC3339Nano),
+		prefix + "-leader-duration":    strconv.Itoa(int(r.LeaseDuration.Seconds())),
+		prefix + "-leader-transitions": strconv.Itoa(r.Transitions),
+	}
+}
+
+// RecordFromTags decodes a record from tags, returning nil if there is none
+func RecordFromTags(prefix string, tags map[string]string) (*Record, error) {
+	holder, ok := tags[prefix+"-leader"]
+	if !ok {
+		return nil, nil
+	}
+
+	r := &Record{Holder: holder}
+
+	var err error
+	if r.AcquireTime, err = time.Parse(time.RFC3339Nano, tags[prefix+"-leader-acquire"]); err != nil {
+		return nil, fmt.Errorf("Failed to parse lease acquire time: %s", err)
+	}
+	if r.RenewTime, err = time.Parse(time.RFC3339Nano, tags[prefix+"-leader-renew"]); err != nil {
+		return nil, fmt.Errorf("Failed to parse lease renew time: %s", err)
+	}
+
+	seconds, err := strconv.Atoi(tags[prefix+"-leader-duration"])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse lease duration: %s", err)
+	}
+	r.LeaseDuration = time.Duration(seconds) * time.Second
+
+	if r.Transitions, err = strconv.Atoi(tags[prefix+"-leader-transitions"]); err != nil {
+		return nil, fmt.Errorf("Failed to parse lease transitions: %s", err)
+	}
+
+	return r, nil
+}
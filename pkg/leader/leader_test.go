@@ -0,0 +1,74 @@
+package leader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Store{
+		"file":       NewFileStore(filepath.Join(dir, "lease.json")),
+		"kubernetes": newTestKubernetesStore(t),
+		"tags":       NewTagStore("crs", &versionedTags{tags: map[string]string{}}),
+	}
+
+	// Times survive the microsecond precision of Kubernetes and the second precision of tags
+	now := time.Now().Truncate(time.Second)
+	record := func(holder string) *Record {
+		return &Record{Holder: holder, AcquireTime: now, RenewTime: now, LeaseDuration: 15 * time.Second, Transitions: 1}
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			current, err := store.Get(ctx)
+			if err != nil {
+				t.Fatalf("Get of empty store: %s", err)
+			}
+			if current != nil {
+				t.Fatalf("Empty store holds %+v", current)
+			}
+
+			if err := store.Update(ctx, nil, record("a")); err != nil {
+				t.Fatalf("Update of empty store: %s", err)
+			}
+			if err := store.Update(ctx, nil, record("b")); err != ErrConflict {
+				t.Fatalf("Update of a created lease returned %v, want ErrConflict", err)
+			}
+
+			old, err := store.Get(ctx)
+			if err != nil {
+				t.Fatalf("Get: %s", err)
+			}
+			if !old.equal(record("a")) {
+				t.Fatalf("Get = %+v, want %+v", old, record("a"))
+			}
+
+			if err := store.Update(ctx, old, record("b")); err != nil {
+				t.Fatalf("Update: %s", err)
+			}
+			if err := store.Update(ctx, old, record("c")); err != ErrConflict {
+				t.Fatalf("Update of a stale record returned %v, want ErrConflict", err)
+			}
+
+			current, err = store.Get(ctx)
+			if err != nil {
+				t.Fatalf("Get: %s", err)
+			}
+			if current.Holder != "b" {
+				t.Errorf("lease is held by %q, want b", current.Holder)
+			}
+		})
+	}
+}
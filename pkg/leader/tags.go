@@ -0,0 +1,52 @@
+package leader
+
+import (
+	"context"
+)
+
+// TagBackend reads and writes tags, labels or metadata of a cloud resource
+// Only backends with conditional writes can hold a lease, otherwise two candidates could both win
+type TagBackend interface {
+	// GetTags returns all tags and an opaque version of them, e.g. a fingerprint or an ETag
+	GetTags(ctx context.Context) (map[string]string, string, error)
+	// SetTags adds or overwrites tags, leaving other tags intact
+	// It must fail with ErrConflict unless the tags are still at version
+	SetTags(ctx context.Context, tags map[string]string, version string) error
+}
+
+// tagStore keeps the lease in cloud resource tags
+// The version read along with the old record is the precondition of the write, so the update is atomic
+type tagStore struct {
+	prefix  string
+	backend TagBackend
+}
+
+// NewTagStore builds a lease store on top of cloud resource tags with keys starting with prefix
+func NewTagStore(prefix string, backend TagBackend) Store {
+	return &tagStore{prefix: prefix, backend: backend}
+}
+
+func (s *tagStore) Get(ctx context.Context) (*Record, error) {
+	tags, _, err := s.backend.GetTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return RecordFromTags(s.prefix, tags)
+}
+
+func (s *tagStore) Update(ctx context.Context, old, new *Record) error {
+	tags, version, err := s.backend.GetTags(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := RecordFromTags(s.prefix, tags)
+	if err != nil {
+		return err
+	}
+	if !current.equal(old) {
+		return ErrConflict
+	}
+
+	// Any write since GetTags, including one by another candidate, changes the version and fails this one
+	return s.backend.SetTags(ctx, new.Tags(s.prefix), version)
+}
@@ -0,0 +1,80 @@
+package leader
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// versionedTags is a tag backend with a version bumped on every write
+type versionedTags struct {
+	tags    map[string]string
+	version int
+	// beforeSet runs once between reading and writing, simulating a concurrent candidate
+	beforeSet func()
+}
+
+func (v *versionedTags) GetTags(ctx context.Context) (map[string]string, string, error) {
+	tags := make(map[string]string)
+	for key, value := range v.tags {
+		tags[key] = value
+	}
+	return tags, strconv.Itoa(v.version), nil
+}
+
+func (v *versionedTags) SetTags(ctx context.Context, tags map[string]string, version string) error {
+	if v.beforeSet != nil {
+		f := v.beforeSet
+		v.beforeSet = nil
+		f()
+	}
+	if version != strconv.Itoa(v.version) {
+		return ErrConflict
+	}
+	for key, value := range tags {
+		v.tags[key] = value
+	}
+	v.version++
+	return nil
+}
+
+func TestTagStoreUpdate(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+	record := func(holder string) *Record {
+		return &Record{Holder: holder, AcquireTime: now, RenewTime: now, LeaseDuration: 15 * time.Second}
+	}
+
+	backend := &versionedTags{tags: map[string]string{}}
+	store := NewTagStore("crs", backend)
+
+	if err := store.Update(ctx, nil, record("a")); err != nil {
+		t.Fatalf("first acquisition failed: %s", err)
+	}
+	if err := store.Update(ctx, nil, record("b")); err != ErrConflict {
+		t.Fatalf("acquisition of a held lease returned %v, want ErrConflict", err)
+	}
+
+	// Both candidates read the same record, the one writing second must lose
+	old, err := store.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.beforeSet = func() {
+		if err := store.Update(ctx, old, record("c")); err != nil {
+			t.Errorf("concurrent update failed: %s", err)
+		}
+	}
+	if err := store.Update(ctx, old, record("b")); err != ErrConflict {
+		t.Fatalf("racing update returned %v, want ErrConflict", err)
+	}
+
+	current, err := store.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Holder != "c" {
+		t.Errorf("lease is held by %q, want c", current.Holder)
+	}
+}
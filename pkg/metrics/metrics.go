@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cloudroutesync"
+
+var (
+	netlinkRoutes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "netlink_routes",
+		Help:      "Number of local routes selected for syncing",
+	})
+
+	cloudRoutes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cloud_routes",
+		Help:      "Number of routes in the cloud route table",
+	}, []string{"cloud", "table"})
+
+	routeDrift = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "route_drift",
+		Help:      "Number of routes that differ between the local and the cloud route table at the last sync",
+	}, []string{"cloud", "table"})
+
+	targetSynced = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "target_synced",
+		Help:      "Whether the last sync of a target subnet or route table succeeded",
+	}, []string{"cloud", "target"})
+
+	routesAdded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "routes_added_total",
+		Help:      "Number of routes added to the cloud route table",
+	}, []string{"cloud"})
+
+	routesReplaced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "routes_replaced_total",
+		Help:      "Number of routes of the cloud route table changed to another next hop in place",
+	}, []string{"cloud"})
+
+	routesDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "routes_deleted_total",
+		Help:      "Number of routes deleted from the cloud route table",
+	}, []string{"cloud"})
+
+	routesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "routes_failed_total",
+		Help:      "Number of failed cloud route changes",
+	}, []string{"cloud"})
+
+	syncDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of cloud route table syncs",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"cloud", "result"})
+
+	apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Number of failed cloud API calls",
+	}, []string{"cloud", "operation"})
+
+	backendMember = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_member",
+		Help:      "Whether the local instance is a backend of the load balancer used as next hop",
+	}, []string{"cloud"})
+
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Whether this instance is the active one, always 1 without leader election",
+	})
+
+	// Unix nanoseconds of the last successful sync, process start until the first one
+	lastSync = time.Now().UnixNano()
+
+	sinceLastSync = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "seconds_since_last_sync",
+		Help:      "Seconds since the last successful cloud sync, or since startup if there was none",
+	}, func() float64 {
+		return time.Since(time.Unix(0, atomic.LoadInt64(&lastSync))).Seconds()
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		netlinkRoutes,
+		cloudRoutes,
+		routeDrift,
+		targetSynced,
+		routesAdded,
+		routesReplaced,
+		routesDeleted,
+		routesFailed,
+		syncDuration,
+		apiErrors,
+		sinceLastSync,
+		backendMember,
+		isLeader,
+	)
+}
+
+// Handler serves all registered metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// SetLeader records whether this instance is the active one
+func SetLeader(leader bool) {
+	if leader {
+		isLeader.Set(1)
+	} else {
+		isLeader.Set(0)
+	}
+}
+
+// SetBackendMember records whether the local instance is a load balancer backend
+func SetBackendMember(cloud string, member bool) {
+	if member {
+		backendMember.WithLabelValues(cloud).Set(1)
+	} else {
+		backendMember.WithLabelValues(cloud).Set(0)
+	}
+}
+
+// SetNetlinkRoutes records the size of the local route table
+func SetNetlinkRoutes(n int) {
+	netlinkRoutes.Set(float64(n))
+}
+
+// SetCloudRoutes records the size of a cloud route table
+func SetCloudRoutes(cloud, table string, n int) {
+	cloudRoutes.WithLabelValues(cloud, table).Set(float64(n))
+}
+
+// SetDrift records the number of pending changes to a cloud route table
+func SetDrift(cloud, table string, n int) {
+	routeDrift.WithLabelValues(cloud, table).Set(float64(n))
+}
+
+// SetTargetSynced records the result of the last sync of a target subnet or route table
+func SetTargetSynced(cloud, target string, err error) {
+	if err != nil {
+		targetSynced.WithLabelValues(cloud, target).Set(0)
+	} else {
+		targetSynced.WithLabelValues(cloud, target).Set(1)
+	}
+}
+
+// RoutesAdded counts routes successfully added to the cloud
+func RoutesAdded(cloud string, n int) {
+	routesAdded.WithLabelValues(cloud).Add(float64(n))
+}
+
+// RoutesReplaced counts routes successfully changed to another next hop in place
+func RoutesReplaced(cloud string, n int) {
+	routesReplaced.WithLabelValues(cloud).Add(float64(n))
+}
+
+// RoutesDeleted counts routes successfully deleted from the cloud
+func RoutesDeleted(cloud string, n int) {
+	routesDeleted.WithLabelValues(cloud).Add(float64(n))
+}
+
+// RoutesFailed counts route changes that could not be applied
+func RoutesFailed(cloud string, n int) {
+	routesFailed.WithLabelValues(cloud).Add(float64(n))
+}
+
+// APIError counts a failed cloud API call
+func APIError(cloud, operation string) {
+	apiErrors.WithLabelValues(cloud, operation).Inc()
+}
+
+// ObserveSync records duration and result of a single cloud sync
+func ObserveSync(cloud string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	} else {
+		atomic.StoreInt64(&lastSync, time.Now().UnixNano())
+	}
+	syncDuration.WithLabelValues(cloud, result).Observe(time.Since(start).Seconds())
+}
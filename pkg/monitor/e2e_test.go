@@ -0,0 +1,225 @@
+package monitor
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/networkop/cloudroutesync/pkg/filter"
+	"github.com/networkop/cloudroutesync/pkg/reconciler"
+	"github.com/networkop/cloudroutesync/pkg/route"
+	"golang.org/x/sys/unix"
+)
+
+// pipeline feeds netlink messages through the monitor into a route table synced to the fake cloud
+type pipeline struct {
+	t      *testing.T
+	filter *filter.Filter
+	events chan []route.Change
+	cloud  *reconciler.FakeClient
+}
+
+func startPipeline(t *testing.T, cloud *reconciler.FakeClient, eventSync bool) *pipeline {
+	f, err := filter.New(filter.Config{Tables: []string{"main"}, Protocols: []string{"bgp"}})
+	if err != nil {
+		t.Fatalf("filter: %s", err)
+	}
+
+	rt := &route.Table{
+		Routes:    make(map[string]route.Nexthops),
+		SyncCh:    make(chan bool, 1),
+		DefaultIP: net.ParseIP("10.0.0.5"),
+	}
+
+	p := &pipeline{
+		t:      t,
+		filter: f,
+		events: make(chan []route.Change),
+		cloud:  cloud,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	go func() {
+		run(ctx, rt, p.events, nil, nil, 3600, func() {})
+		done <- struct{}{}
+	}()
+	go func() {
+		cloud.Reconcile(ctx, rt, eventSync, 1)
+		done <- struct{}{}
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		<-done
+	})
+	return p
+}
+
+func (p *pipeline) send(msgType uint16, routes ...string) {
+	var msgs []netlink.Message
+	for _, r := range routes {
+		msgs = append(msgs, routeMessage(p.t, msgType, r))
+	}
+	p.events <- parseChanges(msgs, p.filter)
+}
+
+// routeMessage builds a netlink message from "prefix via nexthop [proto static]"
+func routeMessage(t *testing.T, msgType uint16, r string) netlink.Message {
+	fields := strings.Fields(r)
+	ip, ipNet, err := net.ParseCIDR(fields[0])
+	if err != nil {
+		t.Fatalf("invalid route %q: %s", r, err)
+	}
+	ones, _ := ipNet.Mask.Size()
+
+	family := uint8(unix.AF_INET)
+	if ip.To4() == nil {
+		family = unix.AF_INET6
+	}
+
+	protocol := uint8(unix.RTPROT_BGP)
+	if len(fields) > 4 && fields[3] == "proto" && fields[4] == "static" {
+		protocol = unix.RTPROT_STATIC
+	}
+
+	msg := rtnetlink.RouteMessage{
+		Family:    family,
+		DstLength: uint8(ones),
+		Table:     unix.RT_TABLE_MAIN,
+		Protocol:  protocol,
+		Scope:     unix.RT_SCOPE_UNIVERSE,
+		Type:      unix.RTN_UNICAST,
+		Attributes: rtnetlink.RouteAttributes{
+			Dst:     ipNet.IP,
+			Gateway: net.ParseIP(fields[2]),
+		},
+	}
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to encode route %q: %s", r, err)
+	}
+	return netlink.Message{Header: netlink.Header{Type: netlink.HeaderType(msgType)}, Data: data}
+}
+
+// waitFor polls the fake cloud until it holds exactly the expected "prefix via nexthop" routes
+func (p *pipeline) waitFor(want ...string) {
+	p.t.Helper()
+
+	var got []string
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		got = nil
+		for _, r := range p.cloud.State().Routes {
+			got = append(got, r.Prefix+" via "+r.Nexthop)
+		}
+		if strings.Join(got, ",") == strings.Join(want, ",") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.t.Fatalf("expected cloud routes %v, got %v", want, got)
+}
+
+func TestPipelineEventSync(t *testing.T) {
+	cloud := reconciler.NewFakeClient(reconciler.Options{OwnerTag: "test"}, 0, 0, 0)
+	p := startPipeline(t, cloud, true)
+
+	p.send(unix.RTM_NEWROUTE,
+		"198.51.100.0/24 via 10.0.0.7",
+		"203.0.113.0/24 via 10.0.0.8",
+		"2001:db8::/64 via 2001:db8:ffff::1",
+		"192.0.2.0/24 via 10.0.0.9 proto static",
+		"169.254.10.0/24 via 10.0.0.9",
+	)
+	p.waitFor(
+		"198.51.100.0/24 via 10.0.0.7",
+		"2001:db8::/64 via 2001:db8:ffff::1",
+		"203.0.113.0/24 via 10.0.0.8",
+	)
+
+	p.send(unix.RTM_DELROUTE, "203.0.113.0/24 via 10.0.0.8")
+	p.send(unix.RTM_NEWROUTE, "198.51.100.0/24 via 10.0.0.6")
+	p.waitFor(
+		"198.51.100.0/24 via 10.0.0.6",
+		"2001:db8::/64 via 2001:db8:ffff::1",
+	)
+
+	if calls := cloud.State().Calls[reconciler.FakeReplaceRoute]; calls != 1 {
+		t.Errorf("expected next hop change to replace the route once, got %d calls", calls)
+	}
+
+	if err := cloud.Withdraw(context.Background()); err != nil {
+		t.Fatalf("withdraw: %s", err)
+	}
+	p.waitFor()
+}
+
+func TestPipelineRetriesFailures(t *testing.T) {
+	cloud := reconciler.NewFakeClient(reconciler.Options{OwnerTag: "test"}, 0, 0, 0)
+	if err := cloud.InjectFailure(reconciler.FakeCreateRoute, 1); err != nil {
+		t.Fatal(err)
+	}
+	p := startPipeline(t, cloud, false)
+
+	p.send(unix.RTM_NEWROUTE, "198.51.100.0/24 via 10.0.0.7")
+	p.waitFor("198.51.100.0/24 via 10.0.0.7")
+
+	if calls := cloud.State().Calls[reconciler.FakeCreateRoute]; calls < 2 {
+		t.Errorf("expected a retry after the injected failure, got %d calls", calls)
+	}
+}
+
+func TestPipelineRouteLimit(t *testing.T) {
+	cloud := reconciler.NewFakeClient(reconciler.Options{OwnerTag: "test"}, 2, 0, 0)
+	p := startPipeline(t, cloud, true)
+
+	p.send(unix.RTM_NEWROUTE,
+		"198.51.100.0/24 via 10.0.0.7",
+		"203.0.113.0/24 via 10.0.0.7",
+		"192.0.2.0/24 via 10.0.0.7",
+	)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cloud.State().Calls[reconciler.FakeCreateRoute] < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(cloud.State().Routes); n != 2 {
+		t.Errorf("expected route limit to keep 2 routes, got %d", n)
+	}
+
+	// Freeing up space lets the pending route in
+	p.send(unix.RTM_DELROUTE, "198.51.100.0/24 via 10.0.0.7")
+	p.waitFor(
+		"192.0.2.0/24 via 10.0.0.7",
+		"203.0.113.0/24 via 10.0.0.7",
+	)
+}
+
+func TestPipelineForeignRoutes(t *testing.T) {
+	cloud := reconciler.NewFakeClient(reconciler.Options{OwnerTag: "test"}, 0, 0, 0)
+	err := cloud.AddForeignRoute(reconciler.FakeRoute{Prefix: "198.51.100.0/24", Nexthop: "10.0.0.99", Owner: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := startPipeline(t, cloud, true)
+
+	p.send(unix.RTM_NEWROUTE,
+		"198.51.100.0/24 via 10.0.0.7",
+		"203.0.113.0/24 via 10.0.0.7",
+	)
+	p.waitFor(
+		"198.51.100.0/24 via 10.0.0.99",
+		"203.0.113.0/24 via 10.0.0.7",
+	)
+
+	if err := cloud.Withdraw(context.Background()); err != nil {
+		t.Fatalf("withdraw: %s", err)
+	}
+	p.waitFor("198.51.100.0/24 via 10.0.0.99")
+}
@@ -1,60 +1,267 @@
 package monitor
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
 	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/networkop/cloudroutesync/pkg/filter"
+	"github.com/networkop/cloudroutesync/pkg/health"
+	"github.com/networkop/cloudroutesync/pkg/metrics"
 	"github.com/networkop/cloudroutesync/pkg/route"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
 // Start monitoring local routing table
-func Start(rt *route.Table, pollInterval int) {
+// Route changes are received from netlink multicast groups and applied incrementally
+// Full table resync happens every resyncInterval and after socket overruns
+// It returns when ctx is cancelled or the subscription fails
+func Start(ctx context.Context, rt *route.Table, f *filter.Filter, resyncInterval int) error {
 
+	conn, err := rtnetlink.Dial(&netlink.Config{
+		Groups: unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to dial netlink: %s", err)
+	}
+	// Closing the socket unblocks the pending Receive in subscribe
+	defer conn.Close()
+
+	events := make(chan []route.Change)
+	overruns := make(chan struct{}, 1)
+	errs := make(chan error, 1)
+	go subscribe(ctx, conn, f, events, overruns, errs)
+
+	return run(ctx, rt, events, overruns, errs, resyncInterval, func() { resync(rt, f) })
+}
+
+// run applies route changes to rt until ctx is cancelled or the subscription fails
+// It is separate from Start, so that changes can be fed in without a netlink socket
+func run(ctx context.Context, rt *route.Table, events <-chan []route.Change, overruns <-chan struct{}, errs <-chan error, resyncInterval int, resync func()) error {
+	health.SetMonitorAlive(true)
+	defer health.SetMonitorAlive(false)
+
+	resync()
+
+	ticker := time.NewTicker(time.Duration(resyncInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Info("Stopping netlink monitor")
+			return ctx.Err()
+		case changes := <-events:
+			logrus.Debugf("Received %d netlink route changes", len(changes))
+			rt.Apply(changes)
+			metrics.SetNetlinkRoutes(rt.Len())
+		case <-overruns:
+			logrus.Info("Netlink socket overrun, resyncing routing table")
+			resync()
+		case <-ticker.C:
+			resync()
+		case err := <-errs:
+			return fmt.Errorf("Netlink subscription failed: %s", err)
+		}
+	}
+}
+
+func resync(rt *route.Table, f *filter.Filter) {
+	logrus.Infof("Checking routing table")
+
+	if err := Dump(rt, f); err != nil {
+		logrus.Error(err)
+	}
+	metrics.SetNetlinkRoutes(rt.Len())
+}
+
+// Dump reads the whole routing table once over a separate netlink socket
+// so that the dump does not interleave with multicast notifications
+func Dump(rt *route.Table, f *filter.Filter) error {
 	conn, err := rtnetlink.Dial(nil)
 	if err != nil {
-		logrus.Fatal(err)
+		return fmt.Errorf("Failed to dial netlink: %s", err)
 	}
 	defer conn.Close()
 
+	// Route.List() only returns decoded messages, which lack RTA_MULTIPATH
+	// so we issue the dump ourselves and parse the raw netlink messages
+	_, err = conn.Send(&rtnetlink.RouteMessage{}, unix.RTM_GETROUTE, netlink.Request|netlink.Dump)
+	if err != nil {
+		return fmt.Errorf("Failed to request route dump :%s", err)
+	}
+
+	_, msgs, err := conn.Receive()
+	if err != nil {
+		return fmt.Errorf("Failed to list routes :%s", err)
+	}
+
+	currentRT := parseNetlinkRT(msgs, f)
+
+	logrus.Debugf("Current netlink route table :%+v", currentRT)
+
+	return rt.Update(currentRT)
+}
+
+// subscribe receives multicast route notifications until a non-recoverable error or ctx is cancelled
+func subscribe(ctx context.Context, conn *rtnetlink.Conn, f *filter.Filter, events chan<- []route.Change, overruns chan<- struct{}, errs chan<- error) {
 	for {
-		logrus.Infof("Checking routing table")
-		msg, err := conn.Route.List()
+		_, msgs, err := conn.Receive()
 		if err != nil {
-			logrus.Errorf("Failed to list routes :%s", err)
+			if errors.Is(err, unix.ENOBUFS) {
+				select {
+				case overruns <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			if ctx.Err() == nil {
+				errs <- err
+			}
+			return
 		}
 
-		currentRT := parseNetlinkRT(msg)
+		changes := parseChanges(msgs, f)
+		if len(changes) > 0 {
+			select {
+			case events <- changes:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
 
-		logrus.Debugf("Current netlink route table :%+v", currentRT)
+// parseChanges converts route notifications into incremental route table changes
+func parseChanges(msgs []netlink.Message, f *filter.Filter) (changes []route.Change) {
+	for _, m := range msgs {
+		var isDelete bool
+		switch m.Header.Type {
+		case unix.RTM_NEWROUTE:
+		case unix.RTM_DELROUTE:
+			isDelete = true
+		default:
+			continue
+		}
 
-		rt.Update(currentRT)
+		prefix, nextHops, ok := parseRoute(m.Data, f)
+		if !ok {
+			continue
+		}
+		changes = append(changes, route.Change{
+			Prefix:   prefix,
+			Nexthops: nextHops,
+			Delete:   isDelete,
+		})
+	}
+	return changes
+}
 
-		//log.Debugf("Current netlink route table :%+v", currentRT)
+func parseNetlinkRT(msgs []netlink.Message, f *filter.Filter) map[string]route.Nexthops {
+	result := make(map[string]route.Nexthops)
 
-		time.Sleep(time.Duration(pollInterval) * time.Second)
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWROUTE {
+			continue
+		}
+		if prefix, nextHops, ok := parseRoute(m.Data, f); ok {
+			result[prefix] = nextHops
+		}
 	}
 
+	return result
 }
 
-func parseNetlinkRT(routes []rtnetlink.RouteMessage) map[string]net.IP {
-	result := make(map[string]net.IP)
+func parseRoute(data []byte, f *filter.Filter) (string, route.Nexthops, bool) {
+	var r rtnetlink.RouteMessage
+	if err := r.UnmarshalBinary(data); err != nil {
+		logrus.Infof("Failed to parse netlink route message: %s", err)
+		return "", nil, false
+	}
 
-	for _, r := range routes {
-		// Narrowing down to only the routes we _need_
-		if r.Table != unix.RT_TABLE_MAIN && r.Scope != unix.RT_SCOPE_UNIVERSE && r.Type != unix.RTN_UNICAST && r.Family != unix.AF_INET {
-			continue
+	if r.Family != unix.AF_INET && r.Family != unix.AF_INET6 {
+		return "", nil, false
+	}
+	// Narrowing down to only the routes we _need_
+	if !f.Match(r) {
+		return "", nil, false
+	}
+	attrs := r.Attributes
+
+	// ECMP routes have no RTA_GATEWAY, their next hops are stored in RTA_MULTIPATH
+	var gateways []net.IP
+	if attrs.Gateway != nil {
+		gateways = append(gateways, attrs.Gateway)
+	} else {
+		for _, nh := range parseMultipath(data) {
+			if f.MatchInterface(nh.ifIndex) {
+				gateways = append(gateways, nh.gateway)
+			}
 		}
-		attrs := r.Attributes
+	}
 
-		if attrs.Dst != nil && attrs.Gateway != nil {
-			prefix := fmt.Sprintf("%s/%d", attrs.Dst.String(), r.DstLength)
-			result[prefix] = attrs.Gateway
+	nextHops := route.NewNexthops(gateways...)
+	if len(nextHops) == 0 {
+		return "", nil, false
+	}
+
+	return fmt.Sprintf("%s/%d", attrs.Dst.String(), r.DstLength), nextHops, true
+}
+
+type multipathNexthop struct {
+	gateway net.IP
+	ifIndex uint32
+}
+
+// parseMultipath decodes next hops from RTA_MULTIPATH attribute
+// which is a list of rtnexthop structs, each followed by its own attributes
+func parseMultipath(data []byte) (result []multipathNexthop) {
+	if len(data) < unix.SizeofRtMsg {
+		return nil
+	}
+
+	ad, err := netlink.NewAttributeDecoder(data[unix.SizeofRtMsg:])
+	if err != nil {
+		return nil
+	}
+
+	for ad.Next() {
+		if ad.Type() != unix.RTA_MULTIPATH {
+			continue
 		}
 
+		b := ad.Bytes()
+		for len(b) >= unix.SizeofRtNexthop {
+			length := int(nlenc.Uint16(b[0:2]))
+			if length < unix.SizeofRtNexthop || length > len(b) {
+				break
+			}
+			ifIndex := nlenc.Uint32(b[4:8])
+
+			nad, err := netlink.NewAttributeDecoder(b[unix.SizeofRtNexthop:length])
+			if err == nil {
+				for nad.Next() {
+					if nad.Type() == unix.RTA_GATEWAY {
+						gw := make(net.IP, len(nad.Bytes()))
+						copy(gw, nad.Bytes())
+						result = append(result, multipathNexthop{gateway: gw, ifIndex: ifIndex})
+					}
+				}
+			}
+
+			// rtnexthop structs are aligned to 4 bytes
+			next := (length + unix.NLA_ALIGNTO - 1) & ^(unix.NLA_ALIGNTO - 1)
+			if next > len(b) {
+				break
+			}
+			b = b[next:]
+		}
 	}
 
 	return result
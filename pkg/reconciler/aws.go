@@ -1,23 +1,31 @@
 package reconciler
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/networkop/cloudroutesync/pkg/diff"
+	"github.com/networkop/cloudroutesync/pkg/metrics"
 	"github.com/networkop/cloudroutesync/pkg/route"
+	"github.com/networkop/cloudroutesync/pkg/state"
 	"github.com/sirupsen/logrus"
 )
 
 var errRouteTableNotFound = errors.New("RouteTable not found")
 
+// awsSubnetRouteTable selects the route table currently used by the local subnet
+const awsSubnetRouteTable = "subnet"
+
 var awsReservedRanges = []*net.IPNet{
 	route.ParseCIDR("224.0.0.0/4"),
 	route.ParseCIDR("255.255.255.255/32"),
@@ -25,24 +33,36 @@ var awsReservedRanges = []*net.IPNet{
 	route.ParseCIDR("169.254.0.0/16"),
 }
 
+var awsReservedRangesV6 = []*net.IPNet{
+	route.ParseCIDR("ff00::/8"),
+	route.ParseCIDR("::1/128"),
+	route.ParseCIDR("fe80::/10"),
+	route.ParseCIDR("fd00:ec2::/32"),
+}
+
 // AWS Implementation details:
 // * AWS only allows association of 1 route table with a single subnet
 // * AWS routes cannot be tagged or given names
-// * We will attempt to remove all non-local and non-default routes
-// * To workaround the above, we may need to keep track of added routes
-// Doing the above between restarts means having a statefile
+// * Created routes are recorded in the state store, only those are ever deleted
+// * Routes of others at proposed prefixes are replaced, after which they are owned
+// * Routes already matching the proposed ones are adopted, e.g. after the state has been lost
+// * An existing route table can be managed instead of a dedicated one, its foreign routes are never replaced
+// * Multiple target route tables, selected directly or through their subnets, are all treated as existing ones
 
 // AwsClient  stores cloud client and values
 type AwsClient struct {
 	aws                                    *ec2.EC2
 	instanceID, privateIP, subnetID, vpcID string
-	awsRouteTable                          *ec2.RouteTable
-	baseRoutes                             []*ec2.Route
+	awsRouteTables                         []*ec2.RouteTable
+	routeTable                             string
 	nicIPtoID                              map[string]string
+	uncopied                               map[string]bool
+	opts                                   Options
 }
 
 // NewAwsClient builds new AWS client
-func NewAwsClient() (*AwsClient, error) {
+// routeTable is empty for a dedicated route table, "subnet" or an ID of an existing route table to manage
+func NewAwsClient(opts Options, routeTable string) (*AwsClient, error) {
 
 	s, err := session.NewSession(&aws.Config{
 		MaxRetries: aws.Int(0),
@@ -58,24 +78,43 @@ func NewAwsClient() (*AwsClient, error) {
 	}
 	client := ec2.New(s, aws.NewConfig().WithRegion(idDoc.Region))
 
+	if opts.State == nil {
+		opts.State = state.NewMemoryStore()
+	}
+
 	logrus.Debug("NewAwsClient built")
 	return &AwsClient{
 		aws:        client,
 		instanceID: idDoc.InstanceID,
 		privateIP:  idDoc.PrivateIP,
 		nicIPtoID:  make(map[string]string),
+		uncopied:   make(map[string]bool),
+		routeTable: routeTable,
+		opts:       opts,
 	}, nil
 }
 
 // Cleanup removes any leftover resources
-func (c *AwsClient) Cleanup() error {
+// Existing route tables are kept, only owned routes are removed from them
+func (c *AwsClient) Cleanup(ctx context.Context) error {
+	if c.adopted() {
+		if err := c.lookupAwsSubnet(ctx); err != nil {
+			return fmt.Errorf("Failed to lookupSubnet: %s", err)
+		}
+		if err := c.discoverRouteTables(ctx, true); err != nil {
+			return err
+		}
+		logrus.Info("Deleting owned routes from managed route tables")
+		return c.syncRouteTable(ctx, route.Empty())
+	}
+
 	logrus.Info("Deleting own route table")
 
-	myRouteTable, err := c.getRouteTable(
+	myRouteTable, err := c.getRouteTable(ctx,
 		[]*ec2.Filter{
 			{
 				Name:   aws.String("tag:name"),
-				Values: aws.StringSlice([]string{uniquePrefix}),
+				Values: aws.StringSlice([]string{c.opts.owner()}),
 			},
 		},
 	)
@@ -85,71 +124,347 @@ func (c *AwsClient) Cleanup() error {
 
 	logrus.Debugf("Disassociating route tableID: %s", *myRouteTable.RouteTableId)
 	for _, assoc := range myRouteTable.Associations {
-		_, err := c.aws.DisassociateRouteTable(&ec2.DisassociateRouteTableInput{
+		_, err := c.aws.DisassociateRouteTableWithContext(ctx, &ec2.DisassociateRouteTableInput{
 			AssociationId: assoc.RouteTableAssociationId,
 		})
 		if err != nil {
+			metrics.APIError("aws", "DisassociateRouteTable")
 			return fmt.Errorf("Failed to disassociate route table %s", err)
 		}
 	}
 
-	logrus.Debugf("Deleting route tableID: %s", myRouteTable.RouteTableId)
-	_, err = c.aws.DeleteRouteTable(&ec2.DeleteRouteTableInput{
+	logrus.Debugf("Deleting route tableID: %s", *myRouteTable.RouteTableId)
+	_, err = c.aws.DeleteRouteTableWithContext(ctx, &ec2.DeleteRouteTableInput{
 		RouteTableId: myRouteTable.RouteTableId,
 	})
 	if err != nil {
+		metrics.APIError("aws", "DeleteRouteTable")
 		return fmt.Errorf("Failed to delete route table %s", err)
 	}
 
-	return nil
+	st, err := c.opts.State.Load(ctx)
+	if err != nil {
+		return err
+	}
+	st.SetOwned(*myRouteTable.RouteTableId, nil)
+	st.SetOwned(mainRoutesKey(myRouteTable), nil)
+	return c.opts.State.Save(ctx, st)
 }
 
 // Reconcile implements reconciler interface
-func (c *AwsClient) Reconcile(rt *route.Table, eventSync bool, syncInterval int) {
+func (c *AwsClient) Reconcile(ctx context.Context, rt *route.Table, eventSync bool, syncInterval int) error {
 	logrus.Debug("Entering Reconcile loop")
 
-	err := c.lookupAwsSubnet()
+	err := c.lookupAwsSubnet(ctx)
+	if err != nil {
+		return fmt.Errorf("Failed to lookupSubnet: %s", err)
+	}
+
+	if err := c.discoverRouteTables(ctx, c.opts.DryRun); err != nil {
+		return fmt.Errorf("Failed to ensure route table: %s", err)
+	}
+
+	return runLoop(ctx, "aws", rt, eventSync, syncInterval, c.syncRouteTable)
+}
+
+// Withdraw implements reconciler interface
+func (c *AwsClient) Withdraw(ctx context.Context) error {
+	if len(c.awsRouteTables) == 0 {
+		return fmt.Errorf("Route table has not been discovered yet")
+	}
+	logrus.Info("Withdrawing all owned routes")
+	return c.syncRouteTable(ctx, route.Empty())
+}
+
+// Plan implements reconciler interface
+func (c *AwsClient) Plan(ctx context.Context, rt *route.Table) (Plans, error) {
+	if err := c.lookupAwsSubnet(ctx); err != nil {
+		return nil, fmt.Errorf("Failed to lookupSubnet: %s", err)
+	}
+
+	if err := c.discoverRouteTables(ctx, true); err != nil {
+		return nil, err
+	}
+
+	st, err := c.opts.State.Load(ctx)
 	if err != nil {
-		logrus.Panicf("Failed to lookupSubnet: %s", err)
+		return nil, err
 	}
 
-	err = c.ensureRouteTable()
+	proposed := c.buildRoutes(ctx, rt)
+
+	var plans Plans
+	for _, table := range c.awsRouteTables {
+		owned := st.Owned(aws.StringValue(table.RouteTableId))
+		plans = append(plans, newAwsPlan(table, c.diffRoutes(table, proposed, owned)))
+	}
+	return plans, nil
+}
+
+// adopted returns true if existing route tables are managed instead of a dedicated one
+func (c *AwsClient) adopted() bool {
+	return c.routeTable != "" || !c.opts.Targets.Empty()
+}
+
+// discoverRouteTables finds all managed route tables, readOnly never creates or associates a route table
+func (c *AwsClient) discoverRouteTables(ctx context.Context, readOnly bool) error {
+	var tables []*ec2.RouteTable
+	var table *ec2.RouteTable
+	var err error
+
+	switch {
+	case !c.opts.Targets.Empty():
+		tables, err = c.lookupTargets(ctx)
+	case c.routeTable != "":
+		table, err = c.adoptRouteTable(ctx)
+	case readOnly:
+		table, err = c.lookupRouteTable(ctx)
+	default:
+		table, err = c.ensureRouteTable(ctx)
+	}
 	if err != nil {
-		logrus.Panicf("Failed to ensure route table: %s", err)
+		return err
 	}
 
-	if eventSync {
-		for range rt.SyncCh {
-			err = c.syncRouteTable(rt)
-			if err != nil {
-				logrus.Infof("Failed to sync route table: %s", err)
-			}
+	if table != nil {
+		tables = []*ec2.RouteTable{table}
+	}
+	c.awsRouteTables = tables
+	return nil
+}
+
+// lookupRouteTable is a read-only version of ensureRouteTable used in dry-run mode
+// Missing route table is treated as empty, as it would be created on the first run
+func (c *AwsClient) lookupRouteTable(ctx context.Context) (*ec2.RouteTable, error) {
+	myRouteTable, err := c.getRouteTable(ctx,
+		[]*ec2.Filter{
+			{
+				Name:   aws.String("tag:name"),
+				Values: aws.StringSlice([]string{c.opts.owner()}),
+			},
+		},
+	)
+	switch err {
+	case nil:
+		return myRouteTable, nil
+	case errRouteTableNotFound:
+		logrus.Info("Route table doesn't exist, it would be created")
+		return &ec2.RouteTable{
+			RouteTableId: aws.String("(new)"),
+		}, nil
+	default:
+		return nil, err
+	}
+}
+
+// adoptRouteTable finds an existing route table, either the configured one or the one of the local subnet
+// Subnets without an explicit association use the main route table
+func (c *AwsClient) adoptRouteTable(ctx context.Context) (*ec2.RouteTable, error) {
+	var myRouteTable *ec2.RouteTable
+	var err error
+
+	if c.routeTable == awsSubnetRouteTable {
+		myRouteTable, err = c.getRouteTable(ctx,
+			[]*ec2.Filter{
+				{
+					Name:   aws.String("association.subnet-id"),
+					Values: aws.StringSlice([]string{c.subnetID}),
+				},
+			},
+		)
+		if err == errRouteTableNotFound {
+			logrus.Debug("Subnet is not explicitly associated, using the main route table")
+			myRouteTable, err = c.getMainRouteTable(ctx)
 		}
 	} else {
-		for {
-			select {
-			case _ = <-rt.SyncCh:
-				logrus.Debug("Received sync signal in periodic mode, ignoring")
-			default:
-				err = c.syncRouteTable(rt)
-				if err != nil {
-					logrus.Infof("Failed to sync route table: %s", err)
+		myRouteTable, err = c.getRouteTable(ctx,
+			[]*ec2.Filter{
+				{
+					Name:   aws.String("route-table-id"),
+					Values: aws.StringSlice([]string{c.routeTable}),
+				},
+			},
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find route table %s: %s", c.routeTable, err)
+	}
+
+	if aws.StringValue(myRouteTable.VpcId) != c.vpcID {
+		return nil, fmt.Errorf("Route table %s is not in VPC %s", *myRouteTable.RouteTableId, c.vpcID)
+	}
+
+	logrus.Debugf("Managing existing route table %s", *myRouteTable.RouteTableId)
+	return myRouteTable, nil
+}
+
+// lookupTargets finds route tables of the configured target subnets and route tables in the local VPC
+// Subnets without an explicit association resolve to the main route table
+func (c *AwsClient) lookupTargets(ctx context.Context) ([]*ec2.RouteTable, error) {
+	vpcFilter := &ec2.Filter{
+		Name:   aws.String("vpc-id"),
+		Values: aws.StringSlice([]string{c.vpcID}),
+	}
+
+	byID := make(map[string]*ec2.RouteTable)
+	bySubnet := make(map[string]*ec2.RouteTable)
+	var mainRouteTable *ec2.RouteTable
+
+	err := c.aws.DescribeRouteTablesPagesWithContext(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{vpcFilter},
+	}, func(page *ec2.DescribeRouteTablesOutput, lastPage bool) bool {
+		for _, table := range page.RouteTables {
+			byID[aws.StringValue(table.RouteTableId)] = table
+			for _, assoc := range table.Associations {
+				if aws.BoolValue(assoc.Main) {
+					mainRouteTable = table
+				}
+				if assoc.SubnetId != nil {
+					bySubnet[*assoc.SubnetId] = table
 				}
-				time.Sleep(time.Duration(syncInterval) * time.Second)
 			}
 		}
+		return true
+	})
+	if err != nil {
+		metrics.APIError("aws", "DescribeRouteTables")
+		return nil, fmt.Errorf("Failed to DescribeRouteTables: %s", err)
+	}
+
+	selected := make(map[string]*ec2.RouteTable)
+	var subnetIDs []string
+	for _, id := range c.opts.Targets.IDs {
+		switch {
+		case strings.HasPrefix(id, "rtb-"):
+			table, ok := byID[id]
+			if !ok {
+				return nil, fmt.Errorf("Route table %s not found in VPC %s", id, c.vpcID)
+			}
+			selected[id] = table
+		case strings.HasPrefix(id, "subnet-"):
+			subnetIDs = append(subnetIDs, id)
+		default:
+			return nil, fmt.Errorf("Target %s is neither a route table nor a subnet ID", id)
+		}
+	}
+
+	var subnets []string
+	if len(subnetIDs) > 0 {
+		found, err := c.describeSubnets(ctx, vpcFilter, &ec2.Filter{
+			Name:   aws.String("subnet-id"),
+			Values: aws.StringSlice(subnetIDs),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(found) != len(subnetIDs) {
+			return nil, fmt.Errorf("Only %d out of %d target subnets found in VPC %s", len(found), len(subnetIDs), c.vpcID)
+		}
+		subnets = append(subnets, found...)
+	}
+
+	if c.opts.Targets.All || len(c.opts.Targets.Tags) > 0 {
+		filters := []*ec2.Filter{vpcFilter}
+		if !c.opts.Targets.All {
+			for key, value := range c.opts.Targets.Tags {
+				filters = append(filters, &ec2.Filter{
+					Name:   aws.String("tag:" + key),
+					Values: aws.StringSlice([]string{value}),
+				})
+			}
+		}
+		found, err := c.describeSubnets(ctx, filters...)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, found...)
+	}
+
+	for _, subnetID := range subnets {
+		table, ok := bySubnet[subnetID]
+		if !ok {
+			table = mainRouteTable
+		}
+		if table == nil {
+			return nil, fmt.Errorf("No route table found for subnet %s", subnetID)
+		}
+		selected[aws.StringValue(table.RouteTableId)] = table
+	}
+
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("No route tables match the configured targets")
+	}
+
+	var result []*ec2.RouteTable
+	for _, table := range selected {
+		result = append(result, table)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return aws.StringValue(result[i].RouteTableId) < aws.StringValue(result[j].RouteTableId)
+	})
+	logrus.Debugf("Found %d target route tables", len(result))
+	return result, nil
+}
+
+// describeSubnets returns IDs of all subnets matching filters
+func (c *AwsClient) describeSubnets(ctx context.Context, filters ...*ec2.Filter) ([]string, error) {
+	var result []string
+	err := c.aws.DescribeSubnetsPagesWithContext(ctx, &ec2.DescribeSubnetsInput{
+		Filters: filters,
+	}, func(page *ec2.DescribeSubnetsOutput, lastPage bool) bool {
+		for _, subnet := range page.Subnets {
+			result = append(result, aws.StringValue(subnet.SubnetId))
+		}
+		return true
+	})
+	if err != nil {
+		metrics.APIError("aws", "DescribeSubnets")
+		return nil, fmt.Errorf("Failed to DescribeSubnets: %s", err)
 	}
+	return result, nil
+}
+
+// refreshRouteTable reads the current routes of a managed route table
+func (c *AwsClient) refreshRouteTable(ctx context.Context, table *ec2.RouteTable) (*ec2.RouteTable, error) {
+	return c.getRouteTable(ctx,
+		[]*ec2.Filter{
+			{
+				Name:   aws.String("route-table-id"),
+				Values: aws.StringSlice([]string{aws.StringValue(table.RouteTableId)}),
+			},
+		},
+	)
+}
+
+func (c *AwsClient) getMainRouteTable(ctx context.Context) (*ec2.RouteTable, error) {
+	return c.getRouteTable(ctx,
+		[]*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{c.vpcID}),
+			},
+			{
+				Name:   aws.String("association.main"),
+				Values: aws.StringSlice([]string{"true"}),
+			},
+		},
+	)
 }
 
-func (c *AwsClient) getRouteTable(filters []*ec2.Filter) (*ec2.RouteTable, error) {
+func newAwsPlan(table *ec2.RouteTable, changes diff.Result) *Plan {
+	return newPlan("aws", aws.StringValue(table.RouteTableId), changes)
+}
+
+func (c *AwsClient) getRouteTable(ctx context.Context, filters []*ec2.Filter) (*ec2.RouteTable, error) {
 	logrus.Debugf("Reading route table with filters: %+v", filters)
 
 	input := &ec2.DescribeRouteTablesInput{
 		Filters: filters,
 	}
 
-	result, err := c.aws.DescribeRouteTables(input)
+	result, err := c.aws.DescribeRouteTablesWithContext(ctx, input)
 	if err != nil {
+		metrics.APIError("aws", "DescribeRouteTables")
 		return nil, fmt.Errorf("Failed to DescribeRouteTables: %s", err)
 	}
 
@@ -165,35 +480,24 @@ func (c *AwsClient) getRouteTable(filters []*ec2.Filter) (*ec2.RouteTable, error
 }
 
 // First we need to check what other routes may be present in the main route table
-// This is done to capture the default route pointing to Internet GatewayID
+// This is done to capture routes to gateways, NATs, peerings, endpoints etc.
 // Next, we check if the route table exists, and if not create a new one
-// Right after create we inject the default route to make sure VMs stay online
+// Before associating it we copy the main route table routes to make sure VMs stay online
 // And create a new associating between the new route table and the local subnet
-func (c *AwsClient) ensureRouteTable() error {
+func (c *AwsClient) ensureRouteTable(ctx context.Context) (*ec2.RouteTable, error) {
 
 	logrus.Debug("Reading the main route table")
-	mainRT, err := c.getRouteTable(
-		[]*ec2.Filter{
-			{
-				Name:   aws.String("vpc-id"),
-				Values: aws.StringSlice([]string{c.vpcID}),
-			},
-			{
-				Name:   aws.String("association.main"),
-				Values: aws.StringSlice([]string{"true"}),
-			},
-		},
-	)
+	mainRT, err := c.getMainRouteTable(ctx)
 	if err != nil {
-		return fmt.Errorf("Could not find the main route table: %s", err)
+		return nil, fmt.Errorf("Could not find the main route table: %s", err)
 	}
 
 	logrus.Debug("Checking if our route table exists")
-	myRouteTable, err := c.getRouteTable(
+	myRouteTable, err := c.getRouteTable(ctx,
 		[]*ec2.Filter{
 			{
 				Name:   aws.String("tag:name"),
-				Values: aws.StringSlice([]string{uniquePrefix}),
+				Values: aws.StringSlice([]string{c.opts.owner()}),
 			},
 		},
 	)
@@ -211,198 +515,593 @@ func (c *AwsClient) ensureRouteTable() error {
 						Tags: []*ec2.Tag{
 							{
 								Key:   aws.String("name"),
-								Value: aws.String(uniquePrefix),
+								Value: aws.String(c.opts.owner()),
 							},
 						},
 					},
 				},
 			}
 
-			resp, err := c.aws.CreateRouteTable(input)
+			resp, err := c.aws.CreateRouteTableWithContext(ctx, input)
 			if err != nil {
-				return fmt.Errorf("Failed to CreateRouteTable: %w", err)
+				metrics.APIError("aws", "CreateRouteTable")
+				return nil, fmt.Errorf("Failed to CreateRouteTable: %w", err)
 			}
 
-			for _, route := range onlyDefaultRoute(mainRT.Routes) {
-				logrus.Debugf("Checking a route from the main RT: %s", *route.DestinationCidrBlock)
-
-				if route.GatewayId != nil {
-					logrus.Info("Adding a default route from the main route table")
+			myRouteTable = resp.RouteTable
+		default:
+			return nil, err
+		}
+	} else {
+		logrus.Debugf("Route table already exists")
+	}
 
-					input := &ec2.CreateRouteInput{
-						DestinationCidrBlock: route.DestinationCidrBlock,
-						GatewayId:            route.GatewayId,
-						RouteTableId:         resp.RouteTable.RouteTableId,
-					}
+	st, err := c.opts.State.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-					_, err := c.aws.CreateRoute(input)
-					if err != nil {
-						return fmt.Errorf("Failed to add base routes from main RT: %s", err)
-					}
-				}
-			}
+	// Only recorded copies are replaced, other routes already present may have been taken over by proposed routes
+	key := mainRoutesKey(myRouteTable)
+	myRouteTable, copied, err := c.syncMainRoutes(ctx, mainRT, myRouteTable, nil, st.Owned(key))
 
-			c.awsRouteTable = resp.RouteTable
-			return c.associateRouteTable()
-		default:
-			return err
+	// Copies are recorded even if some of them failed, so that they are found by the next sync
+	if !c.opts.DryRun && !reflect.DeepEqual(st.Owned(key), copied) {
+		st.SetOwned(key, copied)
+		if err := c.opts.State.Save(ctx, st); err != nil {
+			return nil, err
 		}
 	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add base routes from main RT: %s", err)
+	}
 
-	c.awsRouteTable = myRouteTable
-	logrus.Debugf("Route table already exists")
+	return myRouteTable, c.associateRouteTable(ctx, myRouteTable)
+}
 
-	return c.associateRouteTable()
+// mainRoutesKey records routes copied from the main route table next to the owned routes of a route table
+func mainRoutesKey(table *ec2.RouteTable) string {
+	return aws.StringValue(table.RouteTableId) + "/main"
 }
 
-func onlyDefaultRoute(routes []*ec2.Route) []*ec2.Route {
-	logrus.Debugf("Finding default route to internet GW")
+// copyableRoutes returns routes of the main route table by destination that can be copied into another route table
+// Local routes exist in every route table, others that can not be copied are reported once
+func (c *AwsClient) copyableRoutes(routes []*ec2.Route) map[string]*ec2.Route {
+	result := make(map[string]*ec2.Route)
 	for _, route := range routes {
-		if strings.HasPrefix(*route.GatewayId, "igw") {
-			return []*ec2.Route{route}
+		dest := routeDestination(route)
+		switch {
+		case dest == "" || aws.StringValue(route.GatewayId) == "local":
+			continue
+		case aws.StringValue(route.Origin) == ec2.RouteOriginEnableVgwRoutePropagation:
+			c.reportUncopied(dest, "it is propagated by a virtual private gateway, route propagation has to be enabled instead")
+		case aws.StringValue(route.State) == ec2.RouteStateBlackhole:
+			c.reportUncopied(dest, "its target no longer exists")
+		case awsRouteTarget(route) == "":
+			c.reportUncopied(dest, "its target type is not supported")
+		default:
+			result[dest] = route
 		}
 	}
-	return nil
+	return result
 }
 
-func filterRoutes(routes []*ec2.Route) (result []*ec2.Route) {
-	logrus.Debugf("Filtering out routes that don't have NetworkInterfaceID set")
-	for _, route := range routes {
-		if route.NetworkInterfaceId == nil {
+// reportUncopied warns about a main route table route that can not be copied, only once per route and reason
+func (c *AwsClient) reportUncopied(dest, reason string) {
+	key := dest + " " + reason
+	if c.uncopied[key] {
+		return
+	}
+	c.uncopied[key] = true
+	logrus.Warnf("Route %s of the main route table can not be copied, %s", dest, reason)
+}
+
+// syncMainRoutes keeps all non-local routes of the main route table in a dedicated route table
+// Proposed routes take precedence, copies of routes removed from the main route table are deleted
+// It returns the refreshed route table and all copied routes by destination
+func (c *AwsClient) syncMainRoutes(ctx context.Context, mainRT, table *ec2.RouteTable, proposed []diff.Route, copied map[string]string) (*ec2.RouteTable, map[string]string, error) {
+	isProposed := make(map[string]bool)
+	for _, r := range proposed {
+		isProposed[r.Prefix] = true
+	}
+
+	wanted := c.copyableRoutes(mainRT.Routes)
+	for dest := range isProposed {
+		delete(wanted, dest)
+	}
+
+	current := make(map[string]*ec2.Route)
+	for _, route := range table.Routes {
+		if dest := routeDestination(route); dest != "" && aws.StringValue(route.GatewayId) != "local" {
+			current[dest] = route
+		}
+	}
+
+	result := make(map[string]string)
+	var opErrors []string
+	changed := false
+
+	for dest, route := range wanted {
+		target := awsRouteTarget(route)
+		existing, ok := current[dest]
+		switch {
+		case ok && awsRouteTarget(existing) == target:
+			result[dest] = target
 			continue
+		case ok && copied[dest] != awsRouteTarget(existing):
+			c.reportUncopied(dest, fmt.Sprintf("it is already routed via %s", awsRouteTarget(existing)))
+			continue
+		}
+
+		if c.opts.DryRun {
+			logrus.Infof("Would copy route %s via %s from the main route table", dest, target)
+			continue
+		}
+
+		var err error
+		if ok {
+			logrus.Infof("Replacing route %s via %s with %s from the main route table", dest, awsRouteTarget(existing), target)
+			err = c.replaceCopiedRoute(ctx, table, route)
+		} else {
+			logrus.Infof("Copying route %s via %s from the main route table", dest, target)
+			err = c.createCopiedRoute(ctx, table, route)
 		}
-		result = append(result, route)
+		changed = true
+		if err != nil {
+			opErrors = append(opErrors, fmt.Sprintf("%s: %s", dest, err))
+			continue
+		}
+		result[dest] = target
 	}
-	return result
+
+	for dest, target := range copied {
+		existing, ok := current[dest]
+		if _, stillWanted := wanted[dest]; stillWanted || !ok || awsRouteTarget(existing) != target || isProposed[dest] {
+			continue
+		}
+
+		if c.opts.DryRun {
+			logrus.Infof("Would delete route %s via %s removed from the main route table", dest, target)
+			continue
+		}
+
+		logrus.Infof("Deleting route %s via %s removed from the main route table", dest, target)
+		changed = true
+		if err := c.deleteCopiedRoute(ctx, table, existing); err != nil {
+			opErrors = append(opErrors, fmt.Sprintf("%s: %s", dest, err))
+			result[dest] = target
+		}
+	}
+
+	if changed {
+		refreshed, err := c.refreshRouteTable(ctx, table)
+		if err != nil {
+			return table, result, fmt.Errorf("Failed to update route table: %s", err)
+		}
+		table = refreshed
+	}
+
+	if len(opErrors) > 0 {
+		return table, result, fmt.Errorf("Failed to copy %d routes of the main route table: %s", len(opErrors), strings.Join(opErrors, "; "))
+	}
+	return table, result, nil
 }
 
-func (c *AwsClient) syncRouteTable(rt *route.Table) error {
+// Gateway endpoint routes can not be created directly, the route table is added to the endpoint instead
+func (c *AwsClient) createCopiedRoute(ctx context.Context, table *ec2.RouteTable, route *ec2.Route) error {
+	if id := aws.StringValue(route.GatewayId); strings.HasPrefix(id, "vpce-") {
+		return c.modifyGatewayEndpoint(ctx, &ec2.ModifyVpcEndpointInput{
+			VpcEndpointId:    aws.String(id),
+			AddRouteTableIds: []*string{table.RouteTableId},
+		})
+	}
 
-	currentRoutes := filterRoutes(c.awsRouteTable.Routes)
-	logrus.Debugf("Current routes %+v", currentRoutes)
+	input := &ec2.CreateRouteInput{
+		RouteTableId:                table.RouteTableId,
+		DestinationCidrBlock:        route.DestinationCidrBlock,
+		DestinationIpv6CidrBlock:    route.DestinationIpv6CidrBlock,
+		DestinationPrefixListId:     route.DestinationPrefixListId,
+		CarrierGatewayId:            route.CarrierGatewayId,
+		EgressOnlyInternetGatewayId: route.EgressOnlyInternetGatewayId,
+		GatewayId:                   route.GatewayId,
+		LocalGatewayId:              route.LocalGatewayId,
+		NatGatewayId:                route.NatGatewayId,
+		NetworkInterfaceId:          route.NetworkInterfaceId,
+		TransitGatewayId:            route.TransitGatewayId,
+		VpcPeeringConnectionId:      route.VpcPeeringConnectionId,
+	}
+	// Routes to an instance also carry its primary interface, only one of them can be set
+	if route.NetworkInterfaceId == nil {
+		input.InstanceId = route.InstanceId
+	}
 
-	proposedRoutes := c.buildRoutes(rt)
-	logrus.Debugf("Proposed routes %+v", proposedRoutes)
+	if _, err := c.aws.CreateRouteWithContext(ctx, input); err != nil {
+		metrics.APIError("aws", "CreateRoute")
+		return err
+	}
+	metrics.RoutesAdded("aws", 1)
+	return nil
+}
+
+func (c *AwsClient) replaceCopiedRoute(ctx context.Context, table *ec2.RouteTable, route *ec2.Route) error {
+	if strings.HasPrefix(aws.StringValue(route.GatewayId), "vpce-") {
+		return fmt.Errorf("gateway endpoint routes can not replace other routes")
+	}
+
+	input := &ec2.ReplaceRouteInput{
+		RouteTableId:                table.RouteTableId,
+		DestinationCidrBlock:        route.DestinationCidrBlock,
+		DestinationIpv6CidrBlock:    route.DestinationIpv6CidrBlock,
+		DestinationPrefixListId:     route.DestinationPrefixListId,
+		CarrierGatewayId:            route.CarrierGatewayId,
+		EgressOnlyInternetGatewayId: route.EgressOnlyInternetGatewayId,
+		GatewayId:                   route.GatewayId,
+		LocalGatewayId:              route.LocalGatewayId,
+		NatGatewayId:                route.NatGatewayId,
+		NetworkInterfaceId:          route.NetworkInterfaceId,
+		TransitGatewayId:            route.TransitGatewayId,
+		VpcPeeringConnectionId:      route.VpcPeeringConnectionId,
+	}
+	if route.NetworkInterfaceId == nil {
+		input.InstanceId = route.InstanceId
+	}
+
+	if _, err := c.aws.ReplaceRouteWithContext(ctx, input); err != nil {
+		metrics.APIError("aws", "ReplaceRoute")
+		return err
+	}
+	metrics.RoutesReplaced("aws", 1)
+	return nil
+}
 
-	toAdd := []*ec2.Route{}
-	for _, proposedRoute := range proposedRoutes {
-		if len(currentRoutes) == 0 {
-			toAdd = append(toAdd, proposedRoute)
+func (c *AwsClient) deleteCopiedRoute(ctx context.Context, table *ec2.RouteTable, route *ec2.Route) error {
+	if id := aws.StringValue(route.GatewayId); strings.HasPrefix(id, "vpce-") {
+		return c.modifyGatewayEndpoint(ctx, &ec2.ModifyVpcEndpointInput{
+			VpcEndpointId:       aws.String(id),
+			RemoveRouteTableIds: []*string{table.RouteTableId},
+		})
+	}
+
+	input := &ec2.DeleteRouteInput{
+		RouteTableId:             table.RouteTableId,
+		DestinationCidrBlock:     route.DestinationCidrBlock,
+		DestinationIpv6CidrBlock: route.DestinationIpv6CidrBlock,
+		DestinationPrefixListId:  route.DestinationPrefixListId,
+	}
+	if _, err := c.aws.DeleteRouteWithContext(ctx, input); err != nil {
+		metrics.APIError("aws", "DeleteRoute")
+		return err
+	}
+	metrics.RoutesDeleted("aws", 1)
+	return nil
+}
+
+func (c *AwsClient) modifyGatewayEndpoint(ctx context.Context, input *ec2.ModifyVpcEndpointInput) error {
+	if _, err := c.aws.ModifyVpcEndpointWithContext(ctx, input); err != nil {
+		metrics.APIError("aws", "ModifyVpcEndpoint")
+		return err
+	}
+	return nil
+}
+
+// syncRouteTable syncs all managed route tables concurrently and records their owned routes
+func (c *AwsClient) syncRouteTable(ctx context.Context, rt *route.Table) error {
+	// Targets are looked up on every sync, so that new subnets receive routes as well
+	if !c.opts.Targets.Empty() {
+		if err := c.discoverRouteTables(ctx, true); err != nil {
+			return err
 		}
-		for _, currentRoute := range currentRoutes {
-			if !routesEqual(proposedRoute, currentRoute) {
-				toAdd = append(toAdd, proposedRoute)
-			}
+	}
+
+	st, err := c.opts.State.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	proposed := c.buildRoutes(ctx, rt)
+
+	var failed []string
+	changed := false
+
+	// A dedicated route table follows the main route table, so that VMs keep reaching gateways, NATs, peerings etc.
+	if !c.adopted() {
+		var err error
+		if changed, err = c.syncDedicatedMainRoutes(ctx, st, proposed); err != nil {
+			failed = append(failed, err.Error())
 		}
 	}
 
-	toDelete := []*ec2.Route{}
-	for _, currentRoute := range currentRoutes {
-		if len(proposedRoutes) == 0 {
-			toDelete = append(toDelete, currentRoute)
+	owned := make([]map[string]string, len(c.awsRouteTables))
+	errs := make([]error, len(c.awsRouteTables))
+	var wg sync.WaitGroup
+
+	for i, table := range c.awsRouteTables {
+		wg.Add(1)
+
+		go func(i int, table *ec2.RouteTable, current map[string]string, wg *sync.WaitGroup) {
+			defer wg.Done()
+			c.awsRouteTables[i], owned[i], errs[i] = c.syncTable(ctx, table, proposed, current)
+		}(i, table, st.Owned(aws.StringValue(table.RouteTableId)), &wg)
+	}
+	wg.Wait()
+
+	for i, table := range c.awsRouteTables {
+		id := aws.StringValue(table.RouteTableId)
+		metrics.SetTargetSynced("aws", id, errs[i])
+		if errs[i] != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", id, errs[i]))
 		}
-		for _, proposedRoute := range proposedRoutes {
-			if !routesEqual(currentRoute, proposedRoute) {
-				toDelete = append(toDelete, currentRoute)
-			}
+		if owned[i] != nil && !reflect.DeepEqual(st.Owned(id), owned[i]) {
+			st.SetOwned(id, owned[i])
+			changed = true
 		}
 	}
 
+	if changed {
+		if err := c.opts.State.Save(ctx, st); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to sync %d out of %d route tables: %s", len(failed), len(c.awsRouteTables), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// syncDedicatedMainRoutes copies main route table routes into the dedicated route table
+// It returns true if the recorded copies have changed
+func (c *AwsClient) syncDedicatedMainRoutes(ctx context.Context, st *state.State, proposed []diff.Route) (bool, error) {
+	mainRT, err := c.getMainRouteTable(ctx)
+	if err != nil {
+		return false, fmt.Errorf("Could not find the main route table: %s", err)
+	}
+
+	key := mainRoutesKey(c.awsRouteTables[0])
+	table, copied, err := c.syncMainRoutes(ctx, mainRT, c.awsRouteTables[0], proposed, st.Owned(key))
+	c.awsRouteTables[0] = table
+
+	if c.opts.DryRun || reflect.DeepEqual(st.Owned(key), copied) {
+		return false, err
+	}
+	st.SetOwned(key, copied)
+	return true, err
+}
+
+// syncTable applies changes to a single route table
+// It returns the refreshed route table and its owned routes, which are nil if nothing has been changed
+func (c *AwsClient) syncTable(ctx context.Context, table *ec2.RouteTable, proposed []diff.Route, owned map[string]string) (*ec2.RouteTable, map[string]string, error) {
+	changes := c.diffRoutes(table, proposed, owned)
+
+	plan := newAwsPlan(table, changes)
+	metrics.SetCloudRoutes("aws", plan.Table, len(table.Routes))
+	metrics.SetDrift("aws", plan.Table, plan.Changes())
+
+	if c.opts.DryRun {
+		c.opts.printPlan(plan)
+		return table, nil, nil
+	}
+
 	var opErrors []error
+	var mu sync.Mutex
 	var wg sync.WaitGroup
 
-	for _, route := range toAdd {
+	recordResult := func(err error, operation string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil {
+			metrics.APIError("aws", operation)
+			metrics.RoutesFailed("aws", 1)
+			opErrors = append(opErrors, fmt.Errorf("Failed to %s: %s", operation, err))
+			return
+		}
+		switch operation {
+		case "DeleteRoute":
+			metrics.RoutesDeleted("aws", 1)
+		case "ReplaceRoute":
+			metrics.RoutesReplaced("aws", 1)
+		default:
+			metrics.RoutesAdded("aws", 1)
+		}
+	}
+
+	// Next hop changes are replaced in place, so every prefix gets at most one operation
+	for _, route := range changes.Delete {
 		wg.Add(1)
 
-		go func(route *ec2.Route, wg *sync.WaitGroup) {
+		go func(route diff.Route, wg *sync.WaitGroup) {
 			defer wg.Done()
 
-			input := &ec2.CreateRouteInput{
-				DestinationCidrBlock: route.DestinationCidrBlock,
-				NetworkInterfaceId:   route.NetworkInterfaceId,
-				RouteTableId:         c.awsRouteTable.RouteTableId,
+			input := &ec2.DeleteRouteInput{
+				RouteTableId: table.RouteTableId,
 			}
+			input.DestinationCidrBlock, input.DestinationIpv6CidrBlock = awsDestination(route.Prefix)
 
-			logrus.Infof("Creating route %s in %s", *route.DestinationCidrBlock, *c.awsRouteTable.RouteTableId)
-			_, err := c.aws.CreateRoute(input)
-			if err != nil {
-				opErrors = append(opErrors, fmt.Errorf("Failed to create route: %s", err))
-			}
+			logrus.Infof("Deleting route %s in %s", route.Prefix, *table.RouteTableId)
+			_, err := c.aws.DeleteRouteWithContext(ctx, input)
+			recordResult(err, "DeleteRoute")
 		}(route, &wg)
 	}
 
-	for _, route := range toDelete {
+	for _, route := range changes.Replace {
 		wg.Add(1)
 
-		go func(route *ec2.Route, wg *sync.WaitGroup) {
+		go func(route diff.Replacement, wg *sync.WaitGroup) {
 			defer wg.Done()
 
-			input := &ec2.DeleteRouteInput{
-				DestinationCidrBlock: route.DestinationCidrBlock,
-				RouteTableId:         c.awsRouteTable.RouteTableId,
+			input := &ec2.ReplaceRouteInput{
+				NetworkInterfaceId: aws.String(route.To),
+				RouteTableId:       table.RouteTableId,
 			}
+			input.DestinationCidrBlock, input.DestinationIpv6CidrBlock = awsDestination(route.Prefix)
 
-			logrus.Infof("Deleting route %s in %s", *route.DestinationCidrBlock, *c.awsRouteTable.RouteTableId)
-			_, err := c.aws.DeleteRoute(input)
-			if err != nil {
-				opErrors = append(opErrors, fmt.Errorf("Failed to create route: %s", err))
-			}
+			logrus.Infof("Replacing route %s via %s with %s in %s", route.Prefix, route.From, route.To, *table.RouteTableId)
+			_, err := c.aws.ReplaceRouteWithContext(ctx, input)
+			recordResult(err, "ReplaceRoute")
 		}(route, &wg)
 	}
 
+	for _, route := range changes.Add {
+		wg.Add(1)
+
+		go func(route diff.Route, wg *sync.WaitGroup) {
+			defer wg.Done()
+
+			input := &ec2.CreateRouteInput{
+				NetworkInterfaceId: aws.String(route.Nexthop),
+				RouteTableId:       table.RouteTableId,
+			}
+			input.DestinationCidrBlock, input.DestinationIpv6CidrBlock = awsDestination(route.Prefix)
+
+			logrus.Infof("Creating route %s in %s", route.Prefix, *table.RouteTableId)
+			_, err := c.aws.CreateRouteWithContext(ctx, input)
+			recordResult(err, "CreateRoute")
+		}(route, &wg)
+	}
 	wg.Wait()
+
 	for _, err := range opErrors {
 		logrus.Infof("Failed route operation: %s", err)
 	}
 
-	if len(toAdd)+len(toDelete) > 0 {
-		logrus.Debug("Updating own route table")
-		myRouteTable, err := c.getRouteTable(
-			[]*ec2.Filter{
-				{
-					Name:   aws.String("tag:name"),
-					Values: aws.StringSlice([]string{uniquePrefix}),
-				},
-			},
-		)
+	if changes.Len() > 0 {
+		logrus.Debugf("Updating route table %s", *table.RouteTableId)
+		refreshed, err := c.refreshRouteTable(ctx, table)
 		if err != nil {
-			return fmt.Errorf("Failed to update route table")
+			return table, nil, fmt.Errorf("Failed to update route table: %s", err)
 		}
-		c.awsRouteTable = myRouteTable
+		table = refreshed
 	}
 
-	return nil
+	owned = ownedRoutes(table, owned, proposed)
+
+	if len(opErrors) > 0 {
+		return table, owned, fmt.Errorf("%d out of %d route operations failed", len(opErrors), changes.Len())
+	}
+
+	return table, owned, nil
+}
+
+// diffRoutes only deletes owned routes, routes of others at proposed prefixes are replaced
+// in a dedicated route table and left alone in an existing one
+func (c *AwsClient) diffRoutes(table *ec2.RouteTable, proposedRoutes []diff.Route, owned map[string]string) diff.Result {
+	targets := replaceableRoutes(table.Routes)
+
+	var currentRoutes []diff.Route
+	for prefix, target := range targets {
+		currentRoutes = append(currentRoutes, diff.Route{Prefix: prefix, Nexthop: target})
+	}
+	logrus.Debugf("Current routes of %s %+v", aws.StringValue(table.RouteTableId), currentRoutes)
+	logrus.Debugf("Proposed routes %+v", proposedRoutes)
+
+	// Routes repointed by somebody else since they were recorded are no longer owned
+	changes := diff.Routes(currentRoutes, proposedRoutes, func(r diff.Route) bool {
+		return owned[r.Prefix] == r.Nexthop
+	})
+
+	// Prefixes held by others, e.g. a gateway, a NAT or a manually added route, are taken over in place
+	var toAdd []diff.Route
+	for _, r := range changes.Add {
+		if target, ok := targets[r.Prefix]; ok {
+			if c.adopted() {
+				logrus.Warnf("Skipping route %s in %s, the prefix is already routed via %s", r.Prefix, aws.StringValue(table.RouteTableId), target)
+				continue
+			}
+			changes.Replace = append(changes.Replace, diff.Replacement{Prefix: r.Prefix, From: target, To: r.Nexthop})
+			continue
+		}
+		toAdd = append(toAdd, r)
+	}
+	changes.Add = toAdd
+	sort.Slice(changes.Replace, func(i, j int) bool { return changes.Replace[i].Prefix < changes.Replace[j].Prefix })
+
+	return changes
 }
 
-func (c *AwsClient) buildRoutes(rt *route.Table) (result []*ec2.Route) {
-OUTER:
-	for prefix, nextHop := range rt.Routes {
+// ownedRoutes returns owned routes after a sync: all proposed routes present in the route table
+// and previously owned routes that could not be deleted or replaced
+func ownedRoutes(table *ec2.RouteTable, owned map[string]string, proposed []diff.Route) map[string]string {
+	targets := replaceableRoutes(table.Routes)
+
+	result := make(map[string]string)
+	for prefix, nextHop := range owned {
+		if targets[prefix] == nextHop {
+			result[prefix] = nextHop
+		}
+	}
+	for _, r := range proposed {
+		if targets[r.Prefix] == r.Nexthop {
+			result[r.Prefix] = r.Nexthop
+		}
+	}
+	return result
+}
+
+// replaceableRoutes returns targets of all routes by their prefix
+// Local and propagated routes can not be replaced or deleted
+func replaceableRoutes(routes []*ec2.Route) map[string]string {
+	result := make(map[string]string)
+	for _, route := range routes {
+		if routeDestination(route) == "" {
+			continue
+		}
+		if aws.StringValue(route.GatewayId) == "local" || aws.StringValue(route.Origin) == ec2.RouteOriginEnableVgwRoutePropagation {
+			continue
+		}
+		result[routeDestination(route)] = awsRouteTarget(route)
+	}
+	return result
+}
+
+// awsRouteTarget returns the ID of whatever a route points to
+func awsRouteTarget(route *ec2.Route) string {
+	for _, id := range []*string{
+		route.NetworkInterfaceId,
+		route.InstanceId,
+		route.GatewayId,
+		route.NatGatewayId,
+		route.TransitGatewayId,
+		route.VpcPeeringConnectionId,
+		route.EgressOnlyInternetGatewayId,
+		route.CarrierGatewayId,
+		route.LocalGatewayId,
+	} {
+		if id != nil {
+			return *id
+		}
+	}
+	return ""
+}
+
+func (c *AwsClient) buildRoutes(ctx context.Context, rt *route.Table) (result []diff.Route) {
+	for prefix, nextHops := range rt.Snapshot() {
+		// No ECMP support, picking the lowest next hop as primary
+		nextHop := nextHops.Primary()
 
 		ip, _, err := net.ParseCIDR(prefix)
 		if err != nil {
 			logrus.Infof("Failed to parse prefix: %s", prefix)
 			continue
 		}
-		for _, subnet := range awsReservedRanges {
-			if subnet != nil && subnet.Contains(ip) {
-				logrus.Debugf("Ignoring IP from AWS reserved ranges: %s", ip)
-				continue OUTER
-			}
+		if c.opts.isReserved(ip, awsReservedRanges, awsReservedRangesV6) {
+			logrus.Debugf("Ignoring IP from AWS reserved ranges: %s", ip)
+			continue
 		}
 
-		result = append(result, &ec2.Route{
-			DestinationCidrBlock: aws.String(prefix),
-			NetworkInterfaceId:   aws.String(c.nicIDFromIP(nextHop.String())),
+		result = append(result, diff.Route{
+			Prefix:  prefix,
+			Nexthop: c.nicIDFromIP(ctx, nextHop.String()),
 		})
 	}
 	return result
 }
 
-func (c *AwsClient) associateRouteTable() error {
+func (c *AwsClient) associateRouteTable(ctx context.Context, table *ec2.RouteTable) error {
 	logrus.Debugf("Ensuring route table is associated")
 
-	for _, assoc := range c.awsRouteTable.Associations {
-		if *assoc.SubnetId == c.subnetID {
+	for _, assoc := range table.Associations {
+		if aws.StringValue(assoc.SubnetId) == c.subnetID {
 			logrus.Debugf("Route table is already associated, nothing to do")
 			return nil
 		}
@@ -410,19 +1109,20 @@ func (c *AwsClient) associateRouteTable() error {
 
 	logrus.Debugf("Associating route table with the subnet")
 	input := &ec2.AssociateRouteTableInput{
-		RouteTableId: aws.String(*c.awsRouteTable.RouteTableId),
+		RouteTableId: table.RouteTableId,
 		SubnetId:     aws.String(c.subnetID),
 	}
 
-	_, err := c.aws.AssociateRouteTable(input)
+	_, err := c.aws.AssociateRouteTableWithContext(ctx, input)
 	if err != nil {
+		metrics.APIError("aws", "AssociateRouteTable")
 		return err
 	}
 
 	return nil
 }
 
-func (c *AwsClient) nicIDFromIP(ip string) string {
+func (c *AwsClient) nicIDFromIP(ctx context.Context, ip string) string {
 	logrus.Debugf("Calculating nic ID from IP: %s", ip)
 
 	if id, ok := c.nicIPtoID[ip]; ok {
@@ -438,8 +1138,9 @@ func (c *AwsClient) nicIDFromIP(ip string) string {
 		},
 	}
 
-	nics, err := c.aws.DescribeNetworkInterfaces(input)
+	nics, err := c.aws.DescribeNetworkInterfacesWithContext(ctx, input)
 	if err != nil {
+		metrics.APIError("aws", "DescribeNetworkInterfaces")
 		logrus.Infof("Failed to DescribeNetworkInterfaces: %s", err)
 		return ""
 	}
@@ -452,6 +1153,14 @@ func (c *AwsClient) nicIDFromIP(ip string) string {
 			c.nicIPtoID[ip] = *nic.NetworkInterfaceId
 			return *nic.NetworkInterfaceId
 		}
+
+		for _, ipv6 := range nic.Ipv6Addresses {
+			if net.ParseIP(aws.StringValue(ipv6.Ipv6Address)).Equal(net.ParseIP(ip)) {
+				logrus.Debugf("Found a matching nic ID for IPv6 %s", ip)
+				c.nicIPtoID[ip] = *nic.NetworkInterfaceId
+				return *nic.NetworkInterfaceId
+			}
+		}
 	}
 
 	logrus.Infof("Failed to find an AWS interface matching IP: %s", ip)
@@ -459,13 +1168,14 @@ func (c *AwsClient) nicIDFromIP(ip string) string {
 	return c.privateIP
 }
 
-func (c *AwsClient) lookupAwsSubnet() error {
+func (c *AwsClient) lookupAwsSubnet(ctx context.Context) error {
 	logrus.Debugf("Looking for subnetID for instanceID %s", c.instanceID)
 
-	instances, err := c.aws.DescribeInstances(&ec2.DescribeInstancesInput{
+	instances, err := c.aws.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{aws.String(c.instanceID)},
 	})
 	if err != nil {
+		metrics.APIError("aws", "DescribeInstances")
 		return fmt.Errorf("Failed to DescribeInstances: %s", err)
 	}
 
@@ -497,11 +1207,21 @@ func (c *AwsClient) lookupAwsSubnet() error {
 	return fmt.Errorf("Failed to find the matching instance and NIC")
 }
 
-func routesEqual(route1, route2 *ec2.Route) bool {
-	if *route1.DestinationCidrBlock == *route2.DestinationCidrBlock {
-		if *route1.NetworkInterfaceId == *route2.NetworkInterfaceId {
-			return true
-		}
+// routeDestination returns either IPv4, IPv6 or prefix list destination of a route
+func routeDestination(route *ec2.Route) string {
+	if route.DestinationIpv6CidrBlock != nil {
+		return *route.DestinationIpv6CidrBlock
+	}
+	if route.DestinationPrefixListId != nil {
+		return *route.DestinationPrefixListId
+	}
+	return aws.StringValue(route.DestinationCidrBlock)
+}
+
+// awsDestination returns either IPv4 or IPv6 destination of a route input
+func awsDestination(prefix string) (*string, *string) {
+	if ip, _, err := net.ParseCIDR(prefix); err == nil && ip.To4() == nil {
+		return nil, aws.String(prefix)
 	}
-	return false
+	return aws.String(prefix), nil
 }
@@ -0,0 +1,56 @@
+package reconciler
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestAwsCopyableRoutes(t *testing.T) {
+	c := &AwsClient{uncopied: make(map[string]bool)}
+
+	// Only the local route has a gateway, which used to be dereferenced for every route
+	routes := []*ec2.Route{
+		{DestinationCidrBlock: aws.String("10.0.0.0/16"), GatewayId: aws.String("local")},
+		{DestinationIpv6CidrBlock: aws.String("2001:db8::/56"), GatewayId: aws.String("local")},
+		{DestinationCidrBlock: aws.String("0.0.0.0/0"), NatGatewayId: aws.String("nat-1")},
+		{DestinationIpv6CidrBlock: aws.String("::/0"), EgressOnlyInternetGatewayId: aws.String("eigw-1")},
+		{DestinationCidrBlock: aws.String("10.1.0.0/16"), VpcPeeringConnectionId: aws.String("pcx-1")},
+		{DestinationCidrBlock: aws.String("10.2.0.0/16"), TransitGatewayId: aws.String("tgw-1")},
+		{DestinationPrefixListId: aws.String("pl-1"), GatewayId: aws.String("vpce-1")},
+		{DestinationCidrBlock: aws.String("10.3.0.0/16"), InstanceId: aws.String("i-1"), NetworkInterfaceId: aws.String("eni-1")},
+		{DestinationCidrBlock: aws.String("10.4.0.0/16"), NatGatewayId: aws.String("nat-2"), State: aws.String(ec2.RouteStateBlackhole)},
+		{DestinationCidrBlock: aws.String("10.5.0.0/16"), GatewayId: aws.String("vgw-1"), Origin: aws.String(ec2.RouteOriginEnableVgwRoutePropagation)},
+	}
+
+	got := c.copyableRoutes(routes)
+
+	want := map[string]string{
+		"0.0.0.0/0":   "nat-1",
+		"::/0":        "eigw-1",
+		"10.1.0.0/16": "pcx-1",
+		"10.2.0.0/16": "tgw-1",
+		"pl-1":        "vpce-1",
+		"10.3.0.0/16": "eni-1",
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected %d copyable routes, got %d", len(want), len(got))
+	}
+	for dest, target := range want {
+		if route, ok := got[dest]; !ok || awsRouteTarget(route) != target {
+			t.Errorf("expected %s via %s to be copied, got %+v", dest, target, route)
+		}
+	}
+
+	var reported []string
+	for key := range c.uncopied {
+		reported = append(reported, strings.Fields(key)[0])
+	}
+	sort.Strings(reported)
+	if strings.Join(reported, ",") != "10.4.0.0/16,10.5.0.0/16" {
+		t.Errorf("expected blackhole and propagated routes to be reported, got %v", reported)
+	}
+}
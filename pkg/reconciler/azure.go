@@ -2,25 +2,36 @@ package reconciler
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
-	"os"
+	"net/http"
+	"path"
 	"strings"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-01/compute"
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2020-06-01/network"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/networkop/cloudroutesync/pkg/diff"
+	"github.com/networkop/cloudroutesync/pkg/metrics"
 	"github.com/networkop/cloudroutesync/pkg/route"
+	"github.com/networkop/cloudroutesync/pkg/state"
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	defaultSub    = "1aebf65e-be71-4dac-8755-1a58f16dd74d"
-	defaultRG     = "example-resources"
-	defaultPrefix = "cloudroutesync-"
-)
+const azureRouteTableObject = "route-table"
+
+// azureMetadataEndpoint is the compute section of the Azure Instance Metadata Service
+var azureMetadataEndpoint = "http://169.254.169.254/metadata/instance/compute?api-version=2020-09-01"
+
+// azureMetadataClient never goes through HTTP(S)_PROXY, which can't reach the link-local metadata endpoint
+var azureMetadataClient = &http.Client{
+	Transport: &http.Transport{Proxy: nil},
+	Timeout:   5 * time.Second,
+}
 
 var azureReservedRanges = []*net.IPNet{
 	route.ParseCIDR("224.0.0.0/4"),
@@ -30,34 +41,108 @@ var azureReservedRanges = []*net.IPNet{
 	route.ParseCIDR("168.63.129.16/32"),
 }
 
+var azureReservedRangesV6 = []*net.IPNet{
+	route.ParseCIDR("ff00::/8"),
+	route.ParseCIDR("::1/128"),
+	route.ParseCIDR("fe80::/10"),
+}
+
+// Subnets of Azure services that are never targeted when selecting subnets by VNET
+var azureServiceSubnets = map[string]bool{
+	"GatewaySubnet":                 true,
+	"AzureFirewallSubnet":           true,
+	"AzureFirewallManagementSubnet": true,
+	"AzureBastionSubnet":            true,
+	"RouteServerSubnet":             true,
+}
+
 // AzureClient stores cloud client and values
+// ResourceGroup holds the managed route table, the local VNET may be in another one
 type AzureClient struct {
-	ResourceGroup   string
-	SubscriptionID  string
-	Authorizer      autorest.Authorizer
-	GenerateName    func(string) string
-	azureSubnet     network.Subnet
-	azureRouteTable network.RouteTable
-	azureVnetName   *string
-	location        *string
+	ResourceGroup     string
+	SubscriptionID    string
+	Authorizer        autorest.Authorizer
+	GenerateName      func(string) string
+	azureSubnet       network.Subnet
+	azureRouteTable   network.RouteTable
+	azureVnetName     *string
+	vnetResourceGroup string
+	vmID              string
+	location          *string
+	// Route Server peered with instead of programming the route table, resource group defaults to ResourceGroup
+	routeServer, routeServerRG string
+	peerASN                    int64
+	opts                       Options
+}
+
+// AzureSettings define where Azure routes are managed
+type AzureSettings struct {
+	// SubscriptionID and ResourceGroup of the managed resources default to the ones of the local VM
+	SubscriptionID string
+	ResourceGroup  string
+	// IdentityClientID selects a user-assigned managed identity
+	IdentityClientID string
+	// RouteServer enables Route Server mode, the local VM is peered with it instead of programming the route table
+	RouteServer              string
+	RouteServerResourceGroup string
+	// PeerASN is the BGP ASN of the local routing daemon
+	PeerASN int64
+}
+
+// azureInstanceMetadata is the part of the compute metadata of the local VM used for discovery
+type azureInstanceMetadata struct {
+	SubscriptionID string `json:"subscriptionId"`
+	ResourceGroup  string `json:"resourceGroupName"`
+	Location       string `json:"location"`
+	ResourceID     string `json:"resourceId"`
+}
+
+// azureTarget is a subnet associated with the managed route table
+type azureTarget struct {
+	vnet   string
+	subnet network.Subnet
 }
 
 // NewAzureClient builds new Azure client
-func NewAzureClient() (*AzureClient, error) {
+// Subscription, resource group and location of the local VM are discovered from the Instance Metadata Service,
+// settings override the first two
+// Credentials are read from the environment, falling back to the managed identity of the VM,
+// or the user-assigned one with IdentityClientID
+func NewAzureClient(opts Options, settings AzureSettings) (*AzureClient, error) {
+	md, err := getAzureInstanceMetadata(context.TODO())
+	if err != nil {
+		return nil, err
+	}
 
-	sub := os.Getenv("AZURE_SUBSCRIPTION_ID")
+	sub := settings.SubscriptionID
 	if sub == "" {
-		sub = defaultSub
+		sub = md.SubscriptionID
 	}
 
-	rg := os.Getenv("AZURE_RESOURCE_GROUP")
+	rg := settings.ResourceGroup
 	if rg == "" {
-		rg = defaultRG
+		rg = md.ResourceGroup
+	}
+
+	routeServerRG := settings.RouteServerResourceGroup
+	if routeServerRG == "" {
+		routeServerRG = rg
 	}
 
-	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	var authorizer autorest.Authorizer
+	if settings.IdentityClientID != "" {
+		msiConfig := auth.NewMSIConfig()
+		msiConfig.ClientID = settings.IdentityClientID
+		authorizer, err = msiConfig.Authorizer()
+	} else {
+		authorizer, err = auth.NewAuthorizerFromEnvironment()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Failed to init authorizer from environment %s", err)
+		return nil, fmt.Errorf("Failed to init Azure authorizer: %s", err)
+	}
+
+	if opts.State == nil {
+		opts.State = state.NewMemoryStore()
 	}
 
 	return &AzureClient{
@@ -65,118 +150,574 @@ func NewAzureClient() (*AzureClient, error) {
 		SubscriptionID: sub,
 		Authorizer:     authorizer,
 		GenerateName: func(objectType string) string {
-			return defaultPrefix + objectType
+			return opts.owner() + "-" + objectType
 		},
+		vmID:          md.ResourceID,
+		location:      to.StringPtr(md.Location),
+		routeServer:   settings.RouteServer,
+		routeServerRG: routeServerRG,
+		peerASN:       settings.PeerASN,
+		opts:          opts,
 	}, nil
 }
 
-// Cleanup removes any leftover resources
-func (c *AzureClient) Cleanup() error {
-	logrus.Infof("Azure cleanup currently not implemented")
-	return nil
+// getAzureInstanceMetadata reads the compute metadata of the local VM
+func getAzureInstanceMetadata(ctx context.Context) (*azureInstanceMetadata, error) {
+	req, err := http.NewRequest(http.MethodGet, azureMetadataEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := azureMetadataClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query Azure instance metadata: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to query Azure instance metadata: %s", resp.Status)
+	}
+
+	md := &azureInstanceMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(md); err != nil {
+		return nil, fmt.Errorf("Failed to decode Azure instance metadata: %s", err)
+	}
+	if md.SubscriptionID == "" || md.ResourceGroup == "" || md.Location == "" {
+		return nil, fmt.Errorf("Azure instance metadata is missing subscription, resource group or location")
+	}
+	return md, nil
 }
 
-// Reconcile implements reconciler interface
-func (c *AzureClient) Reconcile(rt *route.Table, eventSync bool, syncInterval int) {
+// Cleanup disassociates and deletes the managed route table
+// Subnets get back the route table they used before, if it was recorded and still exists
+// In Route Server mode the BGP connection of the local VM is deleted instead
+func (c *AzureClient) Cleanup(ctx context.Context) error {
+	if c.routeServerMode() {
+		deleted, err := c.deleteBgpConnection(ctx)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			logrus.Infof("BGP connection %s doesn't exist, nothing to clean up", c.bgpConnectionName())
+		}
+		return nil
+	}
 
-	err := c.lookupSubnet(rt.DefaultIP)
+	table, found, err := c.getRouteTable(ctx)
 	if err != nil {
-		logrus.Infof("Failed to lookupSubnet: %s", err)
+		return err
+	}
+	if !found {
+		logrus.Infof("Route table %s doesn't exist, nothing to clean up", c.GenerateName(azureRouteTableObject))
+		return nil
 	}
 
-	err = c.ensureRouteTable()
+	st, err := c.opts.State.Load(ctx)
 	if err != nil {
-		logrus.Infof("Failed to fetch route table: %s", err)
+		return err
 	}
 
-	if eventSync {
-		for range rt.SyncCh {
-			err = c.syncRouteTable(rt)
-			if err != nil {
-				logrus.Infof("Failed to sync route table: %s", err)
-			}
+	var subnets []network.Subnet
+	if props := table.RouteTablePropertiesFormat; props != nil && props.Subnets != nil {
+		subnets = *props.Subnets
+	}
+
+	restored := 0
+	for _, ref := range subnets {
+		previous := st.Previous[strings.ToLower(to.String(ref.ID))]
+		ok, err := c.disassociateSubnet(ctx, to.String(ref.ID), previous)
+		if err != nil {
+			return err
 		}
-	} else {
-		for {
-			select {
-			case _ = <-rt.SyncCh:
-				logrus.Debug("Received sync signal in periodic mode, ignoring")
-			default:
-				err = c.syncRouteTable(rt)
-				if err != nil {
-					logrus.Infof("Failed to sync route table: %s", err)
-				}
-				time.Sleep(time.Duration(syncInterval) * time.Second)
-			}
+		if ok {
+			restored++
 		}
+		st.SetPrevious(strings.ToLower(to.String(ref.ID)), "")
 	}
-}
 
-func (c *AzureClient) ensureRouteTable() error {
-	object := "route-table"
 	rtClient := network.NewRouteTablesClient(c.SubscriptionID)
 	rtClient.Authorizer = c.Authorizer
 
-	_, err := rtClient.Get(context.Background(), c.ResourceGroup, c.GenerateName(object), "")
+	logrus.Debugf("Deleting route table %s", c.GenerateName(azureRouteTableObject))
+	future, err := rtClient.Delete(ctx, c.ResourceGroup, c.GenerateName(azureRouteTableObject))
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, rtClient.Client)
+	}
 	if err != nil {
-		c.syncRouteTable(&route.Table{Routes: make(map[string]net.IP)})
+		metrics.APIError("azure", "RouteTables.Delete")
+		return fmt.Errorf("Failed to delete route table %s: %s", c.GenerateName(azureRouteTableObject), err)
+	}
+
+	if err := c.opts.State.Save(ctx, st); err != nil {
+		return err
 	}
 
+	logrus.Infof("Cleanup deleted route table %s with %d routes, disassociated %d subnets and restored %d previous route tables",
+		c.GenerateName(azureRouteTableObject), len(azureRoutes(table)), len(subnets), restored)
 	return nil
 }
 
-func (c *AzureClient) syncRouteTable(rt *route.Table) error {
-	object := "route-table"
+// disassociateSubnet removes the managed route table from a subnet and restores its previous route table
+// It returns true if the previous route table has been restored
+func (c *AzureClient) disassociateSubnet(ctx context.Context, subnetID, previous string) (bool, error) {
+	vnet, name, err := parseSubnetID(subnetID)
+	if err != nil {
+		return false, err
+	}
+
+	subnetClient := network.NewSubnetsClient(c.SubscriptionID)
+	subnetClient.Authorizer = c.Authorizer
+
+	rg := resourceGroupOf(subnetID)
+	subnet, err := subnetClient.Get(ctx, rg, vnet, name, "")
+	if err != nil {
+		metrics.APIError("azure", "Subnets.Get")
+		return false, fmt.Errorf("Failed to get subnet %s: %s", name, err)
+	}
+	if subnet.SubnetPropertiesFormat == nil {
+		return false, nil
+	}
+
+	restore := previous != "" && c.routeTableExists(ctx, previous)
+	if restore {
+		logrus.Infof("Restoring route table %s of subnet %s", path.Base(previous), name)
+		subnet.RouteTable = &network.RouteTable{ID: to.StringPtr(previous)}
+	} else {
+		logrus.Infof("Disassociating route table from subnet %s", name)
+		subnet.RouteTable = nil
+	}
+
+	future, err := subnetClient.CreateOrUpdate(ctx, rg, vnet, name, subnet)
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, subnetClient.Client)
+	}
+	if err != nil {
+		metrics.APIError("azure", "Subnets.CreateOrUpdate")
+		return false, fmt.Errorf("Failed to disassociate route table from subnet %s: %s", name, err)
+	}
+	return restore, nil
+}
+
+// routeTableExists checks a route table by its resource ID
+func (c *AzureClient) routeTableExists(ctx context.Context, id string) bool {
+	parts := strings.Split(id, "/")
+	if len(parts) < 9 {
+		return false
+	}
+
 	rtClient := network.NewRouteTablesClient(c.SubscriptionID)
 	rtClient.Authorizer = c.Authorizer
 
-	routeTable := &network.RouteTablePropertiesFormat{
+	// Resource IDs are /subscriptions/<sub>/resourceGroups/<rg>/providers/Microsoft.Network/routeTables/<name>
+	if _, err := rtClient.Get(ctx, parts[4], parts[8], ""); err != nil {
+		logrus.Infof("Previous route table %s can not be restored: %s", parts[8], err)
+		return false
+	}
+	return true
+}
 
-		Routes: c.buildRoutes(rt),
+// parseSubnetID returns VNET and subnet names from a subnet resource ID
+func parseSubnetID(id string) (vnet, subnet string, err error) {
+	parts := strings.Split(strings.TrimPrefix(id, "/"), "/")
+	for i := 0; i+3 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "virtualNetworks") && strings.EqualFold(parts[i+2], "subnets") {
+			return parts[i+1], parts[i+3], nil
+		}
 	}
+	return "", "", fmt.Errorf("Failed to parse subnet ID %q", id)
+}
 
-	logrus.Infoln("Syncing Route Table")
+// resourceGroupOf returns the resource group name from a resource ID
+func resourceGroupOf(id string) string {
+	parts := strings.Split(strings.TrimPrefix(id, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "resourceGroups") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// azureRoutes returns all routes of a route table
+func azureRoutes(table network.RouteTable) []network.Route {
+	if props := table.RouteTablePropertiesFormat; props != nil && props.Routes != nil {
+		return *props.Routes
+	}
+	return nil
+}
+
+// Reconcile implements reconciler interface
+func (c *AzureClient) Reconcile(ctx context.Context, rt *route.Table, eventSync bool, syncInterval int) error {
+
+	if err := c.lookupSubnet(ctx, rt.DefaultIP); err != nil {
+		return fmt.Errorf("Failed to lookupSubnet: %s", err)
+	}
+
+	if c.routeServerMode() {
+		return runLoop(ctx, "azure", rt, eventSync, syncInterval, c.syncRouteServer)
+	}
+
+	if !c.opts.DryRun {
+		if err := c.ensureRouteTable(ctx); err != nil {
+			logrus.Infof("Failed to ensure route table: %s", err)
+		}
+	}
+
+	return runLoop(ctx, "azure", rt, eventSync, syncInterval, c.syncRouteTable)
+}
+
+// Plan implements reconciler interface
+// A single route table is shared by all target subnets
+func (c *AzureClient) Plan(ctx context.Context, rt *route.Table) (Plans, error) {
+	if err := c.lookupSubnet(ctx, rt.DefaultIP); err != nil {
+		return nil, fmt.Errorf("Failed to lookupSubnet: %s", err)
+	}
+	if c.routeServerMode() {
+		conn, _, err := c.getBgpConnection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		plan, _, err := c.planRouteServer(ctx, rt, bgpConnected(conn))
+		if err != nil {
+			return nil, err
+		}
+		return Plans{plan}, nil
+	}
+	plan, _, _, err := c.plan(ctx, rt)
+	if err != nil {
+		return nil, err
+	}
+	return Plans{plan}, nil
+}
+
+// Withdraw removes all owned routes from the managed route table
+// In Route Server mode the BGP connection is deleted, so that Route Server stops using routes of the local VM
+func (c *AzureClient) Withdraw(ctx context.Context) error {
+	if c.azureVnetName == nil {
+		return fmt.Errorf("Local subnet has not been discovered yet")
+	}
+	if c.routeServerMode() {
+		logrus.Info("Withdrawing BGP connection")
+		_, err := c.deleteBgpConnection(ctx)
+		return err
+	}
+	logrus.Info("Withdrawing all owned routes")
+	return c.syncRouteTable(ctx, route.Empty())
+}
+
+// getRouteTable reads the managed route table, found is false if it doesn't exist yet
+func (c *AzureClient) getRouteTable(ctx context.Context) (table network.RouteTable, found bool, err error) {
+	rtClient := network.NewRouteTablesClient(c.SubscriptionID)
+	rtClient.Authorizer = c.Authorizer
+
+	table, err = rtClient.Get(ctx, c.ResourceGroup, c.GenerateName(azureRouteTableObject), "")
+	if err != nil {
+		if table.IsHTTPStatus(http.StatusNotFound) {
+			return table, false, nil
+		}
+		metrics.APIError("azure", "RouteTables.Get")
+		return table, false, fmt.Errorf("Error reading route table %s: %+v", c.GenerateName(azureRouteTableObject), err)
+	}
+	return table, true, nil
+}
+
+// plan compares owned routes of the route table with the proposed ones
+// It also returns the names of current routes by prefix, Azure does not allow two routes with the same prefix
+func (c *AzureClient) plan(ctx context.Context, rt *route.Table) (*Plan, diff.Result, map[string]string, error) {
+	table, found, err := c.getRouteTable(ctx)
+	if err != nil {
+		return nil, diff.Result{}, nil, err
+	}
+	if !found {
+		logrus.Info("Route table doesn't exist, it would be created")
+	}
+
+	var current []diff.Route
+	names := make(map[string]string)
+	owned := make(map[string]bool)
+	if props := table.RouteTablePropertiesFormat; props != nil && props.Routes != nil {
+		for _, r := range *props.Routes {
+			if r.RoutePropertiesFormat == nil {
+				continue
+			}
+			prefix := to.String(r.AddressPrefix)
+			current = append(current, diff.Route{Prefix: prefix, Nexthop: to.String(r.NextHopIPAddress)})
+			names[prefix] = to.String(r.Name)
+			owned[prefix] = c.isOwnedRoute(r)
+		}
+	}
+
+	var proposed []diff.Route
+	for _, r := range *c.buildRoutes(rt) {
+		prefix := to.String(r.AddressPrefix)
+		// Routes of others are never changed
+		if name, ok := names[prefix]; ok && !owned[prefix] {
+			logrus.Warnf("Skipping route %s, the prefix is already used by route %s", prefix, name)
+			continue
+		}
+		proposed = append(proposed, diff.Route{Prefix: prefix, Nexthop: to.String(r.NextHopIPAddress)})
+	}
+
+	metrics.SetCloudRoutes("azure", c.GenerateName(azureRouteTableObject), len(current))
+
+	changes := diff.Routes(current, proposed, func(r diff.Route) bool { return owned[r.Prefix] })
+	return newPlan("azure", c.GenerateName(azureRouteTableObject), changes), changes, names, nil
+}
+
+// isOwnedRoute checks the name prefix of a route
+// Routes named after their prefix only were created by earlier versions and are owned as well
+func (c *AzureClient) isOwnedRoute(r network.Route) bool {
+	name := to.String(r.Name)
+	return strings.HasPrefix(name, c.opts.owner()+"-") || name == azureRouteName(to.String(r.AddressPrefix))
+}
+
+// ensureRouteTable creates an empty route table if it doesn't exist
+// Existing route tables are never overwritten, so that their foreign routes and properties are kept
+func (c *AzureClient) ensureRouteTable(ctx context.Context) error {
+	table, found, err := c.getRouteTable(ctx)
+	if err != nil {
+		return err
+	}
+	if found {
+		c.azureRouteTable = table
+		return nil
+	}
+
+	rtClient := network.NewRouteTablesClient(c.SubscriptionID)
+	rtClient.Authorizer = c.Authorizer
+
+	logrus.Infof("Creating route table %s", c.GenerateName(azureRouteTableObject))
 	future, err := rtClient.CreateOrUpdate(
-		context.Background(),
+		ctx,
 		c.ResourceGroup,
-		c.GenerateName(object),
+		c.GenerateName(azureRouteTableObject),
 		network.RouteTable{
-			ID:                         c.azureRouteTable.ID,
 			Location:                   c.location,
-			RouteTablePropertiesFormat: routeTable,
+			RouteTablePropertiesFormat: &network.RouteTablePropertiesFormat{},
 		})
-
-	err = future.WaitForCompletionRef(context.Background(), rtClient.Client)
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, rtClient.Client)
+	}
 	if err != nil {
+		metrics.APIError("azure", "RouteTables.CreateOrUpdate")
 		return fmt.Errorf("Failed to create a route table %s", err)
 	}
 
-	read, err := rtClient.Get(
-		context.Background(),
-		c.ResourceGroup,
-		c.GenerateName(object),
-		"",
-	)
+	table, _, err = c.getRouteTable(ctx)
+	if err != nil {
+		return err
+	}
+	c.azureRouteTable = table
+	return nil
+}
+
+func (c *AzureClient) syncRouteTable(ctx context.Context, rt *route.Table) error {
+	plan, changes, names, err := c.plan(ctx, rt)
 	if err != nil {
-		return fmt.Errorf("Error reading route table %s: %+v", c.GenerateName(object), err)
+		return err
+	}
+	metrics.SetDrift("azure", plan.Table, plan.Changes())
+
+	if c.opts.DryRun {
+		c.opts.printPlan(plan)
+		return nil
+	}
+
+	if err := c.ensureRouteTable(ctx); err != nil {
+		return err
 	}
 
-	c.azureRouteTable = read
+	routesClient := network.NewRoutesClient(c.SubscriptionID)
+	routesClient.Authorizer = c.Authorizer
+
+	var opErrors []error
 
-	return c.associateSubnetTable()
+	recordResult := func(err error, operation string, succeeded func(string, int)) {
+		if err != nil {
+			metrics.APIError("azure", operation)
+			metrics.RoutesFailed("azure", 1)
+			opErrors = append(opErrors, fmt.Errorf("Failed to %s: %s", operation, err))
+			return
+		}
+		succeeded("azure", 1)
+	}
+
+	createOrUpdate := func(name, prefix, nextHop string) error {
+		future, err := routesClient.CreateOrUpdate(ctx, c.ResourceGroup, c.GenerateName(azureRouteTableObject), name, network.Route{
+			RoutePropertiesFormat: &network.RoutePropertiesFormat{
+				AddressPrefix:    to.StringPtr(prefix),
+				NextHopIPAddress: to.StringPtr(nextHop),
+				NextHopType:      network.RouteNextHopTypeVirtualAppliance,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return future.WaitForCompletionRef(ctx, routesClient.Client)
+	}
+
+	// Azure serializes writes to a route table and rejects concurrent ones, so routes are changed one at a time
+	for _, r := range changes.Delete {
+		logrus.Infof("Deleting route %s", r.Prefix)
+		future, err := routesClient.Delete(ctx, c.ResourceGroup, c.GenerateName(azureRouteTableObject), names[r.Prefix])
+		if err == nil {
+			err = future.WaitForCompletionRef(ctx, routesClient.Client)
+		}
+		recordResult(err, "Routes.Delete", metrics.RoutesDeleted)
+	}
+
+	// Next hops are updated in place, keeping the name of the existing route
+	for _, r := range changes.Replace {
+		logrus.Infof("Replacing route %s via %s with %s", r.Prefix, r.From, r.To)
+		recordResult(createOrUpdate(names[r.Prefix], r.Prefix, r.To), "Routes.CreateOrUpdate", metrics.RoutesReplaced)
+	}
+
+	for _, r := range changes.Add {
+		logrus.Infof("Creating route %s", r.Prefix)
+		recordResult(createOrUpdate(c.routeName(r.Prefix), r.Prefix, r.Nexthop), "Routes.CreateOrUpdate", metrics.RoutesAdded)
+	}
+
+	for _, err := range opErrors {
+		logrus.Infof("Failed route operation: %s", err)
+	}
+
+	var failed []string
+	if len(opErrors) > 0 {
+		failed = append(failed, fmt.Sprintf("%d out of %d route operations failed", len(opErrors), changes.Len()))
+	}
+
+	targets, err := c.lookupTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		err := c.associateSubnetTable(ctx, target)
+		metrics.SetTargetSynced("azure", to.String(target.subnet.Name), err)
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to sync route table: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// lookupTargets returns the subnets that get the managed route table, only the local one if no targets are configured
+// Subnets are looked up on every sync, so that new ones are associated as well
+func (c *AzureClient) lookupTargets(ctx context.Context) ([]azureTarget, error) {
+	targets := c.opts.Targets
+	if targets.Empty() {
+		return []azureTarget{{vnet: *c.azureVnetName, subnet: c.azureSubnet}}, nil
+	}
+
+	vnets, err := c.listVnets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]bool)
+	for _, id := range targets.IDs {
+		ids[strings.ToLower(id)] = true
+	}
+
+	var result []azureTarget
+	for _, vnet := range vnets {
+		local := to.String(vnet.Name) == *c.azureVnetName
+		matchAll := (targets.All && local) || (len(targets.Tags) > 0 && azureTagsMatch(vnet.Tags, targets.Tags))
+		if !local && !matchAll && len(ids) == 0 {
+			continue
+		}
+
+		// A route table can only be associated with subnets in its own region
+		if !strings.EqualFold(to.String(vnet.Location), to.String(c.location)) {
+			if matchAll {
+				logrus.Warnf("Skipping VNET %s in %s, the route table is in %s", to.String(vnet.Name), to.String(vnet.Location), to.String(c.location))
+			}
+			continue
+		}
+
+		subnets, err := c.listSubnets(ctx, *vnet.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, subnet := range subnets {
+			name := to.String(subnet.Name)
+			selected := ids[strings.ToLower(to.String(subnet.ID))] || (local && ids[strings.ToLower(name)])
+			if !selected && matchAll && !azureServiceSubnets[name] {
+				selected = true
+			}
+			if selected {
+				result = append(result, azureTarget{vnet: *vnet.Name, subnet: subnet})
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("No subnets match the configured targets")
+	}
+	return result, nil
+}
+
+// listVnets returns all pages of VNETs in the resource group of the local VNET
+func (c *AzureClient) listVnets(ctx context.Context) ([]network.VirtualNetwork, error) {
+	vnetClient := network.NewVirtualNetworksClient(c.SubscriptionID)
+	vnetClient.Authorizer = c.Authorizer
+
+	var result []network.VirtualNetwork
+	iter, err := vnetClient.ListComplete(ctx, c.vnetResourceGroup)
+	for err == nil && iter.NotDone() {
+		result = append(result, iter.Value())
+		err = iter.NextWithContext(ctx)
+	}
+	if err != nil {
+		metrics.APIError("azure", "VirtualNetworks.List")
+		return nil, fmt.Errorf("Failed to list VNETs: %s", err)
+	}
+	return result, nil
+}
+
+// listSubnets returns all pages of subnets of a VNET
+func (c *AzureClient) listSubnets(ctx context.Context, vnet string) ([]network.Subnet, error) {
+	subnetClient := network.NewSubnetsClient(c.SubscriptionID)
+	subnetClient.Authorizer = c.Authorizer
+
+	var result []network.Subnet
+	iter, err := subnetClient.ListComplete(ctx, c.vnetResourceGroup, vnet)
+	for err == nil && iter.NotDone() {
+		result = append(result, iter.Value())
+		err = iter.NextWithContext(ctx)
+	}
+	if err != nil {
+		metrics.APIError("azure", "Subnets.List")
+		return nil, fmt.Errorf("Failed to list Subnets in vnet %s: %s", vnet, err)
+	}
+	return result, nil
+}
+
+// azureTagsMatch returns true if all wanted tags are set to the wanted values
+func azureTagsMatch(tags map[string]*string, wanted map[string]string) bool {
+	for key, value := range wanted {
+		if tag, ok := tags[key]; !ok || to.String(tag) != value {
+			return false
+		}
+	}
+	return true
 }
 
 func (c *AzureClient) buildRoutes(rt *route.Table) *[]network.Route {
 	results := []network.Route{}
 
-OUTER:
-	for prefix, nextHop := range rt.Routes {
+	for prefix, nextHops := range rt.Snapshot() {
+		// No ECMP support, picking the lowest next hop as primary
+		nextHop := nextHops.Primary()
 
-		if mySubnet := route.ParseCIDR(*c.azureSubnet.AddressPrefix); mySubnet != nil {
-			// Setting nexthop self for all non-local routes
-			if !mySubnet.Contains(nextHop) {
-				nextHop = rt.DefaultIP
-			}
+		// Setting nexthop self for all non-local routes
+		if !c.isLocal(nextHop) {
+			nextHop = rt.SelfIP(nextHop)
 		}
 
 		ip, _, err := net.ParseCIDR(prefix)
@@ -184,14 +725,17 @@ OUTER:
 			logrus.Infof("Failed to parse prefix: %s", prefix)
 			continue
 		}
-		for _, subnet := range azureReservedRanges {
-			if subnet != nil && subnet.Contains(ip) {
-				continue OUTER
-			}
+		if c.opts.isReserved(ip, azureReservedRanges, azureReservedRangesV6) {
+			continue
+		}
+
+		if nextHop == nil || (ip.To4() == nil) != (nextHop.To4() == nil) {
+			logrus.Infof("No nexthop of the same address family found for prefix: %s", prefix)
+			continue
 		}
 
 		route := network.Route{
-			Name: to.StringPtr(strings.Replace(prefix, "/", "_", 1)),
+			Name: to.StringPtr(c.routeName(prefix)),
 			RoutePropertiesFormat: &network.RoutePropertiesFormat{
 				AddressPrefix:    to.StringPtr(prefix),
 				NextHopIPAddress: to.StringPtr(nextHop.String()),
@@ -204,75 +748,184 @@ OUTER:
 	return &results
 }
 
-func (c *AzureClient) associateSubnetTable() error {
+// routeName marks owned routes with the owner prefix
+func (c *AzureClient) routeName(prefix string) string {
+	return c.opts.owner() + "-" + azureRouteName(prefix)
+}
+
+// Azure resource names can not contain colons from IPv6 prefixes
+func azureRouteName(prefix string) string {
+	return strings.ReplaceAll(strings.Replace(prefix, "/", "_", 1), ":", "-")
+}
+
+// subnetPrefixes returns both IPv4 and IPv6 prefixes of a dual-stack subnet
+func subnetPrefixes(subnet network.Subnet) (result []*net.IPNet) {
+	props := subnet.SubnetPropertiesFormat
+	if props == nil {
+		return nil
+	}
+
+	var prefixes []string
+	if props.AddressPrefix != nil {
+		prefixes = append(prefixes, *props.AddressPrefix)
+	}
+	if props.AddressPrefixes != nil {
+		prefixes = append(prefixes, *props.AddressPrefixes...)
+	}
+
+	for _, prefix := range prefixes {
+		if ipNet := route.ParseCIDR(prefix); ipNet != nil {
+			result = append(result, ipNet)
+		}
+	}
+	return result
+}
+
+func (c *AzureClient) isLocal(ip net.IP) bool {
+	for _, subnet := range subnetPrefixes(c.azureSubnet) {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordPrevious saves the route table a subnet used before, so that cleanup can restore it
+func (c *AzureClient) recordPrevious(ctx context.Context, subnetID, table string) error {
+	st, err := c.opts.State.Load(ctx)
+	if err != nil {
+		return err
+	}
+	st.SetPrevious(strings.ToLower(subnetID), table)
+	return c.opts.State.Save(ctx, st)
+}
+
+// associateSubnetTable associates the managed route table with a target subnet
+// Configured targets already using another route table are left alone, as it would lose their routes
+func (c *AzureClient) associateSubnetTable(ctx context.Context, target azureTarget) error {
 	subnetClient := network.NewSubnetsClient(c.SubscriptionID)
 	subnetClient.Authorizer = c.Authorizer
 
-	if props := c.azureSubnet.SubnetPropertiesFormat; props != nil {
+	subnet := target.subnet
+	if props := subnet.SubnetPropertiesFormat; props != nil {
 		if rt := props.RouteTable; rt != nil {
-			if *rt.ID == *c.azureRouteTable.ID {
-				logrus.Debug("Route table is already associated, we're done.")
+			if strings.EqualFold(to.String(rt.ID), to.String(c.azureRouteTable.ID)) {
+				logrus.Debugf("Route table is already associated with %s, we're done.", *subnet.Name)
 				return nil
 			}
+			if !c.opts.Targets.Empty() {
+				return fmt.Errorf("Subnet %q is already associated with route table %s", *subnet.Name, path.Base(to.String(rt.ID)))
+			}
+			if err := c.recordPrevious(ctx, to.String(subnet.ID), to.String(rt.ID)); err != nil {
+				return err
+			}
 		}
 		props.RouteTable = &network.RouteTable{
 			ID: c.azureRouteTable.ID,
 		}
 	}
 
-	logrus.Infoln("Associating a route table with a subnet")
+	logrus.Infof("Associating a route table with subnet %s", *subnet.Name)
 	future, err := subnetClient.CreateOrUpdate(
-		context.Background(),
-		c.ResourceGroup,
-		*c.azureVnetName,
-		*c.azureSubnet.Name,
-		c.azureSubnet,
+		ctx,
+		c.vnetResourceGroup,
+		target.vnet,
+		*subnet.Name,
+		subnet,
 	)
 	if err != nil {
-		return fmt.Errorf("Error updating Route Table Association for Subnet %q : %+v", *c.azureSubnet.Name, err)
+		metrics.APIError("azure", "Subnets.CreateOrUpdate")
+		return fmt.Errorf("Error updating Route Table Association for Subnet %q : %+v", *subnet.Name, err)
 	}
 
-	if err = future.WaitForCompletionRef(context.Background(), subnetClient.Client); err != nil {
-		return fmt.Errorf("Error waiting for completion of Route Table Association for Subnet %q : %+v", *c.azureSubnet.Name, err)
+	if err = future.WaitForCompletionRef(ctx, subnetClient.Client); err != nil {
+		metrics.APIError("azure", "Subnets.CreateOrUpdate")
+		return fmt.Errorf("Error waiting for completion of Route Table Association for Subnet %q : %+v", *subnet.Name, err)
 	}
 
 	return nil
 }
 
-func (c *AzureClient) lookupSubnet(myIP net.IP) error {
-
-	vnetClient := network.NewVirtualNetworksClient(c.SubscriptionID)
-	vnetClient.Authorizer = c.Authorizer
+// lookupSubnet finds the local subnet through the NIC of the local VM with myIP
+func (c *AzureClient) lookupSubnet(ctx context.Context, myIP net.IP) error {
+	subnetID, err := c.lookupInterfaceSubnet(ctx, myIP)
+	if err != nil {
+		return err
+	}
 
-	vnets, err := vnetClient.List(context.TODO(), c.ResourceGroup)
+	vnet, name, err := parseSubnetID(subnetID)
 	if err != nil {
-		return fmt.Errorf("Failed to list VNETs: %s", err)
+		return err
 	}
+	rg := resourceGroupOf(subnetID)
 
 	subnetClient := network.NewSubnetsClient(c.SubscriptionID)
 	subnetClient.Authorizer = c.Authorizer
-	for _, vnet := range vnets.Values() {
-		logrus.Infof("Found VNET: %s", *vnet.Name)
-		subnets, err := subnetClient.List(context.TODO(), c.ResourceGroup, *vnet.Name)
+
+	subnet, err := subnetClient.Get(ctx, rg, vnet, name, "")
+	if err != nil {
+		metrics.APIError("azure", "Subnets.Get")
+		return fmt.Errorf("Failed to get subnet %s: %s", name, err)
+	}
+
+	logrus.Infof("Found subnet %s in VNET %s", name, vnet)
+	c.azureVnetName = to.StringPtr(vnet)
+	c.vnetResourceGroup = rg
+	c.azureSubnet = subnet
+	return nil
+}
+
+// lookupInterfaceSubnet returns the subnet ID of the IP configuration with myIP of the local VM's NICs
+// NICs are read by the IDs in the network profile of the VM
+func (c *AzureClient) lookupInterfaceSubnet(ctx context.Context, myIP net.IP) (string, error) {
+	vmClient := compute.NewVirtualMachinesClient(c.SubscriptionID)
+	vmClient.Authorizer = c.Authorizer
+
+	vm, err := vmClient.Get(ctx, resourceGroupOf(c.vmID), path.Base(c.vmID), "")
+	if err != nil {
+		metrics.APIError("azure", "VirtualMachines.Get")
+		return "", fmt.Errorf("Failed to get local VM %s: %s", path.Base(c.vmID), err)
+	}
+
+	var refs []compute.NetworkInterfaceReference
+	if props := vm.VirtualMachineProperties; props != nil && props.NetworkProfile != nil && props.NetworkProfile.NetworkInterfaces != nil {
+		refs = *props.NetworkProfile.NetworkInterfaces
+	}
+
+	nicClient := network.NewInterfacesClient(c.SubscriptionID)
+	nicClient.Authorizer = c.Authorizer
+
+	for _, ref := range refs {
+		id := to.String(ref.ID)
+		nic, err := nicClient.Get(ctx, resourceGroupOf(id), path.Base(id), "")
 		if err != nil {
-			return fmt.Errorf("Failed to list Subnets in vnet %s: %s", *vnet.Name, err)
+			metrics.APIError("azure", "NetworkInterfaces.Get")
+			return "", fmt.Errorf("Failed to get NIC %s: %s", path.Base(id), err)
 		}
-
-		for _, subnet := range subnets.Values() {
-			logrus.Infof("Found Subnet: %s", *subnet.Name)
-			_, ipv4Net, err := net.ParseCIDR(*subnet.AddressPrefix)
-			if err != nil {
-				return fmt.Errorf("Failed to parse prefix %s: %s", *subnet.AddressPrefix, err)
-			}
-			if ipv4Net.Contains(myIP) {
-				c.azureVnetName = vnet.Name
-				c.location = vnet.Location
-				c.azureSubnet = subnet
-				return nil
-			}
+		if subnetID := interfaceSubnet(nic, c.vmID, myIP); subnetID != "" {
+			return subnetID, nil
 		}
-
 	}
+	return "", fmt.Errorf("Could not find local NIC with IP %s", myIP)
+}
 
-	return fmt.Errorf("Could not find local subnet")
+// interfaceSubnet returns the subnet ID of a NIC of the VM with the given IP, empty if it doesn't match
+func interfaceSubnet(nic network.Interface, vmID string, myIP net.IP) string {
+	props := nic.InterfacePropertiesFormat
+	if props == nil || props.VirtualMachine == nil || !strings.EqualFold(to.String(props.VirtualMachine.ID), vmID) {
+		return ""
+	}
+	if props.IPConfigurations == nil {
+		return ""
+	}
+	for _, ipConfig := range *props.IPConfigurations {
+		ipProps := ipConfig.InterfaceIPConfigurationPropertiesFormat
+		if ipProps == nil || ipProps.Subnet == nil {
+			continue
+		}
+		if ip := net.ParseIP(to.String(ipProps.PrivateIPAddress)); ip != nil && ip.Equal(myIP) {
+			return to.String(ipProps.Subnet.ID)
+		}
+	}
+	return ""
 }
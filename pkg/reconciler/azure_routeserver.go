@@ -0,0 +1,279 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2020-06-01/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/networkop/cloudroutesync/pkg/diff"
+	"github.com/networkop/cloudroutesync/pkg/metrics"
+	"github.com/networkop/cloudroutesync/pkg/route"
+	"github.com/sirupsen/logrus"
+)
+
+// Learned and advertised routes are not part of the network API version used for everything else
+const azurePeerRoutesAPIVersion = "2020-11-01"
+
+// In Route Server mode routes are announced by the local routing daemon over BGP
+// cloudroutesync only manages the BGP connection of the local VM and compares learned routes with the local ones
+
+// azurePeerRoute is a route learned from or advertised to a Route Server peer
+type azurePeerRoute struct {
+	LocalAddress string `json:"localAddress"`
+	Network      string `json:"network"`
+	NextHop      string `json:"nextHop"`
+	SourcePeer   string `json:"sourcePeer"`
+	Origin       string `json:"origin"`
+	AsPath       string `json:"asPath"`
+}
+
+// routeServerMode is true if the local VM is peered with a Route Server instead of programming the route table
+func (c *AzureClient) routeServerMode() bool {
+	return c.routeServer != ""
+}
+
+// bgpConnectionName is unique per VM, so that every NVA has its own connection
+func (c *AzureClient) bgpConnectionName() string {
+	return c.GenerateName(path.Base(c.vmID))
+}
+
+func (c *AzureClient) routeServerTable() string {
+	return c.routeServer + "/" + c.bgpConnectionName()
+}
+
+// getBgpConnection reads the BGP connection of the local VM, found is false if it doesn't exist
+func (c *AzureClient) getBgpConnection(ctx context.Context) (conn network.BgpConnection, found bool, err error) {
+	connClient := network.NewVirtualHubBgpConnectionClient(c.SubscriptionID)
+	connClient.Authorizer = c.Authorizer
+
+	conn, err = connClient.Get(ctx, c.routeServerRG, c.routeServer, c.bgpConnectionName())
+	if err != nil {
+		if conn.IsHTTPStatus(http.StatusNotFound) {
+			return conn, false, nil
+		}
+		metrics.APIError("azure", "VirtualHubBgpConnection.Get")
+		return conn, false, fmt.Errorf("Failed to get BGP connection %s: %s", c.bgpConnectionName(), err)
+	}
+	return conn, true, nil
+}
+
+// ensureBgpConnection peers the local VM with the Route Server, updating peer IP and ASN if they changed
+func (c *AzureClient) ensureBgpConnection(ctx context.Context, peerIP net.IP) (network.BgpConnection, error) {
+	conn, found, err := c.getBgpConnection(ctx)
+	if err != nil {
+		return conn, err
+	}
+	if found && conn.BgpConnectionProperties != nil &&
+		to.String(conn.PeerIP) == peerIP.String() && to.Int64(conn.PeerAsn) == c.peerASN {
+		return conn, nil
+	}
+
+	connClient := network.NewVirtualHubBgpConnectionClient(c.SubscriptionID)
+	connClient.Authorizer = c.Authorizer
+
+	logrus.Infof("Peering %s (AS%d) with Route Server %s", peerIP, c.peerASN, c.routeServer)
+	future, err := connClient.CreateOrUpdate(ctx, c.routeServerRG, c.routeServer, c.bgpConnectionName(), network.BgpConnection{
+		Name: to.StringPtr(c.bgpConnectionName()),
+		BgpConnectionProperties: &network.BgpConnectionProperties{
+			PeerIP:  to.StringPtr(peerIP.String()),
+			PeerAsn: to.Int64Ptr(c.peerASN),
+		},
+	})
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, connClient.Client)
+	}
+	if err != nil {
+		metrics.APIError("azure", "VirtualHubBgpConnection.CreateOrUpdate")
+		return conn, fmt.Errorf("Failed to create BGP connection %s: %s", c.bgpConnectionName(), err)
+	}
+
+	conn, _, err = c.getBgpConnection(ctx)
+	return conn, err
+}
+
+// deleteBgpConnection removes the peering, it returns false if there was none
+func (c *AzureClient) deleteBgpConnection(ctx context.Context) (bool, error) {
+	_, found, err := c.getBgpConnection(ctx)
+	if err != nil || !found {
+		return false, err
+	}
+
+	connClient := network.NewVirtualHubBgpConnectionClient(c.SubscriptionID)
+	connClient.Authorizer = c.Authorizer
+
+	logrus.Infof("Deleting BGP connection %s of Route Server %s", c.bgpConnectionName(), c.routeServer)
+	future, err := connClient.Delete(ctx, c.routeServerRG, c.routeServer, c.bgpConnectionName())
+	if err == nil {
+		err = future.WaitForCompletionRef(ctx, connClient.Client)
+	}
+	if err != nil {
+		metrics.APIError("azure", "VirtualHubBgpConnection.Delete")
+		return false, fmt.Errorf("Failed to delete BGP connection %s: %s", c.bgpConnectionName(), err)
+	}
+	return true, nil
+}
+
+// peerRoutes runs the learnedRoutes or advertisedRoutes action of the BGP connection
+func (c *AzureClient) peerRoutes(ctx context.Context, action string) ([]azurePeerRoute, error) {
+	client := network.New(c.SubscriptionID)
+	client.Authorizer = c.Authorizer
+
+	pathParameters := map[string]interface{}{
+		"action":            autorest.Encode("path", action),
+		"connectionName":    autorest.Encode("path", c.bgpConnectionName()),
+		"resourceGroupName": autorest.Encode("path", c.routeServerRG),
+		"subscriptionId":    autorest.Encode("path", c.SubscriptionID),
+		"virtualHubName":    autorest.Encode("path", c.routeServer),
+	}
+	req, err := autorest.Prepare((&http.Request{}).WithContext(ctx),
+		autorest.AsPost(),
+		autorest.WithBaseURL(client.BaseURI),
+		autorest.WithPathParameters("/subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/Microsoft.Network/virtualHubs/{virtualHubName}/bgpConnections/{connectionName}/{action}", pathParameters),
+		autorest.WithQueryParameters(map[string]interface{}{"api-version": azurePeerRoutesAPIVersion}))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Send(req, azure.DoRetryWithRegistration(client.Client))
+	if err == nil {
+		var future azure.Future
+		if future, err = azure.NewFutureFromResponse(resp); err == nil {
+			if err = future.WaitForCompletionRef(ctx, client.Client); err == nil {
+				resp, err = future.GetResult(client)
+			}
+		}
+	}
+	if err != nil {
+		metrics.APIError("azure", "VirtualHubBgpConnection."+action)
+		return nil, fmt.Errorf("Failed to get %s of BGP connection %s: %s", action, c.bgpConnectionName(), err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %s", action, err)
+	}
+	return decodePeerRoutes(data)
+}
+
+// decodePeerRoutes merges routes of all Route Server instances
+// Results are keyed by instance, e.g. RouteServiceRole_IN_0, or listed under value
+func decodePeerRoutes(data []byte) ([]azurePeerRoute, error) {
+	var instances map[string][]azurePeerRoute
+	if err := json.Unmarshal(data, &instances); err != nil {
+		return nil, fmt.Errorf("Failed to decode peer routes: %s", err)
+	}
+
+	keys := make([]string, 0, len(instances))
+	for key := range instances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := make(map[diff.Route]bool)
+	var result []azurePeerRoute
+	for _, key := range keys {
+		for _, r := range instances[key] {
+			if id := (diff.Route{Prefix: r.Network, Nexthop: r.NextHop}); !seen[id] {
+				seen[id] = true
+				result = append(result, r)
+			}
+		}
+	}
+	return result, nil
+}
+
+// planRouteServer compares local routes with the ones Route Server learned from the local VM
+// Nothing is applied, missing routes have to be announced by the routing daemon
+func (c *AzureClient) planRouteServer(ctx context.Context, rt *route.Table, connected bool) (*Plan, diff.Result, error) {
+	var learned []azurePeerRoute
+	if connected {
+		var err error
+		if learned, err = c.peerRoutes(ctx, "learnedRoutes"); err != nil {
+			return nil, diff.Result{}, err
+		}
+	}
+
+	var current []diff.Route
+	for _, r := range learned {
+		if r.SourcePeer == rt.DefaultIP.String() {
+			current = append(current, diff.Route{Prefix: r.Network, Nexthop: r.NextHop})
+		}
+	}
+
+	var proposed []diff.Route
+	for _, r := range *c.buildRoutes(rt) {
+		proposed = append(proposed, diff.Route{Prefix: to.String(r.AddressPrefix), Nexthop: to.String(r.NextHopIPAddress)})
+	}
+
+	metrics.SetCloudRoutes("azure", c.routeServerTable(), len(current))
+
+	changes := diff.Routes(current, proposed, nil)
+	return newPlan("azure", c.routeServerTable(), changes), changes, nil
+}
+
+// syncRouteServer keeps the BGP connection of the local VM and reports routes exchanged over it
+func (c *AzureClient) syncRouteServer(ctx context.Context, rt *route.Table) error {
+	if c.opts.DryRun {
+		conn, found, err := c.getBgpConnection(ctx)
+		if err != nil {
+			return err
+		}
+		if !found {
+			logrus.Infof("BGP connection %s doesn't exist, it would be created", c.bgpConnectionName())
+		}
+		plan, _, err := c.planRouteServer(ctx, rt, bgpConnected(conn))
+		if err != nil {
+			return err
+		}
+		c.opts.printPlan(plan)
+		return nil
+	}
+
+	conn, err := c.ensureBgpConnection(ctx, rt.DefaultIP)
+	metrics.SetTargetSynced("azure", c.routeServerTable(), err)
+	if err != nil {
+		return err
+	}
+	if !bgpConnected(conn) {
+		err := fmt.Errorf("BGP connection %s is not established yet", c.bgpConnectionName())
+		metrics.SetTargetSynced("azure", c.routeServerTable(), err)
+		return err
+	}
+
+	plan, changes, err := c.planRouteServer(ctx, rt, true)
+	if err != nil {
+		return err
+	}
+	metrics.SetDrift("azure", plan.Table, plan.Changes())
+	for _, r := range changes.Add {
+		logrus.Infof("Route %s via %s is not learned by Route Server %s", r.Prefix, r.Nexthop, c.routeServer)
+	}
+	for _, r := range changes.Replace {
+		logrus.Infof("Route %s is learned by Route Server %s via %s instead of %s", r.Prefix, c.routeServer, r.From, r.To)
+	}
+	for _, r := range changes.Delete {
+		logrus.Debugf("Route %s via %s is learned by Route Server %s but not synced locally", r.Prefix, r.Nexthop, c.routeServer)
+	}
+
+	advertised, err := c.peerRoutes(ctx, "advertisedRoutes")
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Route Server %s advertises %d routes: %+v", c.routeServer, len(advertised), advertised)
+	metrics.SetCloudRoutes("azure", c.routeServerTable()+"/advertised", len(advertised))
+	return nil
+}
+
+func bgpConnected(conn network.BgpConnection) bool {
+	return conn.BgpConnectionProperties != nil && conn.ConnectionState == network.HubBgpConnectionStatusConnected
+}
@@ -0,0 +1,105 @@
+package reconciler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2020-06-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+)
+
+const testVMID = "/subscriptions/sub/resourceGroups/vm-rg/providers/Microsoft.Compute/virtualMachines/router"
+
+func TestAzureInstanceMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			http.Error(w, "missing Metadata header", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"subscriptionId":"sub","resourceGroupName":"vm-rg","location":"westeurope","resourceId":"` + testVMID + `","name":"router"}`))
+	}))
+	defer server.Close()
+
+	defer func(endpoint string) { azureMetadataEndpoint = endpoint }(azureMetadataEndpoint)
+	azureMetadataEndpoint = server.URL
+
+	md, err := getAzureInstanceMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := azureInstanceMetadata{SubscriptionID: "sub", ResourceGroup: "vm-rg", Location: "westeurope", ResourceID: testVMID}
+	if *md != want {
+		t.Errorf("got %+v, want %+v", *md, want)
+	}
+	if rg := resourceGroupOf(md.ResourceID); rg != "vm-rg" {
+		t.Errorf("resourceGroupOf(%q) = %q", md.ResourceID, rg)
+	}
+}
+
+func TestAzureInterfaceSubnet(t *testing.T) {
+	subnetID := "/subscriptions/sub/resourceGroups/net-rg/providers/Microsoft.Network/virtualNetworks/vnet/subnets/routers"
+	nic := func(vmID, ip string) network.Interface {
+		return network.Interface{InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
+			VirtualMachine: &network.SubResource{ID: to.StringPtr(vmID)},
+			IPConfigurations: &[]network.InterfaceIPConfiguration{{
+				InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+					PrivateIPAddress: to.StringPtr(ip),
+					Subnet:           &network.Subnet{ID: to.StringPtr(subnetID)},
+				},
+			}},
+		}}
+	}
+	myIP := net.ParseIP("10.0.1.4")
+
+	tests := []struct {
+		name string
+		nic  network.Interface
+		want string
+	}{
+		{name: "local NIC", nic: nic(testVMID, "10.0.1.4"), want: subnetID},
+		{name: "VM ID in another case", nic: nic("/subscriptions/sub/resourcegroups/VM-RG/providers/Microsoft.Compute/virtualMachines/router", "10.0.1.4"), want: subnetID},
+		{name: "other IP", nic: nic(testVMID, "10.0.1.5")},
+		{name: "other VM", nic: nic("/subscriptions/sub/resourceGroups/vm-rg/providers/Microsoft.Compute/virtualMachines/other", "10.0.1.4")},
+		{name: "detached NIC", nic: network.Interface{InterfacePropertiesFormat: &network.InterfacePropertiesFormat{}}},
+	}
+
+	for _, tt := range tests {
+		if got := interfaceSubnet(tt.nic, testVMID, myIP); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if rg := resourceGroupOf(subnetID); rg != "net-rg" {
+		t.Errorf("resourceGroupOf(%q) = %q", subnetID, rg)
+	}
+}
+
+func TestAzureDecodePeerRoutes(t *testing.T) {
+	data := []byte(`{
+		"RouteServiceRole_IN_1": [
+			{"localAddress": "10.0.2.5", "network": "192.168.0.0/24", "nextHop": "10.0.1.4", "sourcePeer": "10.0.1.4", "origin": "EBgp", "asPath": "65001"}
+		],
+		"RouteServiceRole_IN_0": [
+			{"localAddress": "10.0.2.4", "network": "192.168.0.0/24", "nextHop": "10.0.1.4", "sourcePeer": "10.0.1.4", "origin": "EBgp", "asPath": "65001"},
+			{"localAddress": "10.0.2.4", "network": "192.168.1.0/24", "nextHop": "10.0.1.5", "sourcePeer": "10.0.1.5", "origin": "EBgp", "asPath": "65002"}
+		]
+	}`)
+
+	routes, err := decodePeerRoutes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("expected routes of both instances to be merged into 2, got %+v", routes)
+	}
+	if routes[0].Network != "192.168.0.0/24" || routes[0].LocalAddress != "10.0.2.4" || routes[1].SourcePeer != "10.0.1.5" {
+		t.Errorf("unexpected routes %+v", routes)
+	}
+
+	if routes, err := decodePeerRoutes([]byte(`{"value": [{"network": "192.168.0.0/24", "nextHop": "10.0.1.4"}]}`)); err != nil || len(routes) != 1 {
+		t.Errorf("expected a single route from a value list, got %+v, %v", routes, err)
+	}
+}
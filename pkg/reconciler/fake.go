@@ -0,0 +1,425 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/networkop/cloudroutesync/pkg/diff"
+	"github.com/networkop/cloudroutesync/pkg/metrics"
+	"github.com/networkop/cloudroutesync/pkg/route"
+	"github.com/sirupsen/logrus"
+)
+
+// Operations of the fake cloud API, failures can be injected into each of them
+const (
+	FakeDiscover     = "Discover"
+	FakeListRoutes   = "ListRoutes"
+	FakeCreateRoute  = "CreateRoute"
+	FakeDeleteRoute  = "DeleteRoute"
+	FakeReplaceRoute = "ReplaceRoute"
+)
+
+var fakeOperations = []string{FakeDiscover, FakeListRoutes, FakeCreateRoute, FakeDeleteRoute, FakeReplaceRoute}
+
+var fakeReservedRanges = []*net.IPNet{
+	route.ParseCIDR("224.0.0.0/4"),
+	route.ParseCIDR("255.255.255.255/32"),
+	route.ParseCIDR("127.0.0.0/8"),
+	route.ParseCIDR("169.254.0.0/16"),
+}
+
+var fakeReservedRangesV6 = []*net.IPNet{
+	route.ParseCIDR("ff00::/8"),
+	route.ParseCIDR("::1/128"),
+	route.ParseCIDR("fe80::/10"),
+}
+
+// Fake cloud implementation details
+// * A single in-memory route table, which is lost on restart
+// * Every API call waits for the configured latency and can fail randomly or on demand
+// * Routes carry an owner, routes without one are created over HTTP to simulate other tenants
+// * State is served over HTTP under /fake/ to inspect it and inject failures at runtime
+
+// FakeClient is an in-memory cloud for local and end-to-end testing
+type FakeClient struct {
+	mu          sync.Mutex
+	routes      map[string]FakeRoute
+	maxRoutes   int
+	latency     time.Duration
+	failureRate float64
+	failures    map[string]int
+	calls       map[string]int
+	rand        *rand.Rand
+	discovered  bool
+	opts        Options
+}
+
+// FakeRoute is a single route of the fake cloud route table
+type FakeRoute struct {
+	Prefix  string `json:"prefix"`
+	Nexthop string `json:"nexthop"`
+	Owner   string `json:"owner,omitempty"`
+}
+
+// FakeState is a snapshot of the fake cloud
+type FakeState struct {
+	Routes      []FakeRoute    `json:"routes"`
+	Calls       map[string]int `json:"calls"`
+	Failures    map[string]int `json:"failures"`
+	MaxRoutes   int            `json:"maxRoutes"`
+	Latency     string         `json:"latency"`
+	FailureRate float64        `json:"failureRate"`
+}
+
+// FakeFailure makes the next Count calls of Operation fail
+type FakeFailure struct {
+	Operation string `json:"operation"`
+	Count     int    `json:"count"`
+}
+
+// NewFakeClient builds an empty fake cloud
+// maxRoutes of 0 means no limit, failureRate is the probability of any API call failing
+func NewFakeClient(opts Options, maxRoutes int, latency time.Duration, failureRate float64) *FakeClient {
+	return &FakeClient{
+		routes:      make(map[string]FakeRoute),
+		maxRoutes:   maxRoutes,
+		latency:     latency,
+		failureRate: failureRate,
+		failures:    make(map[string]int),
+		calls:       make(map[string]int),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		opts:        opts,
+	}
+}
+
+// Cleanup implements reconciler interface
+func (c *FakeClient) Cleanup(ctx context.Context) error {
+	logrus.Info("Deleting own routes from the fake cloud")
+	return c.syncRouteTable(ctx, route.Empty())
+}
+
+// Reconcile implements reconciler interface
+func (c *FakeClient) Reconcile(ctx context.Context, rt *route.Table, eventSync bool, syncInterval int) error {
+	if err := c.call(ctx, FakeDiscover); err != nil {
+		return fmt.Errorf("Failed to discover fake cloud: %s", err)
+	}
+	c.mu.Lock()
+	c.discovered = true
+	c.mu.Unlock()
+
+	return runLoop(ctx, "fake", rt, eventSync, syncInterval, c.syncRouteTable)
+}
+
+// Plan implements reconciler interface
+func (c *FakeClient) Plan(ctx context.Context, rt *route.Table) (Plans, error) {
+	if err := c.call(ctx, FakeDiscover); err != nil {
+		return nil, fmt.Errorf("Failed to discover fake cloud: %s", err)
+	}
+
+	current, err := c.listRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return Plans{newPlan("fake", "fake", c.diffRoutes(current, c.buildRoutes(rt)))}, nil
+}
+
+// Withdraw implements reconciler interface
+func (c *FakeClient) Withdraw(ctx context.Context) error {
+	c.mu.Lock()
+	discovered := c.discovered
+	c.mu.Unlock()
+
+	if !discovered {
+		return fmt.Errorf("Fake cloud has not been discovered yet")
+	}
+	logrus.Info("Withdrawing all owned routes")
+	return c.syncRouteTable(ctx, route.Empty())
+}
+
+// call simulates latency and failures of a single API call
+func (c *FakeClient) call(ctx context.Context, operation string) error {
+	if c.latency > 0 {
+		timer := time.NewTimer(c.latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls[operation]++
+	if c.failures[operation] > 0 {
+		c.failures[operation]--
+		metrics.APIError("fake", operation)
+		return fmt.Errorf("Injected %s failure", operation)
+	}
+	if c.failureRate > 0 && c.rand.Float64() < c.failureRate {
+		metrics.APIError("fake", operation)
+		return fmt.Errorf("Random %s failure", operation)
+	}
+	return nil
+}
+
+func (c *FakeClient) listRoutes(ctx context.Context) (map[string]FakeRoute, error) {
+	if err := c.call(ctx, FakeListRoutes); err != nil {
+		return nil, fmt.Errorf("Failed to list routes: %s", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make(map[string]FakeRoute, len(c.routes))
+	for prefix, r := range c.routes {
+		result[prefix] = r
+	}
+	return result, nil
+}
+
+func (c *FakeClient) buildRoutes(rt *route.Table) map[string]string {
+	result := make(map[string]string)
+	for prefix, nextHops := range rt.Snapshot() {
+		ip, _, err := net.ParseCIDR(prefix)
+		if err != nil {
+			logrus.Infof("Failed to parse prefix: %s", prefix)
+			continue
+		}
+
+		if c.opts.isReserved(ip, fakeReservedRanges, fakeReservedRangesV6) {
+			logrus.Debugf("Ignoring IP from fake cloud reserved ranges: %s", ip)
+			continue
+		}
+
+		// No ECMP support, picking the lowest next hop as primary
+		nextHop := nextHops.Primary()
+		if nextHop == nil {
+			continue
+		}
+		result[prefix] = nextHop.String()
+	}
+	return result
+}
+
+// diffRoutes never touches routes owned by others, even if they conflict with proposed ones
+func (c *FakeClient) diffRoutes(current map[string]FakeRoute, proposed map[string]string) diff.Result {
+	var currentRoutes, proposedRoutes []diff.Route
+	for _, existing := range current {
+		currentRoutes = append(currentRoutes, diff.Route{Prefix: existing.Prefix, Nexthop: existing.Nexthop})
+	}
+	for prefix, nextHop := range proposed {
+		if existing, ok := current[prefix]; ok && existing.Owner != c.opts.owner() {
+			logrus.Infof("Route %s is owned by %q, skipping", prefix, existing.Owner)
+			continue
+		}
+		proposedRoutes = append(proposedRoutes, diff.Route{Prefix: prefix, Nexthop: nextHop})
+	}
+
+	return diff.Routes(currentRoutes, proposedRoutes, func(r diff.Route) bool {
+		return current[r.Prefix].Owner == c.opts.owner()
+	})
+}
+
+func (c *FakeClient) syncRouteTable(ctx context.Context, rt *route.Table) error {
+	current, err := c.listRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.SetCloudRoutes("fake", "fake", len(current))
+
+	plan := newPlan("fake", "fake", c.diffRoutes(current, c.buildRoutes(rt)))
+	metrics.SetDrift("fake", plan.Table, plan.Changes())
+
+	if c.opts.DryRun {
+		c.opts.printPlan(plan)
+		return nil
+	}
+
+	var opErrors []error
+	record := func(err error, operation string) {
+		if err != nil {
+			opErrors = append(opErrors, err)
+			metrics.RoutesFailed("fake", 1)
+			return
+		}
+		switch operation {
+		case FakeCreateRoute:
+			metrics.RoutesAdded("fake", 1)
+		case FakeReplaceRoute:
+			metrics.RoutesReplaced("fake", 1)
+		case FakeDeleteRoute:
+			metrics.RoutesDeleted("fake", 1)
+		}
+	}
+
+	for _, r := range plan.Delete {
+		logrus.Infof("Deleting route %s -> %s", r.Prefix, r.Nexthop)
+		record(c.deleteRoute(ctx, r.Prefix), FakeDeleteRoute)
+	}
+	for _, r := range plan.Replace {
+		logrus.Infof("Replacing route %s -> %s with %s", r.Prefix, r.From, r.To)
+		record(c.putRoute(ctx, FakeReplaceRoute, r.Prefix, r.To), FakeReplaceRoute)
+	}
+	for _, r := range plan.Create {
+		logrus.Infof("Creating route %s -> %s", r.Prefix, r.Nexthop)
+		record(c.putRoute(ctx, FakeCreateRoute, r.Prefix, r.Nexthop), FakeCreateRoute)
+	}
+
+	for _, err := range opErrors {
+		logrus.Infof("Failed route operation: %s", err)
+	}
+	if len(opErrors) > 0 {
+		return fmt.Errorf("%d out of %d route operations failed", len(opErrors), plan.Changes())
+	}
+	return nil
+}
+
+func (c *FakeClient) putRoute(ctx context.Context, operation, prefix, nextHop string) error {
+	if err := c.call(ctx, operation); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	existing, ok := c.routes[prefix]
+	if operation == FakeCreateRoute && ok {
+		return fmt.Errorf("Route %s already exists", prefix)
+	}
+	if operation == FakeReplaceRoute && (!ok || existing.Owner != c.opts.owner()) {
+		return fmt.Errorf("Route %s does not exist", prefix)
+	}
+	if !ok && c.maxRoutes > 0 && len(c.routes) >= c.maxRoutes {
+		return fmt.Errorf("Route limit of %d exceeded", c.maxRoutes)
+	}
+
+	c.routes[prefix] = FakeRoute{Prefix: prefix, Nexthop: nextHop, Owner: c.opts.owner()}
+	return nil
+}
+
+func (c *FakeClient) deleteRoute(ctx context.Context, prefix string) error {
+	if err := c.call(ctx, FakeDeleteRoute); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.routes[prefix]; !ok {
+		return fmt.Errorf("Route %s does not exist", prefix)
+	}
+	delete(c.routes, prefix)
+	return nil
+}
+
+// State returns a snapshot of the fake cloud with routes sorted by prefix
+func (c *FakeClient) State() FakeState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := FakeState{
+		Routes:      []FakeRoute{},
+		Calls:       make(map[string]int),
+		Failures:    make(map[string]int),
+		MaxRoutes:   c.maxRoutes,
+		Latency:     c.latency.String(),
+		FailureRate: c.failureRate,
+	}
+	for _, r := range c.routes {
+		state.Routes = append(state.Routes, r)
+	}
+	sort.Slice(state.Routes, func(i, j int) bool { return state.Routes[i].Prefix < state.Routes[j].Prefix })
+	for op, n := range c.calls {
+		state.Calls[op] = n
+	}
+	for op, n := range c.failures {
+		state.Failures[op] = n
+	}
+	return state
+}
+
+// InjectFailure makes the next count calls of operation fail
+func (c *FakeClient) InjectFailure(operation string, count int) error {
+	if !isFakeOperation(operation) {
+		return fmt.Errorf("Unknown operation %q", operation)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures[operation] += count
+	return nil
+}
+
+// AddForeignRoute adds a route owned by somebody else
+func (c *FakeClient) AddForeignRoute(r FakeRoute) error {
+	if _, _, err := net.ParseCIDR(r.Prefix); err != nil {
+		return fmt.Errorf("Invalid prefix %q: %s", r.Prefix, err)
+	}
+	if r.Owner == c.opts.owner() {
+		return fmt.Errorf("Foreign route can not be owned by %q", r.Owner)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[r.Prefix] = r
+	return nil
+}
+
+// RemoveRoute deletes any route, simulating changes made by somebody else
+func (c *FakeClient) RemoveRoute(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.routes, prefix)
+}
+
+func isFakeOperation(operation string) bool {
+	for _, op := range fakeOperations {
+		if op == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP exposes the fake cloud
+// GET /fake/ returns the state, POST and DELETE /fake/routes add and remove other owners' routes,
+// POST /fake/failures injects failures
+func (c *FakeClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	switch {
+	case r.URL.Path == "/fake/" && r.Method == http.MethodGet:
+	case r.URL.Path == "/fake/routes" && r.Method == http.MethodPost:
+		var fr FakeRoute
+		if err = json.NewDecoder(r.Body).Decode(&fr); err == nil {
+			err = c.AddForeignRoute(fr)
+		}
+	case r.URL.Path == "/fake/routes" && r.Method == http.MethodDelete:
+		c.RemoveRoute(r.URL.Query().Get("prefix"))
+	case r.URL.Path == "/fake/failures" && r.Method == http.MethodPost:
+		var f FakeFailure
+		if err = json.NewDecoder(r.Body).Decode(&f); err == nil {
+			err = c.InjectFailure(f.Operation, f.Count)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.State())
+}
@@ -0,0 +1,87 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakeHTTP(t *testing.T) {
+	c := NewFakeClient(Options{OwnerTag: "test"}, 0, 0, 0)
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	do := func(method, path, body string) (int, FakeState) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var state FakeState
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, state
+	}
+
+	code, state := do(http.MethodPost, "/fake/routes", `{"prefix": "198.51.100.0/24", "nexthop": "10.0.0.1", "owner": "other"}`)
+	if code != http.StatusOK || len(state.Routes) != 1 || state.Routes[0].Owner != "other" {
+		t.Errorf("expected a foreign route, got %d %+v", code, state)
+	}
+
+	if code, _ := do(http.MethodPost, "/fake/routes", `{"prefix": "198.51.100.0/24", "nexthop": "10.0.0.1", "owner": "test"}`); code != http.StatusBadRequest {
+		t.Errorf("expected routes of our own owner to be rejected, got %d", code)
+	}
+
+	code, state = do(http.MethodPost, "/fake/failures", `{"operation": "ListRoutes", "count": 2}`)
+	if code != http.StatusOK || state.Failures[FakeListRoutes] != 2 {
+		t.Errorf("expected 2 pending failures, got %d %+v", code, state)
+	}
+
+	if code, _ := do(http.MethodPost, "/fake/failures", `{"operation": "Unknown", "count": 1}`); code != http.StatusBadRequest {
+		t.Errorf("expected unknown operation to be rejected, got %d", code)
+	}
+
+	if _, err := c.Plan(context.Background(), testTable(nil)); err == nil {
+		t.Errorf("expected injected failure")
+	}
+
+	code, state = do(http.MethodDelete, "/fake/routes?prefix=198.51.100.0/24", "")
+	if code != http.StatusOK || len(state.Routes) != 0 || state.Failures[FakeListRoutes] != 1 {
+		t.Errorf("expected empty route table and 1 pending failure, got %d %+v", code, state)
+	}
+}
+
+func TestFakeLatency(t *testing.T) {
+	c := NewFakeClient(Options{OwnerTag: "test"}, 0, time.Hour, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := c.syncRouteTable(ctx, testTable(nil)); err == nil {
+		t.Errorf("expected slow API call to be cancelled")
+	}
+}
+
+func TestFakeDryRun(t *testing.T) {
+	c := NewFakeClient(Options{OwnerTag: "test", DryRun: true, PlanFormat: "json"}, 0, 0, 0)
+
+	rt := testTable(map[string]string{"198.51.100.0/24": "10.0.0.7"})
+	if err := c.syncRouteTable(context.Background(), rt); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(c.State().Routes); n != 0 {
+		t.Errorf("dry run must not create routes, got %d", n)
+	}
+}
@@ -2,17 +2,26 @@ package reconciler
 
 import (
 	"context"
+	"crypto/sha1"
 	"fmt"
 	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
+	"github.com/networkop/cloudroutesync/pkg/diff"
+	"github.com/networkop/cloudroutesync/pkg/leader"
+	"github.com/networkop/cloudroutesync/pkg/metrics"
 	"github.com/networkop/cloudroutesync/pkg/route"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2/google"
 	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 )
 
 var gcpReservedRanges = []*net.IPNet{
@@ -25,6 +34,21 @@ var gcpReservedRanges = []*net.IPNet{
 	route.ParseCIDR("255.255.255.255/32"),
 }
 
+var gcpReservedRangesV6 = []*net.IPNet{
+	route.ParseCIDR("::1/128"),
+	route.ParseCIDR("fe80::/10"),
+	route.ParseCIDR("ff00::/8"),
+}
+
+const (
+	// GCP resource names must be 1-63 characters long
+	gcpMaxNameLength = 63
+	// Project quota on the number of routes in all networks
+	gcpRoutesQuota = "ROUTES"
+	// Project metadata holding the lease is written at most this often
+	gcpLeaseRetryPeriod = 30 * time.Second
+)
+
 var (
 	maxOpWaitSeconds = 60
 	opCheckPeriod    = 2
@@ -44,11 +68,32 @@ type GcpClient struct {
 	client                          *compute.Service
 	projectID, zone, region         string
 	instanceID, network, internalIP string
-	subnet                          *net.IPNet
+	internalIPv6                    string
+	subnet, subnetV6                *net.IPNet
+	// selfLink of the local instance, used as nextHopInstance
+	selfLink string
+	// ilb is the forwarding rule used as next hop, discovered with the local network
+	ilb      *compute.ForwardingRule
+	settings GcpSettings
+	opts     Options
+}
+
+// GcpSettings define how GCP routes are created
+type GcpSettings struct {
+	// Priority of all routes, ECMP routes always share it
+	Priority int64
+	// Tags limit routes to instances with any of these network tags
+	Tags []string
+	// NextHopInstance points routes to the local instance instead of its IP
+	NextHopInstance bool
+	// ForwardingRule of an internal load balancer used as next hop instead of the local instance
+	ForwardingRule string
+	// InstanceGroup of the ILB backend, the local instance is a member while it has routes
+	InstanceGroup string
 }
 
 // NewGcpClient builds new GCP client
-func NewGcpClient() (*GcpClient, error) {
+func NewGcpClient(opts Options, settings GcpSettings) (*GcpClient, error) {
 
 	httpC, err := google.DefaultClient(context.TODO(), compute.ComputeScope)
 	if err != nil {
@@ -82,6 +127,9 @@ func NewGcpClient() (*GcpClient, error) {
 
 	zoneParts := strings.Split(zone, "-")
 
+	settings.Tags = append([]string{}, settings.Tags...)
+	sort.Strings(settings.Tags)
+
 	return &GcpClient{
 		client:     client,
 		projectID:  project,
@@ -89,153 +137,449 @@ func NewGcpClient() (*GcpClient, error) {
 		internalIP: internalIP,
 		instanceID: instanceID,
 		region:     strings.Join(zoneParts[0:len(zoneParts)-1], "-"),
+		settings:   settings,
+		opts:       opts,
 	}, nil
 }
 
-// Cleanup removes any leftover resources
-func (c *GcpClient) Cleanup() error {
-	logrus.Infof("Azure cleanup currently not implemented")
+// Cleanup deletes all owned routes in the local network and waits for the operations
+// Routes of instances in other networks of the project are left alone
+// The local instance is removed from the ILB instance group as well
+func (c *GcpClient) Cleanup(ctx context.Context) error {
+	if c.settings.InstanceGroup != "" {
+		instance, err := c.instanceSelfLink(ctx)
+		if err != nil {
+			return err
+		}
+		if err := c.syncBackend(ctx, instance, false); err != nil {
+			return err
+		}
+	}
+
+	if err := c.lookupNetwork(ctx); err != nil {
+		return fmt.Errorf("Failed to lookupNetwork: %s", err)
+	}
+
+	routes, err := c.fetchOwnedRoutes(ctx, c.network)
+	if err != nil {
+		return err
+	}
+
+	ops := []*compute.Operation{}
+	failed := 0
+	for _, route := range routes {
+		logrus.Infof("Deleting route %s", route.Name)
+		op, err := c.client.Routes.Delete(c.projectID, route.Name).Context(ctx).Do()
+		if err != nil {
+			metrics.APIError("gcp", "Routes.Delete")
+			metrics.RoutesFailed("gcp", 1)
+			logrus.Infof("Failed to initiate route delete %s", err)
+			failed++
+			continue
+		}
+		ops = append(ops, op)
+	}
+
+	failed += c.waitForOps(ctx, ops)
+
+	logrus.Infof("Cleanup deleted %d out of %d owned routes", len(routes)-failed, len(routes))
+	if failed > 0 {
+		return fmt.Errorf("Failed to delete %d routes", failed)
+	}
 	return nil
 }
 
 // Reconcile implements reconciler interface
-func (c *GcpClient) Reconcile(rt *route.Table, eventSync bool, syncInterval int) {
+func (c *GcpClient) Reconcile(ctx context.Context, rt *route.Table, eventSync bool, syncInterval int) error {
+
+	if err := c.lookupNetwork(ctx); err != nil {
+		return fmt.Errorf("Failed to lookupNetwork: %s", err)
+	}
+
+	return runLoop(ctx, "gcp", rt, eventSync, syncInterval, c.syncRouteTable)
+}
 
-	err := c.lookupNetwork()
+// Plan implements reconciler interface
+func (c *GcpClient) Plan(ctx context.Context, rt *route.Table) (Plans, error) {
+	if err := c.lookupNetwork(ctx); err != nil {
+		return nil, fmt.Errorf("Failed to lookupNetwork: %s", err)
+	}
+
+	changes, _, _, err := c.diffRoutes(ctx, rt)
 	if err != nil {
-		logrus.Infof("Failed to lookupNetwork: %s", err)
+		return nil, err
 	}
+	return Plans{newPlan("gcp", path.Base(c.network), changes)}, nil
+}
 
-	if eventSync {
-		for range rt.SyncCh {
-			err := c.syncRouteTable(rt)
-			if err != nil {
-				logrus.Infof("Failed to sync route table: %s", err)
-			}
-		}
-	} else {
-		for {
-			select {
-			case _ = <-rt.SyncCh:
-				logrus.Debug("Received sync signal in periodic mode, ignoring")
-			default:
-				err := c.syncRouteTable(rt)
-				if err != nil {
-					logrus.Infof("Failed to sync route table: %s", err)
-				}
-				time.Sleep(time.Duration(syncInterval) * time.Second)
+// Withdraw deletes all owned routes
+func (c *GcpClient) Withdraw(ctx context.Context) error {
+	if c.network == "" {
+		return fmt.Errorf("Local network has not been discovered yet")
+	}
+	logrus.Info("Withdrawing all routes")
+	return c.syncRouteTable(ctx, route.Empty())
+}
+
+// fetchOwnedRoutes pages through all owned routes of a network, or of the whole project if network is empty
+// Results are filtered by the API and checked again, in case the filter is not applied as expected
+func (c *GcpClient) fetchOwnedRoutes(ctx context.Context, network string) ([]*compute.Route, error) {
+	// eq expressions are full matches of an RE2 regular expression, several of them are parenthesized and ANDed
+	filter := fmt.Sprintf("(name eq \"%s-.*\")", regexp.QuoteMeta(c.opts.owner()))
+	if network != "" {
+		filter += fmt.Sprintf(" (network eq \"%s\")", regexp.QuoteMeta(network))
+	}
+
+	var result []*compute.Route
+	err := c.client.Routes.List(c.projectID).Filter(filter).Pages(ctx, func(page *compute.RouteList) error {
+		for _, route := range page.Items {
+			if !strings.HasPrefix(route.Name, c.opts.owner()+"-") || (network != "" && route.Network != network) {
+				continue
 			}
+			result = append(result, route)
 		}
+		return nil
+	})
+	if err != nil {
+		metrics.APIError("gcp", "Routes.List")
+		return nil, fmt.Errorf("Failed to list routes for GCP: %s", err)
 	}
+	return result, nil
 }
 
-func (c *GcpClient) fetchOwnedRoutes() ([]*compute.Route, error) {
-	routes, err := c.client.Routes.
-		List(c.projectID).
-		Filter(fmt.Sprintf("name:%s*", uniquePrefix)).
-		Do()
+// routesQuota returns the number of routes that can still be created in the project, -1 if there's no limit
+func (c *GcpClient) routesQuota(ctx context.Context) (int, error) {
+	project, err := c.client.Projects.Get(c.projectID).Context(ctx).Do()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to list routes for GCP: %s", err)
+		metrics.APIError("gcp", "Projects.Get")
+		return 0, fmt.Errorf("Failed to get project %s: %s", c.projectID, err)
+	}
+
+	for _, quota := range project.Quotas {
+		if quota.Metric == gcpRoutesQuota {
+			logrus.Debugf("Project uses %.0f out of %.0f routes", quota.Usage, quota.Limit)
+			return int(quota.Limit - quota.Usage), nil
+		}
+	}
+	return -1, nil
+}
+
+// limitToQuota keeps as many routes as fit into the available quota
+// Shorter prefixes are kept first, as they cover the most destinations
+func limitToQuota(routes []*compute.Route, available int) (kept, skipped []*compute.Route) {
+	if available < 0 || len(routes) <= available {
+		return routes, nil
 	}
+	if available == 0 {
+		return nil, routes
+	}
+
+	sorted := make([]*compute.Route, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		li, lj := prefixLength(sorted[i].DestRange), prefixLength(sorted[j].DestRange)
+		if li != lj {
+			return li < lj
+		}
+		if sorted[i].DestRange != sorted[j].DestRange {
+			return sorted[i].DestRange < sorted[j].DestRange
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted[:available], sorted[available:]
+}
 
-	// If too many routes (>500), this won't work
-	return routes.Items, nil
+func prefixLength(prefix string) int {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return 0
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones
 }
 
 // GCP does not support installation of nexthops from local subnet
 // This is due to the all interfaces having a /32 mask and linux kenel
 // requiring routes to be recursively resolved before installing them in the FIB
+// Prefixes with any next hop in the local subnet are skipped, all others get a single route via self
 func (c *GcpClient) buildRoutes(rt *route.Table) (result []*compute.Route) {
-	for prefix, nextHop := range rt.Routes {
-		// Skip nextHops that match local subnet
-		if c.subnet.Contains(nextHop) {
+	for prefix, nextHops := range rt.Snapshot() {
+		ip, _, err := net.ParseCIDR(prefix)
+		if err != nil {
+			logrus.Infof("Failed to parse prefix: %s", prefix)
+			continue
+		}
+
+		if c.opts.isReserved(ip, gcpReservedRanges, gcpReservedRangesV6) {
+			logrus.Debugf("Ignoring IP from GCP reserved ranges: %s", ip)
 			continue
 		}
-		// For all other cases set next-hop to self
-		result = append(result, &compute.Route{
-			Name:      uniquePrefix + "-" + prefixToName(prefix) + prefixToName(nextHop.String()),
-			DestRange: prefix,
-			Network:   c.network,
-			NextHopIp: c.privateIP,
-		})
+
+		selfIP := c.internalIP
+		if ip.To4() == nil {
+			selfIP = c.internalIPv6
+		}
+
+		if selfIP == "" {
+			logrus.Infof("No local IP of the same address family found for prefix: %s", prefix)
+			continue
+		}
+
+		// The same rule applies to single and ECMP next hops
+		if c.hasLocalNextHop(nextHops) {
+			logrus.Debugf("Ignoring prefix with a next hop in the local subnet: %s", prefix)
+			continue
+		}
+
+		// Non-local next hops are all collapsed into next-hop self
+		result = append(result, c.newRoute(prefix, selfIP))
 	}
 	return result
 }
 
+func (c *GcpClient) hasLocalNextHop(nextHops route.Nexthops) bool {
+	for _, nextHop := range nextHops {
+		if c.subnet.Contains(nextHop) || (c.subnetV6 != nil && c.subnetV6.Contains(nextHop)) {
+			return true
+		}
+	}
+	return false
+}
+
+// newRoute builds a route via self with the configured priority and tags
+// Next hop self is replaced by the ILB of the same address family or the local instance, if either is configured
+// Priority is always sent, since 0 is a valid priority and would otherwise be replaced by GCP's default
+func (c *GcpClient) newRoute(prefix, nextHop string) *compute.Route {
+	route := &compute.Route{
+		Name:            c.routeName(prefix, nextHop),
+		DestRange:       prefix,
+		Network:         c.network,
+		NextHopIp:       nextHop,
+		Priority:        c.settings.Priority,
+		Tags:            c.settings.Tags,
+		ForceSendFields: []string{"Priority"},
+	}
+	switch {
+	case c.ilb != nil && sameFamily(nextHop, c.ilb.IPAddress):
+		route.Name = c.routeName(prefix, c.ilb.Name)
+		route.NextHopIp = ""
+		route.NextHopIlb = c.ilb.SelfLink
+	case c.settings.NextHopInstance:
+		route.Name = c.routeName(prefix, c.instanceID)
+		route.NextHopIp = ""
+		route.NextHopInstance = c.selfLink
+	}
+	return route
+}
+
+func sameFamily(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	return ipA != nil && ipB != nil && (ipA.To4() == nil) == (ipB.To4() == nil)
+}
+
 func prefixToName(prefix string) string {
-	return strings.ReplaceAll(strings.Replace(prefix, "/", "slash", 1), ".", "-")
+	return strings.ReplaceAll(strings.ReplaceAll(strings.Replace(prefix, "/", "slash", 1), ".", "-"), ":", "-")
 }
 
-func containsRoute(routeList []*compute.Route, checkRoute *compute.Route) bool {
-	logrus.Debugf("Checking if %s is in the list", checkRoute.Name)
+// The next hop is either an IP or the ID of the local instance
+// IPv6 prefixes may not fit into a valid route name, so those are hashed instead
+func (c *GcpClient) routeName(prefix string, nextHop string) string {
+	name := c.opts.owner() + "-" + prefixToName(prefix) + prefixToName(nextHop)
+	if len(name) <= gcpMaxNameLength && !strings.HasSuffix(name, "-") {
+		return name
+	}
+	return fmt.Sprintf("%s-%x", c.opts.owner(), sha1.Sum([]byte(prefix+nextHop)))
+}
 
-	for _, route := range routeList {
-		if route.Network == checkRoute.Network && route.NextHopIp == checkRoute.NextHopIp {
+func gcpDiffRoute(route *compute.Route) diff.Route {
+	if route.NextHopIlb != "" {
+		return diff.Route{Prefix: route.DestRange, Nexthop: route.NextHopIlb}
+	}
+	if route.NextHopInstance != "" {
+		return diff.Route{Prefix: route.DestRange, Nexthop: route.NextHopInstance}
+	}
+	return diff.Route{Prefix: route.DestRange, Nexthop: route.NextHopIp}
+}
+
+// gcpRouteOutdated is true if a route has the same next hop as the proposed one, but other priority or tags
+func gcpRouteOutdated(current, proposed *compute.Route) bool {
+	if current.Priority != proposed.Priority || len(current.Tags) != len(proposed.Tags) {
+		return true
+	}
+	tags := append([]string{}, current.Tags...)
+	sort.Strings(tags)
+	for i := range tags {
+		if tags[i] != proposed.Tags[i] {
 			return true
 		}
 	}
 	return false
 }
 
-func (c *GcpClient) syncRouteTable(rt *route.Table) error {
-	logrus.Infof("Syncing cloud route table")
-
-	currentRoutes, err := c.fetchOwnedRoutes()
+// diffRoutes returns routes to insert and delete
+// GCP routes can not be changed in place, so replacements are split into a delete and an insert
+// Routes with outdated priority or tags are recreated and planned as replacements to the same next hop
+func (c *GcpClient) diffRoutes(ctx context.Context, rt *route.Table) (diff.Result, []*compute.Route, []*compute.Route, error) {
+	currentRoutes, err := c.fetchOwnedRoutes(ctx, c.network)
 	if err != nil {
-		return fmt.Errorf("Failed to fetchOwnedRoutes: %s", err)
+		return diff.Result{}, nil, nil, fmt.Errorf("Failed to fetchOwnedRoutes: %s", err)
 	}
 	logrus.Debugf("Current routes: %+v", currentRoutes)
+	metrics.SetCloudRoutes("gcp", path.Base(c.network), len(currentRoutes))
 
 	proposedRoutes := c.buildRoutes(rt)
 	logrus.Debugf("Proposed routes: %+v", proposedRoutes)
 
-	logrus.Debug("Checking if any routes need deleting")
-	toDelete := []*compute.Route{}
-	for _, currentRoute := range currentRoutes {
-		if !containsRoute(proposedRoutes, currentRoute) {
-			logrus.Debugf("Enqueuing DELETE operation for %s", currentRoute.Name)
-			toDelete = append(toDelete, currentRoute)
-		}
+	var current, proposed []diff.Route
+	currentByKey := make(map[diff.Route]*compute.Route)
+	for _, route := range currentRoutes {
+		current = append(current, gcpDiffRoute(route))
+		currentByKey[gcpDiffRoute(route)] = route
+	}
+	proposedByKey := make(map[diff.Route]*compute.Route)
+	for _, route := range proposedRoutes {
+		proposed = append(proposed, gcpDiffRoute(route))
+		proposedByKey[gcpDiffRoute(route)] = route
 	}
 
-	logrus.Debug("Checking if any routes need adding")
-	toAdd := []*compute.Route{}
-	for _, proposedRoute := range proposedRoutes {
-		if !containsRoute(currentRoutes, proposedRoute) {
-			logrus.Debugf("Enqueuing ADD operation for %s", proposedRoute.Name)
-			toAdd = append(toAdd, proposedRoute)
+	changes := diff.Routes(current, proposed, nil)
+	for key, route := range proposedByKey {
+		if existing, ok := currentByKey[key]; ok && gcpRouteOutdated(existing, route) {
+			changes.Replace = append(changes.Replace, diff.Replacement{Prefix: key.Prefix, From: key.Nexthop, To: key.Nexthop})
 		}
 	}
+	sort.Slice(changes.Replace, func(i, j int) bool {
+		if changes.Replace[i].Prefix != changes.Replace[j].Prefix {
+			return changes.Replace[i].Prefix < changes.Replace[j].Prefix
+		}
+		return changes.Replace[i].From < changes.Replace[j].From
+	})
+	add, del := changes.Flatten()
+
+	var toAdd, toDelete []*compute.Route
+	for _, r := range del {
+		logrus.Debugf("Enqueuing DELETE operation for %s", currentByKey[r].Name)
+		toDelete = append(toDelete, currentByKey[r])
+	}
+	for _, r := range add {
+		logrus.Debugf("Enqueuing ADD operation for %s", proposedByKey[r].Name)
+		toAdd = append(toAdd, proposedByKey[r])
+	}
+
+	return changes, toAdd, toDelete, nil
+}
+
+func (c *GcpClient) syncRouteTable(ctx context.Context, rt *route.Table) error {
+	logrus.Infof("Syncing cloud route table")
+
+	changes, toAdd, toDelete, err := c.diffRoutes(ctx, rt)
+	if err != nil {
+		return err
+	}
+
+	plan := newPlan("gcp", path.Base(c.network), changes)
+	metrics.SetDrift("gcp", plan.Table, plan.Changes())
+
+	if c.opts.DryRun {
+		c.opts.printPlan(plan)
+		return nil
+	}
 
 	ops := []*compute.Operation{}
 
 	for _, delete := range toDelete {
 		logrus.Infof("Attempting to delete route %s", delete.Name)
-		op, err := c.client.Routes.Delete(c.projectID, delete.Name).Do()
+		op, err := c.client.Routes.Delete(c.projectID, delete.Name).Context(ctx).Do()
 		if err != nil {
+			metrics.APIError("gcp", "Routes.Delete")
+			metrics.RoutesFailed("gcp", 1)
 			logrus.Infof("Failed to initiate route delete %s", err)
 		} else {
 			ops = append(ops, op)
 		}
 	}
 
+	// Recreated routes keep their name, which is only free once the delete is done
+	if sameNames(toAdd, toDelete) && len(ops) > 0 {
+		logrus.Debugf("Waiting for route deletes before recreating routes")
+		c.waitForOps(ctx, ops)
+		ops = nil
+	}
+
+	toAdd, ops, quotaErr := c.checkQuota(ctx, toAdd, ops)
+
 	for _, add := range toAdd {
 		logrus.Infof("Attempting to add route %s", add.Name)
-		op, err := c.client.Routes.Insert(c.projectID, add).Do()
+		op, err := c.client.Routes.Insert(c.projectID, add).Context(ctx).Do()
 		if err != nil {
+			metrics.APIError("gcp", "Routes.Insert")
+			metrics.RoutesFailed("gcp", 1)
 			logrus.Infof("Failed to initiate route add %s", err)
 		} else {
 			ops = append(ops, op)
 		}
 	}
 
-	c.waitForOps(ops)
+	c.waitForOps(ctx, ops)
 
-	return nil
+	return quotaErr
+}
+
+// sameNames is true if any route to add has the name of a route to delete
+func sameNames(toAdd, toDelete []*compute.Route) bool {
+	names := make(map[string]bool, len(toDelete))
+	for _, route := range toDelete {
+		names[route.Name] = true
+	}
+	for _, route := range toAdd {
+		if names[route.Name] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkQuota drops routes that would exceed the ROUTES quota of the project
+// Deleted routes only free the quota once their operations are done, so those are waited for if the quota is short
+// It returns routes to add and delete operations that are still pending
+func (c *GcpClient) checkQuota(ctx context.Context, toAdd []*compute.Route, deletes []*compute.Operation) ([]*compute.Route, []*compute.Operation, error) {
+	if len(toAdd) == 0 {
+		return toAdd, deletes, nil
+	}
+
+	available, err := c.routesQuota(ctx)
+	if err != nil {
+		logrus.Infof("Failed to check routes quota: %s", err)
+		return toAdd, deletes, nil
+	}
+
+	if available >= 0 && len(toAdd) > available && len(deletes) > 0 {
+		logrus.Debugf("Waiting for route deletes to free the quota")
+		c.waitForOps(ctx, deletes)
+		deletes = nil
+		if available, err = c.routesQuota(ctx); err != nil {
+			logrus.Infof("Failed to check routes quota: %s", err)
+			return toAdd, deletes, nil
+		}
+	}
+
+	kept, skipped := limitToQuota(toAdd, available)
+	if len(skipped) == 0 {
+		return kept, deletes, nil
+	}
+
+	for _, route := range skipped {
+		logrus.Warnf("Skipping route %s, the %s quota of the project is exhausted", route.Name, gcpRoutesQuota)
+	}
+	metrics.RoutesFailed("gcp", len(skipped))
+	return kept, deletes, fmt.Errorf("%d routes exceed the %s quota of project %s", len(skipped), gcpRoutesQuota, c.projectID)
 }
 
-func (c *GcpClient) waitForOps(ops []*compute.Operation) {
+// waitForOps waits for all operations and returns the number of failed ones
+func (c *GcpClient) waitForOps(ctx context.Context, ops []*compute.Operation) int {
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
 
 	for _, op := range ops {
 		wg.Add(1)
@@ -244,9 +588,18 @@ func (c *GcpClient) waitForOps(ops []*compute.Operation) {
 			defer wg.Done()
 			logrus.Debugf("Waiting for operation %s", op.Name)
 
-			err := c.waitForOp(op)
-			if err != nil {
+			err := c.waitForOp(ctx, op)
+			switch {
+			case err != nil:
+				metrics.RoutesFailed("gcp", 1)
 				logrus.Infof("Failed to perform operation: %s", err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			case op.OperationType == "delete":
+				metrics.RoutesDeleted("gcp", 1)
+			default:
+				metrics.RoutesAdded("gcp", 1)
 			}
 
 		}(op, &wg)
@@ -254,10 +607,11 @@ func (c *GcpClient) waitForOps(ops []*compute.Operation) {
 
 	wg.Wait()
 	logrus.Info("All ops completed")
+	return failed
 }
 
-func (c *GcpClient) waitForOp(op *compute.Operation) error {
-	ctx, cancel := context.WithTimeout(context.TODO(), (time.Duration(maxOpWaitSeconds) * time.Second))
+func (c *GcpClient) waitForOp(ctx context.Context, op *compute.Operation) error {
+	ctx, cancel := context.WithTimeout(ctx, (time.Duration(maxOpWaitSeconds) * time.Second))
 	defer cancel()
 
 	ticker := time.NewTicker(time.Duration(opCheckPeriod) * time.Second)
@@ -266,9 +620,9 @@ func (c *GcpClient) waitForOp(op *compute.Operation) error {
 	for {
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("timeout waiting for operation to complete")
+			return fmt.Errorf("Stopped waiting for operation to complete: %s", ctx.Err())
 		case <-ticker.C:
-			result, err := c.client.GlobalOperations.Get(c.projectID, op.Name).Do()
+			result, err := c.getOp(ctx, op)
 			if err != nil {
 				return fmt.Errorf("Failed retriving operation status: %s", err)
 			}
@@ -289,23 +643,44 @@ func (c *GcpClient) waitForOp(op *compute.Operation) error {
 	}
 }
 
-func (c *GcpClient) lookupNetwork() error {
+// getOp returns the current status of a global or zonal operation
+func (c *GcpClient) getOp(ctx context.Context, op *compute.Operation) (*compute.Operation, error) {
+	if op.Zone != "" {
+		result, err := c.client.ZoneOperations.Get(c.projectID, path.Base(op.Zone), op.Name).Context(ctx).Do()
+		if err != nil {
+			metrics.APIError("gcp", "ZoneOperations.Get")
+		}
+		return result, err
+	}
+
+	result, err := c.client.GlobalOperations.Get(c.projectID, op.Name).Context(ctx).Do()
+	if err != nil {
+		metrics.APIError("gcp", "GlobalOperations.Get")
+	}
+	return result, err
+}
+
+func (c *GcpClient) lookupNetwork(ctx context.Context) error {
 	logrus.Debugf("Looking up Local Network")
 
-	instance, err := c.client.Instances.Get(c.projectID, c.zone, c.instanceID).Do()
+	instance, err := c.client.Instances.Get(c.projectID, c.zone, c.instanceID).Context(ctx).Do()
 	if err != nil {
-		return fmt.Errorf("Failed to get local instance details")
+		metrics.APIError("gcp", "Instances.Get")
+		return fmt.Errorf("Failed to get local instance details: %s", err)
 	}
 
+	c.selfLink = instance.SelfLink
+
 	for _, nic := range instance.NetworkInterfaces {
 		logrus.Debugf("Checking NIC %s ", nic.Name)
 
 		if c.internalIP == nic.NetworkIP {
 			logrus.Debug("Found a NIC matching internalIP")
 
-			subnet, err := c.client.Subnetworks.Get(c.projectID, c.region, nic.Subnetwork).Do()
+			subnet, err := c.client.Subnetworks.Get(c.projectID, c.region, nic.Subnetwork).Context(ctx).Do()
 			if err != nil {
-				return fmt.Errorf("Failed to get local subnetwork")
+				metrics.APIError("gcp", "Subnetworks.Get")
+				return fmt.Errorf("Failed to get local subnetwork: %s", err)
 			}
 
 			_, ipNet, err := net.ParseCIDR(subnet.IpCidrRange)
@@ -313,10 +688,219 @@ func (c *GcpClient) lookupNetwork() error {
 				return fmt.Errorf("Failed to parse subnet CIDR: %s", subnet.IpCidrRange)
 			}
 
+			if subnet.Ipv6CidrRange != "" {
+				_, ipNetV6, err := net.ParseCIDR(subnet.Ipv6CidrRange)
+				if err != nil {
+					return fmt.Errorf("Failed to parse subnet IPv6 CIDR: %s", subnet.Ipv6CidrRange)
+				}
+				c.subnetV6 = ipNetV6
+				c.internalIPv6 = nic.Ipv6Address
+			}
+
 			c.network = nic.Network
 			c.subnet = ipNet
-			return nil
+			return c.lookupForwardingRule(ctx)
 		}
 	}
 	return fmt.Errorf("Could not find local network")
 }
+
+// lookupForwardingRule finds the ILB used as next hop, which must be in the local network
+func (c *GcpClient) lookupForwardingRule(ctx context.Context) error {
+	if c.settings.ForwardingRule == "" {
+		return nil
+	}
+
+	rule, err := c.client.ForwardingRules.Get(c.projectID, c.region, c.settings.ForwardingRule).Context(ctx).Do()
+	if err != nil {
+		metrics.APIError("gcp", "ForwardingRules.Get")
+		return fmt.Errorf("Failed to get forwarding rule %s: %s", c.settings.ForwardingRule, err)
+	}
+	if rule.LoadBalancingScheme != "INTERNAL" {
+		return fmt.Errorf("Forwarding rule %s is not an internal passthrough load balancer", rule.Name)
+	}
+	if path.Base(rule.Network) != path.Base(c.network) {
+		return fmt.Errorf("Forwarding rule %s is not in the local network", rule.Name)
+	}
+
+	logrus.Debugf("Using forwarding rule %s (%s) as next hop", rule.Name, rule.IPAddress)
+	c.ilb = rule
+	return nil
+}
+
+// ManageBackend implements BackendManager, the local instance is a member of the ILB instance group while it has routes
+// Routes disappear from the local table once the routing daemon stops, which takes the instance out of the ILB
+func (c *GcpClient) ManageBackend(ctx context.Context, rt *route.Table, syncInterval int) error {
+	if c.settings.InstanceGroup == "" {
+		return nil
+	}
+
+	instance, err := c.instanceSelfLink(ctx)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Duration(syncInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := c.syncBackend(ctx, instance, rt.Len() > 0); err != nil {
+			logrus.Infof("Failed to sync ILB backend membership: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *GcpClient) instanceSelfLink(ctx context.Context) (string, error) {
+	instance, err := c.client.Instances.Get(c.projectID, c.zone, c.instanceID).Context(ctx).Do()
+	if err != nil {
+		metrics.APIError("gcp", "Instances.Get")
+		return "", fmt.Errorf("Failed to get local instance details: %s", err)
+	}
+	return instance.SelfLink, nil
+}
+
+// syncBackend adds the instance to the ILB instance group or removes it from there
+func (c *GcpClient) syncBackend(ctx context.Context, instance string, healthy bool) error {
+	group := c.settings.InstanceGroup
+
+	member, err := c.isGroupMember(ctx, instance)
+	if err != nil {
+		return err
+	}
+	metrics.SetBackendMember("gcp", member)
+	if member == healthy {
+		return nil
+	}
+
+	refs := []*compute.InstanceReference{{Instance: instance}}
+	var op *compute.Operation
+	if healthy {
+		logrus.Infof("Adding local instance to instance group %s", group)
+		op, err = c.client.InstanceGroups.AddInstances(c.projectID, c.zone, group, &compute.InstanceGroupsAddInstancesRequest{Instances: refs}).Context(ctx).Do()
+		if err != nil {
+			metrics.APIError("gcp", "InstanceGroups.AddInstances")
+			return fmt.Errorf("Failed to add instance to instance group %s: %s", group, err)
+		}
+	} else {
+		logrus.Infof("Removing local instance from instance group %s, there are no routes to sync", group)
+		op, err = c.client.InstanceGroups.RemoveInstances(c.projectID, c.zone, group, &compute.InstanceGroupsRemoveInstancesRequest{Instances: refs}).Context(ctx).Do()
+		if err != nil {
+			metrics.APIError("gcp", "InstanceGroups.RemoveInstances")
+			return fmt.Errorf("Failed to remove instance from instance group %s: %s", group, err)
+		}
+	}
+
+	if err := c.waitForOp(ctx, op); err != nil {
+		return err
+	}
+	metrics.SetBackendMember("gcp", healthy)
+	return nil
+}
+
+func (c *GcpClient) isGroupMember(ctx context.Context, instance string) (bool, error) {
+	member := false
+	err := c.client.InstanceGroups.ListInstances(c.projectID, c.zone, c.settings.InstanceGroup, &compute.InstanceGroupsListInstancesRequest{
+		InstanceState: "ALL",
+	}).Pages(ctx, func(page *compute.InstanceGroupsListInstances) error {
+		for _, item := range page.Items {
+			if item.Instance == instance {
+				member = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		metrics.APIError("gcp", "InstanceGroups.ListInstances")
+		return false, fmt.Errorf("Failed to list instances of instance group %s: %s", c.settings.InstanceGroup, err)
+	}
+	return member, nil
+}
+
+// LeaseStore implements LeaseProvider, leases are kept in the project-wide instance metadata
+// Writes are conditional on the metadata fingerprint read along with the lease
+func (c *GcpClient) LeaseStore(ctx context.Context, rt *route.Table) (leader.Store, error) {
+	return gcpLeaseStore{leader.NewTagStore(c.opts.owner(), gcpProjectMetadata{c})}, nil
+}
+
+// gcpLeaseStore renews the lease less often, every write is a slow operation changing metadata of all instances
+type gcpLeaseStore struct {
+	leader.Store
+}
+
+// MinRetryPeriod implements leader.Paced
+func (gcpLeaseStore) MinRetryPeriod() time.Duration {
+	return gcpLeaseRetryPeriod
+}
+
+type gcpProjectMetadata struct {
+	c *GcpClient
+}
+
+func (m gcpProjectMetadata) get(ctx context.Context) (*compute.Metadata, error) {
+	project, err := m.c.client.Projects.Get(m.c.projectID).Context(ctx).Do()
+	if err != nil {
+		metrics.APIError("gcp", "Projects.Get")
+		return nil, fmt.Errorf("Failed to get project %s: %s", m.c.projectID, err)
+	}
+	if project.CommonInstanceMetadata == nil {
+		return &compute.Metadata{}, nil
+	}
+	return project.CommonInstanceMetadata, nil
+}
+
+// GetTags returns metadata items and the metadata fingerprint as their version
+func (m gcpProjectMetadata) GetTags(ctx context.Context) (map[string]string, string, error) {
+	md, err := m.get(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tags := make(map[string]string)
+	for _, item := range md.Items {
+		if item.Value != nil {
+			tags[item.Key] = *item.Value
+		}
+	}
+	return tags, md.Fingerprint, nil
+}
+
+// SetTags fails with ErrConflict if the metadata has changed since version was read
+// The items are read again to be merged, but the write carries the fingerprint of version, not of this read
+func (m gcpProjectMetadata) SetTags(ctx context.Context, tags map[string]string, version string) error {
+	md, err := m.get(ctx)
+	if err != nil {
+		return err
+	}
+	if md.Fingerprint != version {
+		return leader.ErrConflict
+	}
+
+	for _, item := range md.Items {
+		if value, ok := tags[item.Key]; ok {
+			item.Value = &value
+			delete(tags, item.Key)
+		}
+	}
+	for key, value := range tags {
+		value := value
+		md.Items = append(md.Items, &compute.MetadataItems{Key: key, Value: &value})
+	}
+	md.Fingerprint = version
+
+	op, err := m.c.client.Projects.SetCommonInstanceMetadata(m.c.projectID, md).Context(ctx).Do()
+	if err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusPreconditionFailed {
+			return leader.ErrConflict
+		}
+		metrics.APIError("gcp", "Projects.SetCommonInstanceMetadata")
+		return fmt.Errorf("Failed to set project metadata: %s", err)
+	}
+
+	return m.c.waitForOp(ctx, op)
+}
@@ -0,0 +1,179 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/networkop/cloudroutesync/pkg/route"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+func TestLimitToQuota(t *testing.T) {
+	routes := []*compute.Route{
+		{Name: "a", DestRange: "10.0.1.0/24"},
+		{Name: "b", DestRange: "0.0.0.0/0"},
+		{Name: "c", DestRange: "10.0.0.0/16"},
+		{Name: "d", DestRange: "10.0.2.0/24"},
+	}
+
+	tests := []struct {
+		available int
+		kept      []string
+	}{
+		{available: -1, kept: []string{"a", "b", "c", "d"}},
+		{available: 4, kept: []string{"a", "b", "c", "d"}},
+		{available: 2, kept: []string{"b", "c"}},
+		{available: 3, kept: []string{"b", "c", "a"}},
+		{available: 0, kept: nil},
+	}
+
+	for _, tt := range tests {
+		kept, skipped := limitToQuota(routes, tt.available)
+		if len(kept)+len(skipped) != len(routes) {
+			t.Errorf("available %d: %d kept and %d skipped out of %d routes", tt.available, len(kept), len(skipped), len(routes))
+		}
+		if len(kept) != len(tt.kept) {
+			t.Errorf("available %d: expected %d routes to be kept, got %d", tt.available, len(tt.kept), len(kept))
+			continue
+		}
+		for i, name := range tt.kept {
+			if kept[i].Name != name {
+				t.Errorf("available %d: expected route %s at %d, got %s", tt.available, name, i, kept[i].Name)
+			}
+		}
+	}
+}
+
+func TestGcpNewRoute(t *testing.T) {
+	c := &GcpClient{
+		instanceID: "1234",
+		network:    "global/networks/default",
+		selfLink:   "projects/p/zones/z/instances/router",
+		settings:   GcpSettings{Tags: []string{"a", "b"}},
+		opts:       Options{OwnerTag: "crs"},
+	}
+
+	byIP := c.newRoute("10.0.0.0/24", "10.1.0.2")
+	if byIP.NextHopIp != "10.1.0.2" || byIP.NextHopInstance != "" || byIP.Name != "crs-10-0-0-0slash2410-1-0-2" {
+		t.Errorf("unexpected route via IP %+v", byIP)
+	}
+
+	c.settings.NextHopInstance = true
+	byInstance := c.newRoute("10.0.0.0/24", "10.1.0.2")
+	if byInstance.NextHopIp != "" || byInstance.NextHopInstance != c.selfLink || byInstance.Name != "crs-10-0-0-0slash241234" {
+		t.Errorf("unexpected route via instance %+v", byInstance)
+	}
+
+	// The ILB takes precedence for prefixes of its address family
+	c.ilb = &compute.ForwardingRule{Name: "ilb", IPAddress: "10.1.0.100", SelfLink: "projects/p/regions/r/forwardingRules/ilb"}
+	if byIlb := c.newRoute("10.0.0.0/24", "10.1.0.2"); byIlb.NextHopIlb != c.ilb.SelfLink || byIlb.NextHopInstance != "" || byIlb.Name != "crs-10-0-0-0slash24ilb" {
+		t.Errorf("unexpected route via ILB %+v", byIlb)
+	}
+	if v6 := c.newRoute("2001:db8::/64", "fd00::2"); v6.NextHopIlb != "" || v6.NextHopInstance != c.selfLink {
+		t.Errorf("IPv6 route must not use an IPv4 ILB, got %+v", v6)
+	}
+
+	current := &compute.Route{Priority: 0, Tags: []string{"b", "a"}}
+	if gcpRouteOutdated(current, byInstance) {
+		t.Errorf("route with reordered tags is reported outdated")
+	}
+	current.Priority = 1000
+	if !gcpRouteOutdated(current, byInstance) {
+		t.Errorf("route with another priority is not reported outdated")
+	}
+	current.Priority, current.Tags = 0, []string{"a"}
+	if !gcpRouteOutdated(current, byInstance) {
+		t.Errorf("route with other tags is not reported outdated")
+	}
+}
+
+func TestGcpFetchOwnedRoutes(t *testing.T) {
+	network := "https://www.googleapis.com/compute/v1/projects/p/global/networks/default"
+
+	var filters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters = append(filters, r.URL.Query().Get("filter"))
+		json.NewEncoder(w).Encode(&compute.RouteList{Items: []*compute.Route{
+			{Name: "crs-10-0-0-0slash24", Network: network},
+			{Name: "crs-10-1-0-0slash24", Network: network + "-other"},
+			{Name: "other-10-2-0-0slash24", Network: network},
+		}})
+	}))
+	defer srv.Close()
+
+	service, err := compute.NewService(context.Background(), option.WithEndpoint(srv.URL+"/"), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("failed to build compute service: %s", err)
+	}
+	c := &GcpClient{client: service, projectID: "p", opts: Options{OwnerTag: "crs"}}
+
+	tests := []struct {
+		network string
+		filter  string
+		names   []string
+	}{
+		{
+			filter: `(name eq "crs-.*")`,
+			names:  []string{"crs-10-0-0-0slash24", "crs-10-1-0-0slash24"},
+		},
+		{
+			network: network,
+			filter:  `(name eq "crs-.*") (network eq "https://www\.googleapis\.com/compute/v1/projects/p/global/networks/default")`,
+			names:   []string{"crs-10-0-0-0slash24"},
+		},
+	}
+
+	for _, tt := range tests {
+		filters = nil
+		routes, err := c.fetchOwnedRoutes(context.Background(), tt.network)
+		if err != nil {
+			t.Fatalf("failed to fetch routes of network %q: %s", tt.network, err)
+		}
+		if len(filters) != 1 || filters[0] != tt.filter {
+			t.Errorf("expected filter %s, got %q", tt.filter, filters)
+		}
+		var names []string
+		for _, r := range routes {
+			names = append(names, r.Name)
+		}
+		if !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("network %q: expected routes %v, got %v", tt.network, tt.names, names)
+		}
+	}
+}
+
+func TestGcpBuildRoutes(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/24")
+	c := &GcpClient{
+		internalIP: "10.1.0.2",
+		subnet:     subnet,
+		network:    "global/networks/default",
+		opts:       Options{OwnerTag: "crs"},
+	}
+
+	rt := route.Empty()
+	rt.Routes["10.0.1.0/24"] = route.NewNexthops(net.ParseIP("10.1.0.3"))
+	rt.Routes["10.0.2.0/24"] = route.NewNexthops(net.ParseIP("10.1.0.3"), net.ParseIP("10.1.0.4"))
+	rt.Routes["10.0.3.0/24"] = route.NewNexthops(net.ParseIP("10.1.0.3"), net.ParseIP("192.168.0.1"))
+	rt.Routes["10.0.4.0/24"] = route.NewNexthops(net.ParseIP("192.168.0.1"))
+	rt.Routes["10.0.5.0/24"] = route.NewNexthops(net.ParseIP("192.168.0.1"), net.ParseIP("192.168.0.2"))
+
+	// Prefixes with any local next hop are skipped, ECMP via remote next hops collapses into a single route via self
+	var got []string
+	for _, r := range c.buildRoutes(rt) {
+		got = append(got, r.DestRange+"->"+r.NextHopIp)
+	}
+	sort.Strings(got)
+
+	want := []string{"10.0.4.0/24->10.1.0.2", "10.0.5.0/24->10.1.0.2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected routes %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,520 @@
+package reconciler
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/attributestags"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/routers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
+	"github.com/networkop/cloudroutesync/pkg/diff"
+	"github.com/networkop/cloudroutesync/pkg/metrics"
+	"github.com/networkop/cloudroutesync/pkg/route"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	openstackMetadataURL = "http://169.254.169.254/openstack/latest/meta_data.json"
+	// Neutron tags are limited to 60 characters
+	openstackTagHashLength = 16
+)
+
+var openstackReservedRanges = []*net.IPNet{
+	route.ParseCIDR("224.0.0.0/4"),
+	route.ParseCIDR("255.255.255.255/32"),
+	route.ParseCIDR("127.0.0.0/8"),
+	route.ParseCIDR("169.254.0.0/16"),
+}
+
+var openstackReservedRangesV6 = []*net.IPNet{
+	route.ParseCIDR("ff00::/8"),
+	route.ParseCIDR("::1/128"),
+	route.ParseCIDR("fe80::/10"),
+}
+
+// OpenStack implementation details
+// * Routes are installed either as router extra routes or as subnet host routes pushed via DHCP
+// * Neutron routes carry no metadata, so every owned route is marked with a tag on the same resource
+// * Tags hold a hash of the route, which allows owned routes to be recognised after a restart
+// * Host routes can only be of the same address family as their subnet
+// * gophercloud has no per-request context, so the provider context is swapped before every call
+
+// OpenStackClient stores cloud client and values
+type OpenStackClient struct {
+	network     *gophercloud.ServiceClient
+	metadataURL string
+	mode        string
+	routerID    string
+	instanceID  string
+	subnetID    string
+	subnetIPv6  bool
+	subnets     []*net.IPNet
+	selfIP      net.IP
+	selfIPv6    net.IP
+	opts        Options
+}
+
+// NewOpenStackClient builds new OpenStack client using OS_* environment variables
+// mode is either "router" to manage router extra routes or "subnet" to manage subnet host routes
+// routerID is discovered from the local subnet if empty
+func NewOpenStackClient(opts Options, mode, routerID string) (*OpenStackClient, error) {
+	authOpts, err := openstack.AuthOptionsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read auth options from environment: %s", err)
+	}
+	authOpts.AllowReauth = true
+
+	provider, err := openstack.AuthenticatedClient(authOpts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to authenticate: %s", err)
+	}
+
+	network, err := openstack.NewNetworkV2(provider, gophercloud.EndpointOpts{
+		Region: os.Getenv("OS_REGION_NAME"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to build Neutron client: %s", err)
+	}
+
+	return newOpenStackClient(opts, network, openstackMetadataURL, mode, routerID), nil
+}
+
+func newOpenStackClient(opts Options, network *gophercloud.ServiceClient, metadataURL, mode, routerID string) *OpenStackClient {
+	if mode == "" {
+		mode = "router"
+	}
+	return &OpenStackClient{
+		network:     network,
+		metadataURL: metadataURL,
+		mode:        mode,
+		routerID:    routerID,
+		opts:        opts,
+	}
+}
+
+func (c *OpenStackClient) neutron(ctx context.Context) *gophercloud.ServiceClient {
+	c.network.ProviderClient.Context = ctx
+	return c.network
+}
+
+// Cleanup removes all owned routes and their tags
+func (c *OpenStackClient) Cleanup(ctx context.Context) error {
+	if err := c.lookupPort(ctx, nil); err != nil {
+		return fmt.Errorf("Failed to lookupPort: %s", err)
+	}
+	logrus.Infof("Deleting own routes from %s", c.tableName())
+	return c.syncRouteTable(ctx, route.Empty())
+}
+
+// Reconcile implements reconciler interface
+func (c *OpenStackClient) Reconcile(ctx context.Context, rt *route.Table, eventSync bool, syncInterval int) error {
+	if err := c.lookupPort(ctx, rt.DefaultIP); err != nil {
+		return fmt.Errorf("Failed to lookupPort: %s", err)
+	}
+
+	return runLoop(ctx, "openstack", rt, eventSync, syncInterval, c.syncRouteTable)
+}
+
+// Plan implements reconciler interface
+func (c *OpenStackClient) Plan(ctx context.Context, rt *route.Table) (Plans, error) {
+	if err := c.lookupPort(ctx, rt.DefaultIP); err != nil {
+		return nil, fmt.Errorf("Failed to lookupPort: %s", err)
+	}
+
+	current, tags, err := c.getRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return Plans{c.newPlan(c.diffRoutes(current, tags, c.buildRoutes(rt)))}, nil
+}
+
+// Withdraw implements reconciler interface
+func (c *OpenStackClient) Withdraw(ctx context.Context) error {
+	if c.subnetID == "" {
+		return fmt.Errorf("Local port has not been discovered yet")
+	}
+	logrus.Info("Withdrawing all owned routes")
+	return c.syncRouteTable(ctx, route.Empty())
+}
+
+func (c *OpenStackClient) tableName() string {
+	if c.mode == "subnet" {
+		return "subnet/" + c.subnetID
+	}
+	return "router/" + c.routerID
+}
+
+func (c *OpenStackClient) newPlan(changes diff.Result) *Plan {
+	return newPlan("openstack", c.tableName(), changes)
+}
+
+// ownerTag marks a single owned route
+func (c *OpenStackClient) ownerTag(r diff.Route) string {
+	sum := sha1.Sum([]byte(r.Prefix + "-" + r.Nexthop))
+	return fmt.Sprintf("%s-%x", c.opts.owner(), sum[:openstackTagHashLength/2])
+}
+
+func (c *OpenStackClient) isOwnerTag(tag string) bool {
+	return strings.HasPrefix(tag, c.opts.owner()+"-") && len(tag) == len(c.opts.owner())+1+openstackTagHashLength
+}
+
+func (c *OpenStackClient) isLocal(ip net.IP) bool {
+	for _, subnet := range c.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *OpenStackClient) buildRoutes(rt *route.Table) (result []diff.Route) {
+	for prefix, nextHops := range rt.Snapshot() {
+		ip, _, err := net.ParseCIDR(prefix)
+		if err != nil {
+			logrus.Infof("Failed to parse prefix: %s", prefix)
+			continue
+		}
+
+		if c.opts.isReserved(ip, openstackReservedRanges, openstackReservedRangesV6) {
+			logrus.Debugf("Ignoring IP from OpenStack reserved ranges: %s", ip)
+			continue
+		}
+
+		// Neutron rejects the whole update if a single host route is of another address family
+		if c.mode == "subnet" && (ip.To4() == nil) != c.subnetIPv6 {
+			logrus.Debugf("Ignoring prefix of another address family than subnet %s: %s", c.subnetID, prefix)
+			continue
+		}
+
+		selfIP := c.selfIP
+		if ip.To4() == nil {
+			selfIP = c.selfIPv6
+		}
+		if selfIP == nil {
+			logrus.Infof("No local IP of the same address family found for prefix: %s", prefix)
+			continue
+		}
+
+		// No ECMP support, picking the lowest next hop as primary
+		// Neutron can only reach next hops from the local subnet, all others are set to self
+		nextHop := nextHops.Primary()
+		if nextHop == nil || !c.isLocal(nextHop) || (ip.To4() == nil) != (nextHop.To4() == nil) {
+			nextHop = selfIP
+		}
+
+		result = append(result, diff.Route{
+			Prefix:  prefix,
+			Nexthop: nextHop.String(),
+		})
+	}
+	return result
+}
+
+// diffRoutes only deletes routes that carry an owner tag, leaving routes created by others intact
+func (c *OpenStackClient) diffRoutes(current []diff.Route, tags []string, proposed []diff.Route) diff.Result {
+	owned := make(map[string]bool)
+	for _, tag := range tags {
+		owned[tag] = true
+	}
+
+	return diff.Routes(current, proposed, func(r diff.Route) bool {
+		return owned[c.ownerTag(r)]
+	})
+}
+
+func (c *OpenStackClient) syncRouteTable(ctx context.Context, rt *route.Table) error {
+	current, tags, err := c.getRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.SetCloudRoutes("openstack", c.tableName(), len(current))
+
+	proposed := c.buildRoutes(rt)
+	changes := c.diffRoutes(current, tags, proposed)
+
+	plan := c.newPlan(changes)
+	metrics.SetDrift("openstack", plan.Table, plan.Changes())
+
+	if c.opts.DryRun {
+		c.opts.printPlan(plan)
+		return nil
+	}
+
+	// Neutron replaces the whole list at once, so replacements need no special handling
+	toAdd, toDelete := changes.Flatten()
+	if len(toAdd)+len(toDelete) > 0 {
+		deleted := make(map[diff.Route]bool)
+		for _, r := range toDelete {
+			deleted[r] = true
+		}
+
+		var routes []diff.Route
+		for _, r := range current {
+			if !deleted[r] {
+				routes = append(routes, r)
+			}
+		}
+		routes = append(routes, toAdd...)
+
+		logrus.Infof("Updating %s: %d to add, %d to delete", c.tableName(), len(toAdd), len(toDelete))
+		if err := c.setRoutes(ctx, routes); err != nil {
+			metrics.RoutesFailed("openstack", len(toAdd)+len(toDelete))
+			return err
+		}
+		metrics.RoutesAdded("openstack", len(changes.Add))
+		metrics.RoutesReplaced("openstack", len(changes.Replace))
+		metrics.RoutesDeleted("openstack", len(changes.Delete))
+		current = routes
+	}
+
+	// Tags are updated after the routes, so that a failure never leaves an owned route untagged
+	return c.syncTags(ctx, current, tags, proposed)
+}
+
+// syncTags marks all proposed routes present in the cloud as owned, dropping tags of other routes
+func (c *OpenStackClient) syncTags(ctx context.Context, current []diff.Route, tags []string, proposed []diff.Route) error {
+	present := make(map[diff.Route]bool)
+	for _, r := range current {
+		present[r] = true
+	}
+
+	newTags := []string{}
+	for _, tag := range tags {
+		if !c.isOwnerTag(tag) {
+			newTags = append(newTags, tag)
+		}
+	}
+	for _, r := range proposed {
+		if present[r] {
+			newTags = append(newTags, c.ownerTag(r))
+		}
+	}
+
+	if sameStrings(tags, newTags) {
+		return nil
+	}
+
+	resourceType, resourceID := "routers", c.routerID
+	if c.mode == "subnet" {
+		resourceType, resourceID = "subnets", c.subnetID
+	}
+
+	logrus.Debugf("Updating owner tags of %s", c.tableName())
+	_, err := attributestags.ReplaceAll(c.neutron(ctx), resourceType, resourceID, attributestags.ReplaceAllOpts{Tags: newTags}).Extract()
+	if err != nil {
+		metrics.APIError("openstack", "Tags.ReplaceAll")
+		return fmt.Errorf("Failed to update tags of %s: %s", c.tableName(), err)
+	}
+	return nil
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *OpenStackClient) getRoutes(ctx context.Context) ([]diff.Route, []string, error) {
+	var result []diff.Route
+
+	if c.mode == "subnet" {
+		subnet, err := subnets.Get(c.neutron(ctx), c.subnetID).Extract()
+		if err != nil {
+			metrics.APIError("openstack", "Subnets.Get")
+			return nil, nil, fmt.Errorf("Failed to get subnet %s: %s", c.subnetID, err)
+		}
+		for _, r := range subnet.HostRoutes {
+			result = append(result, diff.Route{Prefix: r.DestinationCIDR, Nexthop: r.NextHop})
+		}
+		return result, subnet.Tags, nil
+	}
+
+	router, err := routers.Get(c.neutron(ctx), c.routerID).Extract()
+	if err != nil {
+		metrics.APIError("openstack", "Routers.Get")
+		return nil, nil, fmt.Errorf("Failed to get router %s: %s", c.routerID, err)
+	}
+	for _, r := range router.Routes {
+		result = append(result, diff.Route{Prefix: r.DestinationCIDR, Nexthop: r.NextHop})
+	}
+	return result, router.Tags, nil
+}
+
+// setRoutes replaces all routes, Neutron has no API to add or remove a single one
+func (c *OpenStackClient) setRoutes(ctx context.Context, routes []diff.Route) error {
+	if c.mode == "subnet" {
+		hostRoutes := []subnets.HostRoute{}
+		for _, r := range routes {
+			hostRoutes = append(hostRoutes, subnets.HostRoute{DestinationCIDR: r.Prefix, NextHop: r.Nexthop})
+		}
+		_, err := subnets.Update(c.neutron(ctx), c.subnetID, subnets.UpdateOpts{HostRoutes: &hostRoutes}).Extract()
+		if err != nil {
+			metrics.APIError("openstack", "Subnets.Update")
+			return fmt.Errorf("Failed to update host routes of subnet %s: %s", c.subnetID, err)
+		}
+		return nil
+	}
+
+	routerRoutes := []routers.Route{}
+	for _, r := range routes {
+		routerRoutes = append(routerRoutes, routers.Route{DestinationCIDR: r.Prefix, NextHop: r.Nexthop})
+	}
+	_, err := routers.Update(c.neutron(ctx), c.routerID, routers.UpdateOpts{Routes: routerRoutes}).Extract()
+	if err != nil {
+		metrics.APIError("openstack", "Routers.Update")
+		return fmt.Errorf("Failed to update routes of router %s: %s", c.routerID, err)
+	}
+	return nil
+}
+
+// lookupInstanceID reads the instance UUID from the metadata service
+func (c *OpenStackClient) lookupInstanceID(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, c.metadataURL, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to read metadata: unexpected status %s", resp.Status)
+	}
+
+	var md struct {
+		UUID string `json:"uuid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&md); err != nil {
+		return fmt.Errorf("Failed to parse metadata: %s", err)
+	}
+	if md.UUID == "" {
+		return fmt.Errorf("Metadata has no instance UUID")
+	}
+
+	c.instanceID = md.UUID
+	return nil
+}
+
+// lookupPort finds the local port with myIP, or the first port if myIP is nil,
+// its subnets and, in router mode, the router attached to its primary subnet
+func (c *OpenStackClient) lookupPort(ctx context.Context, myIP net.IP) error {
+	if err := c.lookupInstanceID(ctx); err != nil {
+		return err
+	}
+	logrus.Debugf("Looking up ports of instance %s", c.instanceID)
+
+	pages, err := ports.List(c.neutron(ctx), ports.ListOpts{DeviceID: c.instanceID}).AllPages()
+	if err != nil {
+		metrics.APIError("openstack", "Ports.List")
+		return fmt.Errorf("Failed to list ports: %s", err)
+	}
+	allPorts, err := ports.ExtractPorts(pages)
+	if err != nil {
+		return fmt.Errorf("Failed to parse ports: %s", err)
+	}
+
+	for _, port := range allPorts {
+		if !portHasIP(port, myIP) {
+			continue
+		}
+		logrus.Debugf("Found local port %s", port.ID)
+
+		c.subnets, c.selfIP, c.selfIPv6, c.subnetID = nil, nil, nil, ""
+		for _, fixedIP := range port.FixedIPs {
+			subnet, err := subnets.Get(c.neutron(ctx), fixedIP.SubnetID).Extract()
+			if err != nil {
+				metrics.APIError("openstack", "Subnets.Get")
+				return fmt.Errorf("Failed to get subnet %s: %s", fixedIP.SubnetID, err)
+			}
+
+			ipNet := route.ParseCIDR(subnet.CIDR)
+			ip := net.ParseIP(fixedIP.IPAddress)
+			if ipNet == nil || ip == nil {
+				continue
+			}
+			c.subnets = append(c.subnets, ipNet)
+
+			if ip.To4() == nil {
+				c.selfIPv6 = ip
+			} else {
+				c.selfIP = ip
+			}
+
+			if c.subnetID == "" || (myIP != nil && ip.Equal(myIP)) {
+				c.subnetID, c.subnetIPv6 = fixedIP.SubnetID, ip.To4() == nil
+			}
+		}
+
+		if c.mode == "router" && c.routerID == "" {
+			return c.lookupRouter(ctx, port.NetworkID)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Could not find local port")
+}
+
+func portHasIP(port ports.Port, ip net.IP) bool {
+	if ip == nil {
+		return len(port.FixedIPs) > 0
+	}
+	for _, fixedIP := range port.FixedIPs {
+		if net.ParseIP(fixedIP.IPAddress).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupRouter finds the router with an interface in the local subnet
+func (c *OpenStackClient) lookupRouter(ctx context.Context, networkID string) error {
+	pages, err := ports.List(c.neutron(ctx), ports.ListOpts{NetworkID: networkID}).AllPages()
+	if err != nil {
+		metrics.APIError("openstack", "Ports.List")
+		return fmt.Errorf("Failed to list router ports: %s", err)
+	}
+	networkPorts, err := ports.ExtractPorts(pages)
+	if err != nil {
+		return fmt.Errorf("Failed to parse ports: %s", err)
+	}
+
+	for _, port := range networkPorts {
+		if !strings.HasPrefix(port.DeviceOwner, "network:router_interface") &&
+			port.DeviceOwner != "network:ha_router_replicated_interface" {
+			continue
+		}
+		for _, fixedIP := range port.FixedIPs {
+			if fixedIP.SubnetID == c.subnetID {
+				logrus.Debugf("Found router %s attached to subnet %s", port.DeviceID, c.subnetID)
+				c.routerID = port.DeviceID
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("Could not find a router attached to subnet %s", c.subnetID)
+}
@@ -0,0 +1,316 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/networkop/cloudroutesync/pkg/diff"
+	"github.com/networkop/cloudroutesync/pkg/route"
+)
+
+const (
+	testInstanceID = "instance-1"
+	testNetworkID  = "network-1"
+	testSubnetID   = "subnet-1"
+	testSubnetV6ID = "subnet-2"
+	testRouterID   = "router-1"
+)
+
+// fakeNeutron serves the subset of the metadata and Neutron APIs used by OpenStackClient
+type fakeNeutron struct {
+	mu            sync.Mutex
+	routerRoutes  []map[string]string
+	routerTags    []string
+	hostRoutes    []map[string]string
+	subnetTags    []string
+	routerUpdates int
+}
+
+func (f *fakeNeutron) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	switch {
+	case r.URL.Path == "/meta_data.json":
+		reply(map[string]string{"uuid": testInstanceID})
+
+	case r.URL.Path == "/v2.0/ports" && r.URL.Query().Get("device_id") == testInstanceID:
+		reply(map[string]interface{}{"ports": []interface{}{
+			map[string]interface{}{
+				"id":         "port-1",
+				"network_id": testNetworkID,
+				"device_id":  testInstanceID,
+				// The port is dual-stack, the IPv6 address is listed first
+				"fixed_ips": []interface{}{
+					map[string]string{"subnet_id": testSubnetV6ID, "ip_address": "fd00::5"},
+					map[string]string{"subnet_id": testSubnetID, "ip_address": "10.0.0.5"},
+				},
+			},
+		}})
+
+	case r.URL.Path == "/v2.0/ports" && r.URL.Query().Get("network_id") == testNetworkID:
+		reply(map[string]interface{}{"ports": []interface{}{
+			map[string]interface{}{
+				"id":           "port-2",
+				"network_id":   testNetworkID,
+				"device_id":    testRouterID,
+				"device_owner": "network:router_interface",
+				"fixed_ips":    []interface{}{map[string]string{"subnet_id": testSubnetID, "ip_address": "10.0.0.1"}},
+			},
+		}})
+
+	case r.URL.Path == "/v2.0/subnets/"+testSubnetID && r.Method == http.MethodGet:
+		reply(map[string]interface{}{"subnet": f.subnet()})
+
+	case r.URL.Path == "/v2.0/subnets/"+testSubnetV6ID && r.Method == http.MethodGet:
+		reply(map[string]interface{}{"subnet": map[string]interface{}{
+			"id":         testSubnetV6ID,
+			"network_id": testNetworkID,
+			"cidr":       "fd00::/64",
+			"ip_version": 6,
+		}})
+
+	case r.URL.Path == "/v2.0/subnets/"+testSubnetID && r.Method == http.MethodPut:
+		var body struct {
+			Subnet struct {
+				HostRoutes []map[string]string `json:"host_routes"`
+			} `json:"subnet"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.hostRoutes = body.Subnet.HostRoutes
+		reply(map[string]interface{}{"subnet": f.subnet()})
+
+	case r.URL.Path == "/v2.0/routers/"+testRouterID && r.Method == http.MethodGet:
+		reply(map[string]interface{}{"router": f.router()})
+
+	case r.URL.Path == "/v2.0/routers/"+testRouterID && r.Method == http.MethodPut:
+		var body struct {
+			Router struct {
+				Routes []map[string]string `json:"routes"`
+			} `json:"router"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.routerRoutes = body.Router.Routes
+		f.routerUpdates++
+		reply(map[string]interface{}{"router": f.router()})
+
+	case strings.HasSuffix(r.URL.Path, "/tags") && r.Method == http.MethodPut:
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if strings.HasPrefix(r.URL.Path, "/v2.0/routers/") {
+			f.routerTags = body.Tags
+		} else {
+			f.subnetTags = body.Tags
+		}
+		reply(map[string]interface{}{"tags": body.Tags})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeNeutron) subnet() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          testSubnetID,
+		"network_id":  testNetworkID,
+		"cidr":        "10.0.0.0/24",
+		"host_routes": f.hostRoutes,
+		"tags":        f.subnetTags,
+	}
+}
+
+func (f *fakeNeutron) router() map[string]interface{} {
+	return map[string]interface{}{
+		"id":     testRouterID,
+		"routes": f.routerRoutes,
+		"tags":   f.routerTags,
+	}
+}
+
+func (f *fakeNeutron) routes(subnet bool) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	list := f.routerRoutes
+	if subnet {
+		list = f.hostRoutes
+	}
+	var result []string
+	for _, r := range list {
+		result = append(result, r["destination"]+"->"+r["nexthop"])
+	}
+	sort.Strings(result)
+	return result
+}
+
+func newTestOpenStackClient(t *testing.T, mode string) (*OpenStackClient, *fakeNeutron) {
+	fake := &fakeNeutron{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	network := &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{},
+		Endpoint:       srv.URL + "/",
+		ResourceBase:   srv.URL + "/v2.0/",
+	}
+	c := newOpenStackClient(Options{OwnerTag: "test"}, network, srv.URL+"/meta_data.json", mode, "")
+	if err := c.lookupPort(context.Background(), net.ParseIP("10.0.0.5")); err != nil {
+		t.Fatalf("lookupPort: %s", err)
+	}
+	return c, fake
+}
+
+func testTable(routes map[string]string) *route.Table {
+	rt := route.Empty()
+	for prefix, nh := range routes {
+		rt.Routes[prefix] = route.NewNexthops(net.ParseIP(nh))
+	}
+	return rt
+}
+
+func TestOpenStackLookupPort(t *testing.T) {
+	c, _ := newTestOpenStackClient(t, "router")
+
+	if c.routerID != testRouterID {
+		t.Errorf("expected router %s, got %s", testRouterID, c.routerID)
+	}
+	if c.subnetID != testSubnetID {
+		t.Errorf("expected subnet %s, got %s", testSubnetID, c.subnetID)
+	}
+	if !c.selfIP.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("expected self IP 10.0.0.5, got %s", c.selfIP)
+	}
+}
+
+func TestOpenStackSync(t *testing.T) {
+	for _, mode := range []string{"router", "subnet"} {
+		t.Run(mode, func(t *testing.T) {
+			c, fake := newTestOpenStackClient(t, mode)
+			ctx := context.Background()
+
+			// A route created by somebody else must survive all syncs
+			fake.routerRoutes = []map[string]string{{"destination": "192.168.0.0/16", "nexthop": "10.0.0.9"}}
+			fake.hostRoutes = fake.routerRoutes
+
+			rt := testTable(map[string]string{
+				"198.51.100.0/24": "10.0.0.7",
+				"203.0.113.0/24":  "172.16.0.1",
+			})
+			if err := c.syncRouteTable(ctx, rt); err != nil {
+				t.Fatalf("sync: %s", err)
+			}
+			assertRoutes(t, fake.routes(mode == "subnet"), []string{
+				"192.168.0.0/16->10.0.0.9",
+				"198.51.100.0/24->10.0.0.7",
+				"203.0.113.0/24->10.0.0.5",
+			})
+
+			delete(rt.Routes, "203.0.113.0/24")
+			if err := c.syncRouteTable(ctx, rt); err != nil {
+				t.Fatalf("sync: %s", err)
+			}
+			assertRoutes(t, fake.routes(mode == "subnet"), []string{
+				"192.168.0.0/16->10.0.0.9",
+				"198.51.100.0/24->10.0.0.7",
+			})
+
+			if err := c.Withdraw(ctx); err != nil {
+				t.Fatalf("withdraw: %s", err)
+			}
+			assertRoutes(t, fake.routes(mode == "subnet"), []string{
+				"192.168.0.0/16->10.0.0.9",
+			})
+		})
+	}
+}
+
+func TestOpenStackDualStack(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{mode: "router", want: []string{"198.51.100.0/24->10.0.0.7", "2001:db8:1::/64->fd00::5", "2001:db8::/64->fd00::7"}},
+		// Host routes of the IPv4 subnet can only be IPv4 routes
+		{mode: "subnet", want: []string{"198.51.100.0/24->10.0.0.7"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			c, fake := newTestOpenStackClient(t, tt.mode)
+			if c.subnetID != testSubnetID || !c.selfIPv6.Equal(net.ParseIP("fd00::5")) {
+				t.Fatalf("expected subnet %s and self IPv6 fd00::5, got %s and %s", testSubnetID, c.subnetID, c.selfIPv6)
+			}
+
+			rt := testTable(map[string]string{
+				"198.51.100.0/24": "10.0.0.7",
+				"2001:db8::/64":   "fd00::7",
+				"2001:db8:1::/64": "2001:db8:ffff::1",
+			})
+			if err := c.syncRouteTable(context.Background(), rt); err != nil {
+				t.Fatalf("sync: %s", err)
+			}
+			assertRoutes(t, fake.routes(tt.mode == "subnet"), tt.want)
+		})
+	}
+}
+
+func TestOpenStackSyncNoop(t *testing.T) {
+	c, fake := newTestOpenStackClient(t, "router")
+	ctx := context.Background()
+
+	rt := testTable(map[string]string{"198.51.100.0/24": "10.0.0.7"})
+	for i := 0; i < 3; i++ {
+		if err := c.syncRouteTable(ctx, rt); err != nil {
+			t.Fatalf("sync: %s", err)
+		}
+	}
+	if fake.routerUpdates != 1 {
+		t.Errorf("expected a single router update, got %d", fake.routerUpdates)
+	}
+}
+
+func TestOpenStackPlan(t *testing.T) {
+	c, fake := newTestOpenStackClient(t, "router")
+
+	fake.routerRoutes = []map[string]string{{"destination": "198.51.100.0/24", "nexthop": "10.0.0.7"}}
+	fake.routerTags = []string{c.ownerTag(diff.Route{Prefix: "198.51.100.0/24", Nexthop: "10.0.0.7"})}
+
+	rt := testTable(map[string]string{"198.51.100.0/24": "10.0.0.8"})
+	rt.DefaultIP = net.ParseIP("10.0.0.5")
+	plans, err := c.Plan(context.Background(), rt)
+	if err != nil {
+		t.Fatalf("plan: %s", err)
+	}
+	if len(plans) != 1 {
+		t.Fatalf("expected a single plan, got %d", len(plans))
+	}
+	plan := plans[0]
+	if len(plan.Replace) != 1 || plan.Replace[0].From != "10.0.0.7" || plan.Replace[0].To != "10.0.0.8" {
+		t.Errorf("expected a single replacement, got %+v", plan)
+	}
+	if fake.routerUpdates != 0 {
+		t.Errorf("plan must not update the router")
+	}
+}
+
+func assertRoutes(t *testing.T, got, want []string) {
+	t.Helper()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected routes %v, got %v", want, got)
+	}
+}
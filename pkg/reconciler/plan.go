@@ -0,0 +1,105 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/networkop/cloudroutesync/pkg/diff"
+)
+
+// Plan describes changes to a single cloud route table
+type Plan struct {
+	Cloud   string               `json:"cloud"`
+	Table   string               `json:"table"`
+	Create  []PlannedRoute       `json:"create"`
+	Delete  []PlannedRoute       `json:"delete"`
+	Replace []PlannedReplacement `json:"replace"`
+}
+
+// PlannedRoute is a route that will be created or deleted
+type PlannedRoute struct {
+	Prefix  string `json:"prefix"`
+	Nexthop string `json:"nexthop"`
+}
+
+// PlannedReplacement is a route that will change its next hop
+type PlannedReplacement struct {
+	Prefix string `json:"prefix"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// newPlan builds a plan from the result of a route diff
+func newPlan(cloud, table string, changes diff.Result) *Plan {
+	plan := &Plan{
+		Cloud:   cloud,
+		Table:   table,
+		Create:  []PlannedRoute{},
+		Delete:  []PlannedRoute{},
+		Replace: []PlannedReplacement{},
+	}
+
+	for _, r := range changes.Add {
+		plan.Create = append(plan.Create, PlannedRoute{Prefix: r.Prefix, Nexthop: r.Nexthop})
+	}
+	for _, r := range changes.Delete {
+		plan.Delete = append(plan.Delete, PlannedRoute{Prefix: r.Prefix, Nexthop: r.Nexthop})
+	}
+	for _, r := range changes.Replace {
+		plan.Replace = append(plan.Replace, PlannedReplacement{Prefix: r.Prefix, From: r.From, To: r.To})
+	}
+
+	return plan
+}
+
+// Changes returns the number of routes to create, delete or replace
+func (p *Plan) Changes() int {
+	return len(p.Create) + len(p.Delete) + len(p.Replace)
+}
+
+// Empty returns true if there's nothing to change
+func (p *Plan) Empty() bool {
+	return p.Changes() == 0
+}
+
+// String returns human-readable plan
+func (p *Plan) String() string {
+	s := fmt.Sprintf("Route table %s (%s): %d to create, %d to delete, %d to replace\n",
+		p.Table, p.Cloud, len(p.Create), len(p.Delete), len(p.Replace))
+	for _, r := range p.Create {
+		s += fmt.Sprintf("  + %s -> %s\n", r.Prefix, r.Nexthop)
+	}
+	for _, r := range p.Delete {
+		s += fmt.Sprintf("  - %s -> %s\n", r.Prefix, r.Nexthop)
+	}
+	for _, r := range p.Replace {
+		s += fmt.Sprintf("  ~ %s: %s -> %s\n", r.Prefix, r.From, r.To)
+	}
+	return s
+}
+
+// Plans describe changes to every managed cloud route table
+type Plans []*Plan
+
+// Print writes all plans, json plans are written as a stream of objects
+func (p Plans) Print(w io.Writer, format string) error {
+	for _, plan := range p {
+		if err := plan.Print(w, format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Print writes the plan in either text or json format
+func (p *Plan) Print(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	}
+
+	_, err := fmt.Fprint(w, p.String())
+	return err
+}
@@ -1,13 +1,164 @@
 package reconciler
 
 import (
+	"context"
+	"net"
+	"os"
+	"time"
+
+	"github.com/networkop/cloudroutesync/pkg/health"
+	"github.com/networkop/cloudroutesync/pkg/leader"
+	"github.com/networkop/cloudroutesync/pkg/metrics"
 	"github.com/networkop/cloudroutesync/pkg/route"
+	"github.com/networkop/cloudroutesync/pkg/state"
+	"github.com/sirupsen/logrus"
 )
 
 const uniquePrefix = "cloudroutesync"
 
 // CloudClient defines generic Cloud Client interface
+// All methods return when their context is cancelled
 type CloudClient interface {
-	Reconcile(*route.Table, bool, int)
-	Cleanup() error
+	// Reconcile discovers cloud resources and keeps them in sync with the route table
+	Reconcile(ctx context.Context, rt *route.Table, eventSync bool, syncInterval int) error
+	// Plan returns the changes Reconcile would make to every managed route table, without applying them
+	Plan(ctx context.Context, rt *route.Table) (Plans, error)
+	// Withdraw removes all owned routes, it can only be called after Reconcile
+	Withdraw(ctx context.Context) error
+	// Cleanup removes any created objects
+	Cleanup(ctx context.Context) error
+}
+
+// LeaseProvider is implemented by clients that can keep leader election leases in cloud resource tags
+type LeaseProvider interface {
+	// LeaseStore discovers the local network and returns a lease store on one of its resources
+	LeaseStore(ctx context.Context, rt *route.Table) (leader.Store, error)
+}
+
+// BackendManager is implemented by clients that add the local instance to a load balancer used as next hop
+// It runs on every instance, whether it is the leader or not
+type BackendManager interface {
+	// ManageBackend keeps the local instance a backend while the route table has routes, until ctx is cancelled
+	ManageBackend(ctx context.Context, rt *route.Table, syncInterval int) error
+}
+
+// Options are settings common to all cloud clients
+type Options struct {
+	// OwnerTag marks cloud objects managed by cloudroutesync
+	OwnerTag string
+	// ReservedRanges are never synced, in addition to cloud-specific ranges
+	ReservedRanges []*net.IPNet
+	// DryRun prints planned changes instead of applying them
+	DryRun bool
+	// PlanFormat is either text or json
+	PlanFormat string
+	// State records owned routes of clouds that can not tag them
+	State state.Store
+	// Targets select the subnets or route tables that receive routes, the local subnet if empty
+	Targets Targets
+}
+
+// Targets select cloud subnets or route tables by ID, by tags or all of them in the local network
+type Targets struct {
+	// IDs of AWS route tables or subnets, names or resource IDs of Azure subnets
+	IDs []string
+	// Tags of AWS subnets or Azure VNETs, all of them must match
+	Tags map[string]string
+	// All subnets of the local VPC or VNET
+	All bool
+}
+
+// Empty returns true if only the local subnet is targeted
+func (t Targets) Empty() bool {
+	return len(t.IDs) == 0 && len(t.Tags) == 0 && !t.All
+}
+
+func (o Options) owner() string {
+	if o.OwnerTag == "" {
+		return uniquePrefix
+	}
+	return o.OwnerTag
+}
+
+// isReserved checks if ip belongs to reserved ranges of its address family or user-defined ones
+func (o Options) isReserved(ip net.IP, v4Ranges, v6Ranges []*net.IPNet) bool {
+	reservedRanges := v4Ranges
+	if ip.To4() == nil {
+		reservedRanges = v6Ranges
+	}
+	for _, subnet := range reservedRanges {
+		if subnet != nil && subnet.Contains(ip) {
+			return true
+		}
+	}
+	for _, subnet := range o.ReservedRanges {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// runLoop syncs the route table on every change in event mode or periodically otherwise
+func runLoop(ctx context.Context, cloud string, rt *route.Table, eventSync bool, syncInterval int, sync func(context.Context, *route.Table) error) error {
+	sync = timedSync(cloud, sync)
+
+	// All clients enter the loop once discovery is done
+	health.SetDiscovered(true, eventSync)
+	defer health.SetDiscovered(false, eventSync)
+
+	if eventSync {
+		// Changes signalled before entering the loop, e.g. while on standby, have already been consumed
+		if err := sync(ctx, rt); err != nil {
+			logrus.Infof("Failed to sync route table: %s", err)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-rt.SyncCh:
+				if err := sync(ctx, rt); err != nil {
+					logrus.Infof("Failed to sync route table: %s", err)
+				}
+			}
+		}
+	}
+
+	ticker := time.NewTicker(time.Duration(syncInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		if err := sync(ctx, rt); err != nil {
+			logrus.Infof("Failed to sync route table: %s", err)
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-rt.SyncCh:
+				logrus.Debug("Received sync signal in periodic mode, ignoring")
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
+
+// timedSync records duration and result of every sync for metrics and health checks
+func timedSync(cloud string, sync func(context.Context, *route.Table) error) func(context.Context, *route.Table) error {
+	return func(ctx context.Context, rt *route.Table) error {
+		start := time.Now()
+		err := sync(ctx, rt)
+		metrics.ObserveSync(cloud, start, err)
+		health.SyncDone(err)
+		return err
+	}
+}
+
+func (o Options) printPlan(plan *Plan) {
+	if err := plan.Print(os.Stdout, o.PlanFormat); err != nil {
+		logrus.Infof("Failed to print plan: %s", err)
+	}
 }
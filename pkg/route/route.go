@@ -1,17 +1,24 @@
 package route
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"net"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/jsimonetti/rtnetlink"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
-var internetDst = net.ParseIP("1.1.1.1")
+var (
+	internetDst   = net.ParseIP("1.1.1.1")
+	internetDstV6 = net.ParseIP("2606:4700:4700::1111")
+)
 
 // Route represents a single route
 type Route struct {
@@ -19,38 +26,152 @@ type Route struct {
 	Nexthop net.IP
 }
 
+// Nexthops is a sorted list of ECMP next hops of a single prefix
+type Nexthops []net.IP
+
+// NewNexthops returns a sorted list of unique next hops
+func NewNexthops(ips ...net.IP) Nexthops {
+	result := Nexthops{}
+	for _, ip := range ips {
+		if ip == nil || result.Contains(ip) {
+			continue
+		}
+		result = append(result, ip)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i].To16(), result[j].To16()) < 0
+	})
+	return result
+}
+
+// Primary returns a deterministic next hop for clouds that do not support ECMP
+func (nhs Nexthops) Primary() net.IP {
+	if len(nhs) == 0 {
+		return nil
+	}
+	return nhs[0]
+}
+
+// Contains returns true if ip is one of the next hops
+func (nhs Nexthops) Contains(ip net.IP) bool {
+	for _, nh := range nhs {
+		if nh.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal returns true if both lists contain the same next hops
+func (nhs Nexthops) Equal(other Nexthops) bool {
+	if len(nhs) != len(other) {
+		return false
+	}
+	for i := range nhs {
+		if !nhs[i].Equal(other[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (nhs Nexthops) String() string {
+	var result []string
+	for _, nh := range nhs {
+		result = append(result, nh.String())
+	}
+	return strings.Join(result, ",")
+}
+
+// Change is a single incremental update of the route table
+type Change struct {
+	Prefix   string
+	Nexthops Nexthops
+	Delete   bool
+}
+
 // Table is a list of routes
 type Table struct {
-	Routes      map[string]net.IP
+	Routes      map[string]Nexthops
 	SyncCh      chan bool
 	DefaultIntf string
 	DefaultIP   net.IP
+	DefaultIPv6 net.IP
+	mu          sync.RWMutex
 }
 
 var lookupCache = make(map[string]*net.IPNet)
 
 // New returns new route table
 func New(syncCh chan bool) *Table {
-	intf, ip, err := getDefaultIntf()
+	intf, ip, err := getDefaultIntf(unix.AF_INET, internetDst)
 	if err != nil {
 		logrus.Errorf("Failed to getDefaultIntfIP: %s", err)
 	}
 
+	// IPv6 is optional, single-stack hosts only get an IPv4 default
+	_, ipv6, err := getDefaultIntf(unix.AF_INET6, internetDstV6)
+	if err != nil {
+		logrus.Debugf("Failed to getDefaultIntfIP for IPv6: %s", err)
+	}
+
 	return &Table{
 		SyncCh:      syncCh,
-		Routes:      make(map[string]net.IP),
+		Routes:      make(map[string]Nexthops),
 		DefaultIP:   ip,
+		DefaultIPv6: ipv6,
 		DefaultIntf: intf,
 	}
 }
 
+// Empty returns a detached table without any routes
+// Syncing it removes all routes owned by cloudroutesync
+func Empty() *Table {
+	return &Table{
+		Routes: make(map[string]Nexthops),
+	}
+}
+
+// SelfIP returns the local IP of the same address family as ip
+func (rt *Table) SelfIP(ip net.IP) net.IP {
+	if ip.To4() == nil {
+		return rt.DefaultIPv6
+	}
+	return rt.DefaultIP
+}
+
 // Exists returns true if the route is in the table
 func (rt *Table) Exists(route Route) bool {
 	return false
 }
 
+// Snapshot returns a copy of the current routes
+func (rt *Table) Snapshot() map[string]Nexthops {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	result := make(map[string]Nexthops, len(rt.Routes))
+	for prefix, nh := range rt.Routes {
+		result[prefix] = nh
+	}
+	return result
+}
+
+// Len returns the number of routes in the table
+func (rt *Table) Len() int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return len(rt.Routes)
+}
+
 // String returns pretty route table
 func (rt *Table) String() string {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.string()
+}
+
+func (rt *Table) string() string {
 	s := fmt.Sprint("---------\n")
 	for prefix, nh := range rt.Routes {
 		s += fmt.Sprintf("%s -> %s\n", prefix, nh)
@@ -60,17 +181,59 @@ func (rt *Table) String() string {
 }
 
 // Update in-memory route table
-func (rt *Table) Update(currentRoutes map[string]net.IP) error {
+func (rt *Table) Update(currentRoutes map[string]Nexthops) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
 	if !reflect.DeepEqual(rt.Routes, currentRoutes) {
 		rt.Routes = currentRoutes
 		logrus.Infoln("Route change detected")
-		logrus.Debug(rt.String())
-		rt.SyncCh <- true
+		logrus.Debug(rt.string())
+		rt.notify()
 	}
 	return nil
 }
 
-func getDefaultIntf() (string, net.IP, error) {
+// Apply incrementally updates in-memory route table
+// A delete only removes the route if its nexthops match the ones we have stored
+func (rt *Table) Apply(changes []Change) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	changed := false
+	for _, c := range changes {
+		current, ok := rt.Routes[c.Prefix]
+		if c.Delete {
+			if ok && current.Equal(c.Nexthops) {
+				logrus.Debugf("Removing route %s -> %s", c.Prefix, c.Nexthops)
+				delete(rt.Routes, c.Prefix)
+				changed = true
+			}
+			continue
+		}
+		if !ok || !current.Equal(c.Nexthops) {
+			logrus.Debugf("Adding route %s -> %s", c.Prefix, c.Nexthops)
+			rt.Routes[c.Prefix] = c.Nexthops
+			changed = true
+		}
+	}
+
+	if changed {
+		logrus.Infoln("Route change detected")
+		logrus.Debug(rt.string())
+		rt.notify()
+	}
+}
+
+// notify signals the reconciler without blocking, pending signals are coalesced
+func (rt *Table) notify() {
+	select {
+	case rt.SyncCh <- true:
+	default:
+	}
+}
+
+func getDefaultIntf(family uint8, dst net.IP) (string, net.IP, error) {
 	conn, err := rtnetlink.Dial(nil)
 	if err != nil {
 		log.Fatal(err)
@@ -78,14 +241,19 @@ func getDefaultIntf() (string, net.IP, error) {
 	defer conn.Close()
 
 	attr := rtnetlink.RouteAttributes{
-		Dst: internetDst,
+		Dst: dst,
+	}
+
+	dstLength := 32
+	if family == unix.AF_INET6 {
+		dstLength = 128
 	}
 
 	lookup := &rtnetlink.RouteMessage{
-		Family:     unix.AF_INET,
+		Family:     family,
 		Table:      unix.RT_TABLE_MAIN,
 		Type:       unix.RTN_UNICAST,
-		DstLength:  uint8(32),
+		DstLength:  uint8(dstLength),
 		Attributes: attr,
 	}
 
@@ -0,0 +1,63 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// fileStore keeps the state in a local JSON file
+// Writes go to a temporary file which is renamed over the old one, so a crash never leaves a partial state
+type fileStore struct {
+	path string
+}
+
+// NewFileStore builds a store backed by a local file, its directory is created on first save
+func NewFileStore(path string) Store {
+	return &fileStore{path: path}
+}
+
+func (f *fileStore) Load(ctx context.Context) (*State, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed to read state file: %s", err)
+	}
+	return decode(data)
+}
+
+func (f *fileStore) Save(ctx context.Context, s *State) error {
+	data, err := encode(s)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Failed to create state directory: %s", err)
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Failed to create temporary state file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write state file: %s", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write state file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Failed to write state file: %s", err)
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("Failed to replace state file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ObjectBackend is a key-value store such as cloud object storage or a database table
+type ObjectBackend interface {
+	// Get returns nil data if the key does not exist
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// objectStore keeps the state as a single object of a key-value backend
+type objectStore struct {
+	backend ObjectBackend
+	key     string
+}
+
+// NewObjectStore builds a store keeping the state under key of an object backend
+func NewObjectStore(backend ObjectBackend, key string) Store {
+	return &objectStore{backend: backend, key: key}
+}
+
+func (o *objectStore) Load(ctx context.Context) (*State, error) {
+	data, err := o.backend.Get(ctx, o.key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read state object: %s", err)
+	}
+	return decode(data)
+}
+
+func (o *objectStore) Save(ctx context.Context, s *State) error {
+	data, err := encode(s)
+	if err != nil {
+		return err
+	}
+	if err := o.backend.Put(ctx, o.key, data); err != nil {
+		return fmt.Errorf("Failed to write state object: %s", err)
+	}
+	return nil
+}
+
+// s3Backend stores objects in an S3 bucket
+type s3Backend struct {
+	client *s3.S3
+	bucket string
+}
+
+// NewS3Backend builds an object backend for bucket in the region of the local instance
+func NewS3Backend(bucket string) (ObjectBackend, error) {
+	s, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create AWS session: %s", err)
+	}
+
+	config := aws.NewConfig()
+	if aws.StringValue(s.Config.Region) == "" {
+		region, err := ec2metadata.New(s).Region()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to discover AWS region: %s", err)
+		}
+		config = config.WithRegion(region)
+	}
+
+	return &s3Backend{client: s3.New(s, config), bucket: bucket}, nil
+}
+
+func (b *s3Backend) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := b.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+
+	return ioutil.ReadAll(out.Body)
+}
+
+func (b *s3Backend) Put(ctx context.Context, key string, data []byte) error {
+	_, err := b.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
@@ -0,0 +1,141 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/networkop/cloudroutesync/pkg/diff"
+)
+
+// State records routes created by cloudroutesync, per cloud route table
+// Clouds that can not tag routes rely on it to tell owned routes from ones added by others
+type State struct {
+	Tables map[string][]diff.Route `json:"tables"`
+	// Previous route tables of subnets by subnet ID, restored on cleanup
+	Previous map[string]string `json:"previous,omitempty"`
+}
+
+// Store loads and saves the state
+type Store interface {
+	// Load returns an empty state if nothing has been saved yet
+	Load(ctx context.Context) (*State, error)
+	Save(ctx context.Context, s *State) error
+}
+
+// New builds a store from its location, either a file path or s3://bucket/key
+func New(location string) (Store, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return NewFileStore(location), nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse state location %q: %s", location, err)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("State location %q must be s3://bucket/key", location)
+	}
+
+	backend, err := NewS3Backend(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	return NewObjectStore(backend, key), nil
+}
+
+// Owned returns owned routes of a route table keyed by prefix
+func (s *State) Owned(table string) map[string]string {
+	result := make(map[string]string)
+	for _, r := range s.Tables[table] {
+		result[r.Prefix] = r.Nexthop
+	}
+	return result
+}
+
+// SetOwned replaces owned routes of a route table, an empty map removes the table
+func (s *State) SetOwned(table string, owned map[string]string) {
+	if s.Tables == nil {
+		s.Tables = make(map[string][]diff.Route)
+	}
+	if len(owned) == 0 {
+		delete(s.Tables, table)
+		return
+	}
+
+	routes := make([]diff.Route, 0, len(owned))
+	for prefix, nextHop := range owned {
+		routes = append(routes, diff.Route{Prefix: prefix, Nexthop: nextHop})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Prefix < routes[j].Prefix })
+	s.Tables[table] = routes
+}
+
+// SetPrevious records the route table a subnet used before it was associated with a managed one
+// An empty route table forgets the subnet
+func (s *State) SetPrevious(subnet, table string) {
+	if s.Previous == nil {
+		s.Previous = make(map[string]string)
+	}
+	if table == "" {
+		delete(s.Previous, subnet)
+		return
+	}
+	s.Previous[subnet] = table
+}
+
+func decode(data []byte) (*State, error) {
+	s := &State{Tables: make(map[string][]diff.Route)}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("Failed to decode state: %s", err)
+	}
+	if s.Tables == nil {
+		s.Tables = make(map[string][]diff.Route)
+	}
+	return s, nil
+}
+
+func encode(s *State) ([]byte, error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode state: %s", err)
+	}
+	return data, nil
+}
+
+// memoryStore keeps the state for the lifetime of the process
+type memoryStore struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// NewMemoryStore builds a store that does not survive restarts
+func NewMemoryStore() Store {
+	return &memoryStore{}
+}
+
+func (m *memoryStore) Load(ctx context.Context) (*State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return decode(m.data)
+}
+
+func (m *memoryStore) Save(ctx context.Context, s *State) error {
+	data, err := encode(s)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = data
+	return nil
+}
@@ -0,0 +1,84 @@
+package state
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type memoryBackend map[string][]byte
+
+func (m memoryBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	return m[key], nil
+}
+
+func (m memoryBackend) Put(ctx context.Context, key string, data []byte) error {
+	m[key] = data
+	return nil
+}
+
+func TestStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]Store{
+		"file":   NewFileStore(filepath.Join(dir, "nested", "state.json")),
+		"object": NewObjectStore(memoryBackend{}, "cloudroutesync/state.json"),
+		"memory": NewMemoryStore(),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			st, err := store.Load(ctx)
+			if err != nil {
+				t.Fatalf("Load of empty store: %s", err)
+			}
+			if len(st.Owned("rtb-1")) != 0 {
+				t.Fatalf("Empty store owns %v", st.Owned("rtb-1"))
+			}
+
+			owned := map[string]string{"10.0.0.0/16": "eni-1", "2001:db8::/64": "eni-2"}
+			st.SetOwned("rtb-1", owned)
+			st.SetOwned("rtb-2", map[string]string{"10.1.0.0/16": "eni-1"})
+			if err := store.Save(ctx, st); err != nil {
+				t.Fatalf("Save: %s", err)
+			}
+
+			st, err = store.Load(ctx)
+			if err != nil {
+				t.Fatalf("Load: %s", err)
+			}
+			if got := st.Owned("rtb-1"); !reflect.DeepEqual(got, owned) {
+				t.Errorf("Owned(rtb-1) = %v, want %v", got, owned)
+			}
+
+			st.SetOwned("rtb-2", nil)
+			if err := store.Save(ctx, st); err != nil {
+				t.Fatalf("Save: %s", err)
+			}
+			st, err = store.Load(ctx)
+			if err != nil {
+				t.Fatalf("Load: %s", err)
+			}
+			if _, ok := st.Tables["rtb-2"]; ok {
+				t.Errorf("Table rtb-2 is still recorded after its owned routes have been cleared")
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, location := range []string{"s3://bucket", "s3:///key"} {
+		if _, err := New(location); err == nil {
+			t.Errorf("New(%q) did not fail", location)
+		}
+	}
+}